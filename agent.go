@@ -0,0 +1,591 @@
+package wapsnmp
+
+/* This file implements an SNMP agent: it answers Get, GetNext, GetBulk and Set
+   requests using handlers registered for subtrees of the MIB.
+
+   References : RFC 1157 section 4.1, RFC 3416 section 4.2 (PDU processing),
+                RFC 3584 section 4.1 (SNMPv1 access to SNMPv2 MIBs).
+*/
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+// Handler serves the instances in a subtree of the MIB.
+type Handler interface {
+	// Get returns the value of the instance oid. Return NoSuchObject or
+	// NoSuchInstance as the value if there is no such instance.
+	Get(oid Oid) (interface{}, error)
+	// GetNext returns the first instance in the handler's subtree that comes
+	// after oid, or a nil Oid if there is none.
+	GetNext(oid Oid) (Oid, interface{}, error)
+	// Set sets the value of the instance oid. Return an ErrorStatus, e.g.
+	// NotWritable or WrongType, to refuse. Other errors are reported as
+	// GenErr.
+	Set(oid Oid, value interface{}) error
+}
+
+// SetTester is implemented by Handlers that can check whether a Set would
+// succeed without applying it. Every varbind of a Set request is tested
+// before any of them is set.
+type SetTester interface {
+	TestSet(oid Oid, value interface{}) error
+}
+
+// Table is a conceptual table served by RegisterTable. It is queried for
+// every request, so rows can come and go.
+type Table interface {
+	// Columns returns the column numbers of the table, e.g. 1 for ifIndex.
+	Columns() []int
+	// Rows returns the indexes of the rows, the part of the oid of an
+	// instance after the column number, in lexicographic order. They are
+	// searched on every request, so keep them sorted as rows come and go
+	// rather than sorting them on every call.
+	Rows() []Oid
+	// Value returns the value of a column in a row, or false if there is
+	// none.
+	Value(column int, index Oid) (interface{}, bool)
+}
+
+// WritableTable is a Table that accepts Set requests.
+type WritableTable interface {
+	Table
+	// SetValue sets the value of a column in a row. Return an ErrorStatus to
+	// refuse.
+	SetValue(column int, index Oid, value interface{}) error
+}
+
+type registration struct {
+	subtree Oid
+	handler Handler
+}
+
+// Agent answers SNMPv1 and SNMPv2c requests on a UDP socket.
+type Agent struct {
+	// ReadCommunity is the community allowed to read.
+	ReadCommunity string
+	// WriteCommunity is the community allowed to read and write. Set requests
+	// are refused when it is empty.
+	WriteCommunity string
+	// MaxMessageSize is the largest response the agent sends.
+	MaxMessageSize int
+	// ErrorHandler is called for requests that can't be answered, e.g.
+	// because they can't be decoded or use the wrong community. They are
+	// dropped silently when it is nil.
+	ErrorHandler func(source net.Addr, err error)
+
+	mu        sync.RWMutex
+	handlers  []registration // Sorted by subtree.
+	conn      net.PacketConn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewAgent creates an Agent bound to a UDP address, e.g. ":161".
+func NewAgent(address, readCommunity, writeCommunity string) (*Agent, error) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf(`error listening on ("udp", "%s"): %s`, address, err)
+	}
+	return NewAgentOnConn(conn, readCommunity, writeCommunity), nil
+}
+
+// NewAgentOnConn creates an Agent from an existing net.PacketConn.
+func NewAgentOnConn(conn net.PacketConn, readCommunity, writeCommunity string) *Agent {
+	return &Agent{
+		ReadCommunity:  readCommunity,
+		WriteCommunity: writeCommunity,
+		MaxMessageSize: bufSize,
+		conn:           conn,
+		closed:         make(chan struct{}),
+	}
+}
+
+// Register makes handler serve the subtree of the MIB below subtree,
+// replacing any handler registered for the same subtree. Gets go to the
+// handler with the longest matching subtree, so subtrees shouldn't overlap
+// if GetNext is to visit every instance.
+func (a *Agent) Register(subtree Oid, handler Handler) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	idx := sort.Search(len(a.handlers), func(i int) bool { return a.handlers[i].subtree.Compare(subtree) >= 0 })
+	if idx < len(a.handlers) && a.handlers[idx].subtree.Equal(subtree) {
+		a.handlers[idx].handler = handler
+		return
+	}
+	a.handlers = append(a.handlers, registration{})
+	copy(a.handlers[idx+1:], a.handlers[idx:])
+	a.handlers[idx] = registration{subtree.Copy(), handler}
+}
+
+// unregister removes the handler registered for subtree.
+func (a *Agent) unregister(subtree Oid) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for idx, r := range a.handlers {
+		if r.subtree.Equal(subtree) {
+			a.handlers = append(a.handlers[:idx], a.handlers[idx+1:]...)
+			return
+		}
+	}
+}
+
+// RegisterScalar serves the scalar object oid, whose only instance is oid.0.
+// get is called for every request. If set is nil the object is read-only.
+func (a *Agent) RegisterScalar(oid Oid, get func() interface{}, set func(value interface{}) error) {
+	a.Register(oid, &scalarHandler{append(oid.Copy(), 0), get, set})
+}
+
+// RegisterTable serves a conceptual table below entry, the oid of its
+// xxxEntry object. Set requests are accepted if table is a WritableTable.
+func (a *Agent) RegisterTable(entry Oid, table Table) {
+	a.Register(entry, &tableHandler{entry.Copy(), table})
+}
+
+// Addr returns the address the agent is bound to.
+func (a *Agent) Addr() net.Addr {
+	return a.conn.LocalAddr()
+}
+
+// Serve answers requests until the agent is closed. Returns nil when stopped
+// by Close.
+func (a *Agent) Serve() error {
+	buf := make([]byte, bufSize)
+	for {
+		numRead, source, err := a.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-a.closed:
+				return nil
+			default:
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		response, err := a.handlePacket(buf[:numRead])
+		if err == nil {
+			_, err = a.conn.WriteTo(response, source)
+		}
+		if err != nil && a.ErrorHandler != nil {
+			a.ErrorHandler(source, err)
+		}
+	}
+}
+
+// Close stops the agent and closes its socket.
+func (a *Agent) Close() error {
+	var err error
+	a.closeOnce.Do(func() {
+		close(a.closed)
+		err = a.conn.Close()
+	})
+	return err
+}
+
+// handlePacket decodes a request and returns the response to send.
+func (a *Agent) handlePacket(packet []byte) ([]byte, error) {
+	decoded, err := DecodeSequence(packet)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) != 4 {
+		return nil, fmt.Errorf("message has %d elements, want 3", len(decoded)-1)
+	}
+	version, ok1 := decoded[1].(int64)
+	community, ok2 := decoded[2].(string)
+	pdu, ok3 := decoded[3].([]interface{})
+	if !ok1 || !ok2 || !ok3 || len(pdu) != 5 {
+		return nil, fmt.Errorf("malformed message %v", decoded)
+	}
+	if version != int64(SNMPv1) && version != int64(SNMPv2c) {
+		return nil, fmt.Errorf("unsupported SNMP version %d", version)
+	}
+	requestID, ok1 := pdu[1].(int64)
+	nonRepeaters, ok2 := pdu[2].(int64)
+	maxRepetitions, ok3 := pdu[3].(int64)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, fmt.Errorf("malformed PDU %v", pdu)
+	}
+	varbinds, err := decodeVarbinds(pdu[4])
+	if err != nil {
+		return nil, err
+	}
+
+	canWrite := a.WriteCommunity != "" && community == a.WriteCommunity
+	if !canWrite && (community != a.ReadCommunity || pdu[0] == AsnSetRequest) {
+		return nil, fmt.Errorf("request with unauthorized community %q", community)
+	}
+
+	req := &agentRequest{version: SNMPVersion(version), varbinds: varbinds}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	switch pdu[0] {
+	case AsnGetRequest:
+		err = a.get(req)
+	case AsnGetNextRequest:
+		err = a.getNext(req)
+	case AsnGetBulkRequest:
+		if req.version == SNMPv1 {
+			return nil, errors.New("GetBulk request in an SNMPv1 message")
+		}
+		err = a.getBulk(req, int(nonRepeaters), int(maxRepetitions))
+	case AsnSetRequest:
+		err = a.set(req)
+	default:
+		return nil, fmt.Errorf("unexpected PDU type %v", pdu[0])
+	}
+	if err != nil {
+		req.fail(GenErr, 0)
+	}
+	return a.response(req, community, requestID, pdu[0] == AsnGetBulkRequest)
+}
+
+// agentRequest holds the state of a request being answered.
+type agentRequest struct {
+	version  SNMPVersion
+	varbinds []SNMPValue
+
+	results    []SNMPValue
+	status     ErrorStatus
+	errorIndex int
+}
+
+// fail sets the error-status of the response. index is the index, starting
+// at 1, of the varbind that caused it.
+func (r *agentRequest) fail(status ErrorStatus, index int) {
+	r.status = status
+	r.errorIndex = index
+	if r.version == SNMPv1 {
+		r.status = status.v1()
+	}
+}
+
+// response encodes the response to a request. If it doesn't fit
+// MaxMessageSize varbinds are dropped from the end for GetBulk, otherwise
+// the response is a tooBig error.
+func (a *Agent) response(req *agentRequest, community string, requestID int64, bulk bool) ([]byte, error) {
+	for {
+		varbinds := req.results
+		if req.status != NoError {
+			// Error responses carry the varbinds of the request.
+			varbinds = req.varbinds
+		}
+		result, err := EncodeSequence([]interface{}{Sequence, int(req.version), community,
+			[]interface{}{AsnGetResponse, requestID, int(req.status), req.errorIndex, encodeVarbinds(varbinds)}})
+		if err != nil {
+			if req.status == NoError {
+				// A handler returned a value that can't be encoded.
+				req.fail(GenErr, 0)
+				continue
+			}
+			return nil, err
+		}
+		if len(result) <= a.MaxMessageSize {
+			return result, nil
+		}
+		switch {
+		case bulk && req.status == NoError && len(req.results) > 0:
+			req.results = req.results[:len(req.results)-1]
+		case req.status != TooBig:
+			req.fail(TooBig, 0)
+			if req.version != SNMPv1 {
+				req.varbinds = nil
+			}
+		default:
+			return nil, fmt.Errorf("tooBig response of %d bytes exceeds %d bytes", len(result), a.MaxMessageSize)
+		}
+	}
+}
+
+// lookup returns the handler with the longest subtree containing oid.
+func (a *Agent) lookup(oid Oid) Handler {
+	for idx := len(a.handlers) - 1; idx >= 0; idx-- {
+		if oid.Within(a.handlers[idx].subtree) {
+			return a.handlers[idx].handler
+		}
+	}
+	return nil
+}
+
+// next returns the first instance after oid, or EndOfMibView.
+func (a *Agent) next(oid Oid, version SNMPVersion) (SNMPValue, error) {
+	for _, r := range a.handlers {
+		from := oid
+		if oid.Compare(r.subtree) < 0 {
+			from = r.subtree
+		} else if !oid.Within(r.subtree) {
+			// The whole subtree comes before oid.
+			continue
+		}
+		for {
+			next, value, err := r.handler.GetNext(from)
+			if err != nil {
+				return SNMPValue{}, err
+			}
+			if next == nil {
+				break
+			}
+			if next.Compare(from) <= 0 || !next.Within(r.subtree) {
+				return SNMPValue{}, fmt.Errorf("handler for %v returned %v as the instance after %v", r.subtree, next, from)
+			}
+			// SNMPv1 can't represent Counter64, so those instances are
+			// skipped, RFC 3584 section 4.1.2.1.
+			if _, ok := value.(Counter64); ok && version == SNMPv1 {
+				from = next
+				continue
+			}
+			return SNMPValue{next, value}, nil
+		}
+	}
+	return SNMPValue{oid, EndOfMibView}, nil
+}
+
+func (a *Agent) get(req *agentRequest) error {
+	for idx, v := range req.varbinds {
+		value := interface{}(NoSuchObject)
+		if handler := a.lookup(v.Oid); handler != nil {
+			var err error
+			if value, err = handler.Get(v.Oid); err != nil {
+				return err
+			}
+		}
+		if req.version == SNMPv1 {
+			_, isCounter64 := value.(Counter64)
+			if value == NoSuchObject || value == NoSuchInstance || isCounter64 {
+				req.fail(NoSuchName, idx+1)
+				return nil
+			}
+		}
+		req.results = append(req.results, SNMPValue{v.Oid, value})
+	}
+	return nil
+}
+
+func (a *Agent) getNext(req *agentRequest) error {
+	for idx, v := range req.varbinds {
+		result, err := a.next(v.Oid, req.version)
+		if err != nil {
+			return err
+		}
+		if req.version == SNMPv1 && result.Value == EndOfMibView {
+			req.fail(NoSuchName, idx+1)
+			return nil
+		}
+		req.results = append(req.results, result)
+	}
+	return nil
+}
+
+func (a *Agent) getBulk(req *agentRequest, nonRepeaters, maxRepetitions int) error {
+	if nonRepeaters < 0 {
+		nonRepeaters = 0
+	}
+	if nonRepeaters > len(req.varbinds) {
+		nonRepeaters = len(req.varbinds)
+	}
+	size := 0
+	for _, v := range req.varbinds[:nonRepeaters] {
+		result, err := a.next(v.Oid, req.version)
+		if err != nil {
+			return err
+		}
+		req.results = append(req.results, result)
+		size += len(result.Oid) + 1
+	}
+
+	// The repeaters are answered interleaved, the first row for every
+	// repeater, then the second, until every one reached the end of the MIB.
+	// Stop early if the response is sure not to fit anyway, at least one
+	// byte per oid component.
+	last := make([]Oid, 0, len(req.varbinds)-nonRepeaters)
+	for _, v := range req.varbinds[nonRepeaters:] {
+		last = append(last, v.Oid)
+	}
+	for rep := 0; rep < maxRepetitions && len(last) > 0 && size <= a.MaxMessageSize; rep++ {
+		atEnd := true
+		for idx, oid := range last {
+			result, err := a.next(oid, req.version)
+			if err != nil {
+				return err
+			}
+			req.results = append(req.results, result)
+			size += len(result.Oid) + 1
+			last[idx] = result.Oid
+			if result.Value != EndOfMibView {
+				atEnd = false
+			}
+		}
+		if atEnd {
+			break
+		}
+	}
+	return nil
+}
+
+// set applies the varbinds one by one, in order, after testing them all with
+// handlers implementing SetTester. It stops at the first that fails to set,
+// so varbinds before it have been set.
+func (a *Agent) set(req *agentRequest) error {
+	handlers := make([]Handler, len(req.varbinds))
+	for idx, v := range req.varbinds {
+		handlers[idx] = a.lookup(v.Oid)
+		if handlers[idx] == nil {
+			req.fail(NotWritable, idx+1)
+			return nil
+		}
+		if tester, ok := handlers[idx].(SetTester); ok {
+			if err := tester.TestSet(v.Oid, v.Value); err != nil {
+				req.fail(setErrorStatus(err), idx+1)
+				return nil
+			}
+		}
+	}
+	for idx, v := range req.varbinds {
+		if err := handlers[idx].Set(v.Oid, v.Value); err != nil {
+			req.fail(setErrorStatus(err), idx+1)
+			return nil
+		}
+	}
+	req.results = req.varbinds
+	return nil
+}
+
+// setErrorStatus returns the error-status for an error returned by a
+// handler's Set or TestSet.
+func setErrorStatus(err error) ErrorStatus {
+	var status ErrorStatus
+	if !errors.As(err, &status) {
+		status = GenErr
+	}
+	return status
+}
+
+// scalarHandler serves a scalar object.
+type scalarHandler struct {
+	instance Oid
+	get      func() interface{}
+	set      func(value interface{}) error
+}
+
+func (s *scalarHandler) Get(oid Oid) (interface{}, error) {
+	if !oid.Equal(s.instance) {
+		return NoSuchInstance, nil
+	}
+	return s.get(), nil
+}
+
+func (s *scalarHandler) GetNext(oid Oid) (Oid, interface{}, error) {
+	if oid.Compare(s.instance) >= 0 {
+		return nil, nil, nil
+	}
+	return s.instance, s.get(), nil
+}
+
+func (s *scalarHandler) TestSet(oid Oid, value interface{}) error {
+	if !oid.Equal(s.instance) {
+		return NoCreation
+	}
+	if s.set == nil {
+		return NotWritable
+	}
+	return nil
+}
+
+func (s *scalarHandler) Set(oid Oid, value interface{}) error {
+	if err := s.TestSet(oid, value); err != nil {
+		return err
+	}
+	return s.set(value)
+}
+
+// tableHandler serves a conceptual table.
+type tableHandler struct {
+	entry Oid
+	table Table
+}
+
+// split splits an instance oid into its column and index.
+func (t *tableHandler) split(oid Oid) (int, Oid, bool) {
+	if len(oid) <= len(t.entry)+1 {
+		return 0, nil, false
+	}
+	return oid[len(t.entry)], oid[len(t.entry)+1:], true
+}
+
+func (t *tableHandler) hasColumn(column int) bool {
+	for _, c := range t.table.Columns() {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *tableHandler) Get(oid Oid) (interface{}, error) {
+	column, index, ok := t.split(oid)
+	if !ok || !t.hasColumn(column) {
+		if len(oid) == len(t.entry)+1 && t.hasColumn(oid[len(t.entry)]) {
+			return NoSuchInstance, nil
+		}
+		return NoSuchObject, nil
+	}
+	rows := t.table.Rows()
+	i := sort.Search(len(rows), func(i int) bool { return rows[i].Compare(index) >= 0 })
+	if i < len(rows) && rows[i].Equal(index) {
+		if value, ok := t.table.Value(column, index); ok {
+			return value, nil
+		}
+	}
+	return NoSuchInstance, nil
+}
+
+func (t *tableHandler) GetNext(oid Oid) (Oid, interface{}, error) {
+	columns := append([]int{}, t.table.Columns()...)
+	sort.Ints(columns)
+	rows := t.table.Rows()
+
+	for _, column := range columns {
+		columnOid := append(t.entry.Copy(), column)
+		first := 0
+		if oid.Within(columnOid) {
+			// The first row whose instance comes after oid.
+			after := oid[len(columnOid):]
+			first = sort.Search(len(rows), func(i int) bool { return rows[i].Compare(after) > 0 })
+		} else if columnOid.Compare(oid) < 0 {
+			continue
+		}
+		for _, row := range rows[first:] {
+			if value, ok := t.table.Value(column, row); ok {
+				return append(columnOid, row...), value, nil
+			}
+		}
+	}
+	return nil, nil, nil
+}
+
+func (t *tableHandler) TestSet(oid Oid, value interface{}) error {
+	column, _, ok := t.split(oid)
+	if !ok || !t.hasColumn(column) {
+		return NoCreation
+	}
+	if _, ok := t.table.(WritableTable); !ok {
+		return NotWritable
+	}
+	return nil
+}
+
+func (t *tableHandler) Set(oid Oid, value interface{}) error {
+	if err := t.TestSet(oid, value); err != nil {
+		return err
+	}
+	column, index, _ := t.split(oid)
+	return t.table.(WritableTable).SetValue(column, index, value)
+}
@@ -0,0 +1,344 @@
+package wapsnmp
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testIfTable is a two row ifTable with the ifIndex and ifDescr columns.
+type testIfTable struct {
+	descr map[int]string
+}
+
+func (t *testIfTable) Columns() []int { return []int{2, 1} }
+
+func (t *testIfTable) Rows() []Oid { return []Oid{{1}, {2}} }
+
+func (t *testIfTable) Value(column int, index Oid) (interface{}, bool) {
+	switch column {
+	case 1:
+		return index[0], true
+	case 2:
+		return t.descr[index[0]], true
+	}
+	return nil, false
+}
+
+func (t *testIfTable) SetValue(column int, index Oid, value interface{}) error {
+	descr, ok := value.(string)
+	if column != 2 || !ok {
+		return WrongType
+	}
+	t.descr[index[0]] = descr
+	return nil
+}
+
+// newTestAgent returns an agent serving sysDescr.0, a writable sysContact.0
+// and ifTable, without a socket.
+func newTestAgent() *Agent {
+	a := NewAgentOnConn(nil, "public", "private")
+	a.RegisterScalar(MustParseOid(".1.3.6.1.2.1.1.1"), func() interface{} { return "test agent" }, nil)
+	contact := "nobody"
+	a.RegisterScalar(MustParseOid(".1.3.6.1.2.1.1.4"), func() interface{} { return contact },
+		func(value interface{}) error {
+			s, ok := value.(string)
+			if !ok {
+				return WrongType
+			}
+			contact = s
+			return nil
+		})
+	a.RegisterTable(MustParseOid(".1.3.6.1.2.1.2.2.1"), &testIfTable{map[int]string{1: "lo", 2: "eth0"}})
+	return a
+}
+
+// testAgentRequest sends a request to an agent, and decodes the response PDU.
+func testAgentRequest(t *testing.T, a *Agent, version SNMPVersion, community string, pdu []interface{}) []interface{} {
+	t.Helper()
+	packet, err := EncodeSequence([]interface{}{Sequence, int(version), community, pdu})
+	if err != nil {
+		t.Fatalf("error encoding request: %v", err)
+	}
+	response, err := a.handlePacket(packet)
+	if err != nil {
+		t.Fatalf("handlePacket() returned error %v", err)
+	}
+	decoded, err := DecodeSequence(response)
+	if err != nil {
+		t.Fatalf("error decoding response %x: %v", response, err)
+	}
+	return decoded[3].([]interface{})
+}
+
+func TestAgentGetNext(t *testing.T) {
+	a := newTestAgent()
+
+	var got []SNMPValue
+	oid := MustParseOid(".1.3.6.1.2.1")
+	for i := 0; i < 10; i++ {
+		resp := testAgentRequest(t, a, SNMPv2c, "public", []interface{}{AsnGetNextRequest, 1, 0, 0,
+			[]interface{}{Sequence, []interface{}{Sequence, oid, nil}}})
+		varbinds, err := decodeVarbinds(resp[4])
+		if err != nil || len(varbinds) != 1 {
+			t.Fatalf("got varbinds %v (%v), want 1", resp[4], err)
+		}
+		got = append(got, varbinds[0])
+		if varbinds[0].Value == EndOfMibView {
+			break
+		}
+		oid = varbinds[0].Oid
+	}
+
+	want := []SNMPValue{
+		{MustParseOid(".1.3.6.1.2.1.1.1.0"), "test agent"},
+		{MustParseOid(".1.3.6.1.2.1.1.4.0"), "nobody"},
+		{MustParseOid(".1.3.6.1.2.1.2.2.1.1.1"), int64(1)},
+		{MustParseOid(".1.3.6.1.2.1.2.2.1.1.2"), int64(2)},
+		{MustParseOid(".1.3.6.1.2.1.2.2.1.2.1"), "lo"},
+		{MustParseOid(".1.3.6.1.2.1.2.2.1.2.2"), "eth0"},
+		{MustParseOid(".1.3.6.1.2.1.2.2.1.2.2"), EndOfMibView},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("walk returned %v, want %v", got, want)
+	}
+}
+
+// sparseTable is a table whose column 3 has no value in row 2.5.
+type sparseTable struct{}
+
+func (sparseTable) Columns() []int { return []int{3, 1} }
+
+func (sparseTable) Rows() []Oid { return []Oid{{1}, {2, 5}, {3}} }
+
+func (sparseTable) Value(column int, index Oid) (interface{}, bool) {
+	if column == 3 && index.Equal(Oid{2, 5}) {
+		return nil, false
+	}
+	return int64(10*column + index[0]), true
+}
+
+func TestTableHandler(t *testing.T) {
+	h := &tableHandler{MustParseOid(".1.9"), sparseTable{}}
+
+	getNext := []struct {
+		oid, next string
+	}{
+		{".1", ".1.9.1.1"},
+		{".1.9.1", ".1.9.1.1"},
+		{".1.9.1.1", ".1.9.1.2.5"},
+		{".1.9.1.2", ".1.9.1.2.5"},
+		{".1.9.1.2.5.1", ".1.9.1.3"},
+		{".1.9.1.3", ".1.9.3.1"},
+		{".1.9.2.7", ".1.9.3.1"},
+		// Row 2.5 has no column 3.
+		{".1.9.3.1", ".1.9.3.3"},
+		{".1.9.3.3", ""},
+		{".1.9.4", ""},
+	}
+	for _, test := range getNext {
+		next, _, err := h.GetNext(MustParseOid(test.oid))
+		got := ""
+		if next != nil {
+			got = next.String()
+		}
+		if err != nil || got != test.next {
+			t.Errorf("GetNext(%s) => %q, %v, want %q", test.oid, got, err, test.next)
+		}
+	}
+
+	get := []struct {
+		oid  string
+		want interface{}
+	}{
+		{".1.9.1.2.5", int64(12)},
+		{".1.9.3.3", int64(33)},
+		{".1.9.1.2", NoSuchInstance},
+		{".1.9.1.4", NoSuchInstance},
+		{".1.9.3.2.5", NoSuchInstance},
+		{".1.9.2.1", NoSuchObject},
+	}
+	for _, test := range get {
+		if got, err := h.Get(MustParseOid(test.oid)); err != nil || got != test.want {
+			t.Errorf("Get(%s) => %v, %v, want %v", test.oid, got, err, test.want)
+		}
+	}
+}
+
+func TestAgentGetExceptions(t *testing.T) {
+	a := newTestAgent()
+
+	packet, _ := EncodeSequence([]interface{}{Sequence, int(SNMPv2c), "public",
+		[]interface{}{AsnGetRequest, 1, 0, 0, []interface{}{Sequence,
+			[]interface{}{Sequence, MustParseOid(".1.3.6.1.2.1.1.1.0"), nil},
+			[]interface{}{Sequence, MustParseOid(".1.3.6.1.2.1.1.1.1"), nil},
+			[]interface{}{Sequence, MustParseOid(".1.3.6.1.2.1.2.2.1.3.1"), nil},
+			[]interface{}{Sequence, MustParseOid(".1.3.6.1.2.1.2.2.1.1.3"), nil}}}})
+	got, err := a.handlePacket(packet)
+	if err != nil {
+		t.Fatalf("handlePacket() returned error %v", err)
+	}
+	want, _ := EncodeSequence([]interface{}{Sequence, int(SNMPv2c), "public",
+		[]interface{}{AsnGetResponse, 1, 0, 0, []interface{}{Sequence,
+			[]interface{}{Sequence, MustParseOid(".1.3.6.1.2.1.1.1.0"), "test agent"},
+			[]interface{}{Sequence, MustParseOid(".1.3.6.1.2.1.1.1.1"), NoSuchInstance},
+			[]interface{}{Sequence, MustParseOid(".1.3.6.1.2.1.2.2.1.3.1"), NoSuchObject},
+			[]interface{}{Sequence, MustParseOid(".1.3.6.1.2.1.2.2.1.1.3"), NoSuchInstance}}}})
+	if !bytes.Equal(got, want) {
+		t.Errorf("got response %x, want %x", got, want)
+	}
+}
+
+func TestAgentV1(t *testing.T) {
+	a := newTestAgent()
+
+	// SNMPv1 has no exceptions, a missing instance is a noSuchName error.
+	request := []interface{}{Sequence,
+		[]interface{}{Sequence, MustParseOid(".1.3.6.1.2.1.1.1.0"), nil},
+		[]interface{}{Sequence, MustParseOid(".1.3.6.1.2.1.1.2.0"), nil}}
+	resp := testAgentRequest(t, a, SNMPv1, "public", []interface{}{AsnGetRequest, 7, 0, 0, request})
+	if resp[2] != int64(NoSuchName) || resp[3] != int64(2) {
+		t.Errorf("got error-status %v error-index %v, want noSuchName at 2", resp[2], resp[3])
+	}
+	varbinds, _ := decodeVarbinds(resp[4])
+	if len(varbinds) != 2 || varbinds[0].Value != nil {
+		t.Errorf("got varbinds %v, want the request's", varbinds)
+	}
+
+	// SNMPv1 has no GetBulk.
+	packet, _ := EncodeSequence([]interface{}{Sequence, int(SNMPv1), "public",
+		[]interface{}{AsnGetBulkRequest, 7, 0, 10, request}})
+	if _, err := a.handlePacket(packet); err == nil {
+		t.Errorf("GetBulk in SNMPv1 returned no error")
+	}
+
+	// Versions that wrap around to SNMPv1 or SNMPv2c in a byte aren't them.
+	for _, version := range []int{256, 257, int(SNMPv3)} {
+		packet, _ := EncodeSequence([]interface{}{Sequence, version, "public",
+			[]interface{}{AsnGetRequest, 7, 0, 0, request}})
+		if _, err := a.handlePacket(packet); err == nil {
+			t.Errorf("request with version %d returned no error", version)
+		}
+	}
+}
+
+func TestAgentGetBulk(t *testing.T) {
+	a := newTestAgent()
+
+	resp := testAgentRequest(t, a, SNMPv2c, "public", []interface{}{AsnGetBulkRequest, 1, 1, 3,
+		[]interface{}{Sequence,
+			[]interface{}{Sequence, MustParseOid(".1.3.6.1.2.1.1"), nil},
+			[]interface{}{Sequence, MustParseOid(".1.3.6.1.2.1.2.2.1.1"), nil},
+			[]interface{}{Sequence, MustParseOid(".1.3.6.1.2.1.2.2.1.2"), nil}}})
+	got, err := decodeVarbinds(resp[4])
+	if err != nil {
+		t.Fatalf("error decoding varbinds: %v", err)
+	}
+	// One non-repeater, then the repeaters interleaved.
+	want := []SNMPValue{
+		{MustParseOid(".1.3.6.1.2.1.1.1.0"), "test agent"},
+		{MustParseOid(".1.3.6.1.2.1.2.2.1.1.1"), int64(1)},
+		{MustParseOid(".1.3.6.1.2.1.2.2.1.2.1"), "lo"},
+		{MustParseOid(".1.3.6.1.2.1.2.2.1.1.2"), int64(2)},
+		{MustParseOid(".1.3.6.1.2.1.2.2.1.2.2"), "eth0"},
+		{MustParseOid(".1.3.6.1.2.1.2.2.1.2.1"), "lo"},
+		{MustParseOid(".1.3.6.1.2.1.2.2.1.2.2"), EndOfMibView},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetBulk returned %v, want %v", got, want)
+	}
+
+	// A response that doesn't fit is truncated.
+	a.MaxMessageSize = 100
+	resp = testAgentRequest(t, a, SNMPv2c, "public", []interface{}{AsnGetBulkRequest, 1, 0, 100,
+		[]interface{}{Sequence, []interface{}{Sequence, MustParseOid(".1.3.6.1.2.1"), nil}}})
+	got, _ = decodeVarbinds(resp[4])
+	if resp[2] != int64(NoError) || len(got) == 0 || len(got) >= 6 {
+		t.Errorf("got error-status %v and %d varbinds, want a truncated response", resp[2], len(got))
+	}
+}
+
+func TestAgentSet(t *testing.T) {
+	a := newTestAgent()
+
+	sysContact := MustParseOid(".1.3.6.1.2.1.1.4.0")
+	set := func(community string, oid Oid, value interface{}) []interface{} {
+		return testAgentRequest(t, a, SNMPv2c, community, []interface{}{AsnSetRequest, 1, 0, 0,
+			[]interface{}{Sequence, []interface{}{Sequence, oid, value}}})
+	}
+
+	if resp := set("private", sysContact, "admin"); resp[2] != int64(NoError) {
+		t.Errorf("setting sysContact.0 returned error-status %v", resp[2])
+	}
+	if resp := set("private", MustParseOid(".1.3.6.1.2.1.2.2.1.2.2"), "eth1"); resp[2] != int64(NoError) {
+		t.Errorf("setting ifDescr.2 returned error-status %v", resp[2])
+	}
+	if resp := set("private", MustParseOid(".1.3.6.1.2.1.1.1.0"), "x"); resp[2] != int64(NotWritable) || resp[3] != int64(1) {
+		t.Errorf("setting sysDescr.0 returned error-status %v index %v, want notWritable", resp[2], resp[3])
+	}
+	if resp := set("private", sysContact, 1); resp[2] != int64(WrongType) {
+		t.Errorf("setting sysContact.0 to an integer returned error-status %v, want wrongType", resp[2])
+	}
+
+	got := testAgentRequest(t, a, SNMPv2c, "public", []interface{}{AsnGetRequest, 1, 0, 0,
+		[]interface{}{Sequence,
+			[]interface{}{Sequence, sysContact, nil},
+			[]interface{}{Sequence, MustParseOid(".1.3.6.1.2.1.2.2.1.2.2"), nil}}})
+	varbinds, _ := decodeVarbinds(got[4])
+	if len(varbinds) != 2 || varbinds[0].Value != "admin" || varbinds[1].Value != "eth1" {
+		t.Errorf("got %v after set, want admin and eth1", varbinds)
+	}
+
+	// The read community can't set.
+	packet, _ := EncodeSequence([]interface{}{Sequence, int(SNMPv2c), "public",
+		[]interface{}{AsnSetRequest, 1, 0, 0, []interface{}{Sequence, []interface{}{Sequence, sysContact, "x"}}}})
+	if _, err := a.handlePacket(packet); err == nil {
+		t.Errorf("set with the read community returned no error")
+	}
+}
+
+// startTestAgent serves newTestAgent on loopback, and returns a WapSNMP
+// querying it.
+func startTestAgent(t testing.TB, community string, version SNMPVersion) (*Agent, *WapSNMP) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error creating socket: %v", err)
+	}
+	a := newTestAgent()
+	a.conn = conn
+	go a.Serve()
+
+	clientConn, err := net.Dial("udp", a.Addr().String())
+	if err != nil {
+		a.Close()
+		t.Fatalf("error connecting to agent: %v", err)
+	}
+	return a, NewWapSNMPOnConn("localhost", community, version, time.Second, 2, clientConn)
+}
+
+func TestAgentServe(t *testing.T) {
+	a, wsnmp := startTestAgent(t, "public", SNMPv2c)
+	defer a.Close()
+	defer wsnmp.Close()
+
+	value, err := wsnmp.Get(MustParseOid(".1.3.6.1.2.1.1.1.0"))
+	if err != nil || value != "test agent" {
+		t.Errorf("Get(sysDescr.0) => %v, %v, want test agent", value, err)
+	}
+
+	table, err := wsnmp.GetTable(MustParseOid(".1.3.6.1.2.1.2.2.1"))
+	if err != nil {
+		t.Fatalf("GetTable() returned error %v", err)
+	}
+	want := map[string]interface{}{
+		".1.3.6.1.2.1.2.2.1.1.1": int64(1),
+		".1.3.6.1.2.1.2.2.1.1.2": int64(2),
+		".1.3.6.1.2.1.2.2.1.2.1": "lo",
+		".1.3.6.1.2.1.2.2.1.2.2": "eth0",
+	}
+	if !reflect.DeepEqual(table, want) {
+		t.Errorf("GetTable() => %v, want %v", table, want)
+	}
+}
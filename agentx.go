@@ -0,0 +1,537 @@
+package wapsnmp
+
+/* This file implements the encoding of AgentX PDUs. AgentX doesn't use BER,
+   but a fixed binary format of 32 bit aligned fields.
+
+   References : RFC 2741 section 5 (elements of procedure) and 6 (PDUs).
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"time"
+)
+
+// AgentX PDU types.
+const (
+	agentxOpen            byte = 1
+	agentxClose           byte = 2
+	agentxRegister        byte = 3
+	agentxUnregister      byte = 4
+	agentxGet             byte = 5
+	agentxGetNext         byte = 6
+	agentxGetBulk         byte = 7
+	agentxTestSet         byte = 8
+	agentxCommitSet       byte = 9
+	agentxUndoSet         byte = 10
+	agentxCleanupSet      byte = 11
+	agentxNotify          byte = 12
+	agentxPing            byte = 13
+	agentxIndexAllocate   byte = 14
+	agentxIndexDeallocate byte = 15
+	agentxAddAgentCaps    byte = 16
+	agentxRemoveAgentCaps byte = 17
+	agentxResponse        byte = 18
+)
+
+// AgentX header flags.
+const (
+	agentxNonDefaultContext byte = 0x08
+	agentxNetworkByteOrder  byte = 0x10
+)
+
+// AgentX varbind types. The others are the same as the BER tags.
+const (
+	agentxInteger     uint16 = 2
+	agentxOctetString uint16 = 4
+	agentxNull        uint16 = 5
+	agentxOid         uint16 = 6
+	agentxIPAddress   uint16 = 64
+	agentxCounter32   uint16 = 65
+	agentxGauge32     uint16 = 66
+	agentxTimeTicks   uint16 = 67
+	agentxOpaque      uint16 = 68
+	agentxCounter64   uint16 = 70
+)
+
+// AgentX errors in the res.error field of responses, besides the SNMP
+// error-status values.
+const (
+	agentxOpenFailed            = 256
+	agentxNotOpen               = 257
+	agentxUnsupportedContext    = 262
+	agentxDuplicateRegistration = 263
+	agentxUnknownRegistration   = 264
+	agentxParseError            = 266
+	agentxRequestDenied         = 267
+	agentxProcessingError       = 268
+)
+
+// agentxReasonShutdown is the reason for closing a session when the
+// sub-agent shuts down.
+const agentxReasonShutdown byte = 5
+
+// agentxHeaderSize is the size of the fixed AgentX header.
+const agentxHeaderSize = 20
+
+// agentxInternetPrefix is the prefix AgentX can abbreviate oids with.
+var agentxInternetPrefix = Oid{1, 3, 6, 1}
+
+// AgentXError is a non-zero res.error in an AgentX response.
+type AgentXError int
+
+func (e AgentXError) Error() string {
+	switch e {
+	case agentxOpenFailed:
+		return "agentx: openFailed"
+	case agentxNotOpen:
+		return "agentx: notOpen"
+	case agentxUnsupportedContext:
+		return "agentx: unsupportedContext"
+	case agentxDuplicateRegistration:
+		return "agentx: duplicateRegistration"
+	case agentxUnknownRegistration:
+		return "agentx: unknownRegistration"
+	case agentxParseError:
+		return "agentx: parseError"
+	case agentxRequestDenied:
+		return "agentx: requestDenied"
+	case agentxProcessingError:
+		return "agentx: processingError"
+	}
+	if e > 0 && e < 256 {
+		return "agentx: " + ErrorStatus(e).String()
+	}
+	return fmt.Sprintf("agentx: error %d", int(e))
+}
+
+// agentxPDU is a decoded AgentX PDU. payload holds everything after the
+// header, and the context if there is one.
+type agentxPDU struct {
+	pduType       byte
+	flags         byte
+	sessionID     uint32
+	transactionID uint32
+	packetID      uint32
+	context       string
+	payload       []byte
+}
+
+// order returns the byte order the PDU is encoded in.
+func (p *agentxPDU) order() binary.ByteOrder {
+	if p.flags&agentxNetworkByteOrder != 0 {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// encode encodes the PDU in network byte order. The payload has to be
+// encoded in network byte order too.
+func (p *agentxPDU) encode() []byte {
+	e := newAgentXEncoder()
+	flags := p.flags | agentxNetworkByteOrder
+	if p.context != "" {
+		flags |= agentxNonDefaultContext
+	}
+	e.buf = append(e.buf, 1, p.pduType, flags, 0)
+	e.uint32(p.sessionID)
+	e.uint32(p.transactionID)
+	e.uint32(p.packetID)
+	e.uint32(0) // The payload length, filled in below.
+	if p.context != "" {
+		e.octetString(p.context)
+	}
+	e.buf = append(e.buf, p.payload...)
+	binary.BigEndian.PutUint32(e.buf[16:], uint32(len(e.buf)-agentxHeaderSize))
+	return e.buf
+}
+
+// readAgentXPDU reads one PDU from r.
+func readAgentXPDU(r io.Reader) (*agentxPDU, error) {
+	header := make([]byte, agentxHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 1 {
+		return nil, fmt.Errorf("unsupported AgentX version %d", header[0])
+	}
+	p := &agentxPDU{pduType: header[1], flags: header[2]}
+	order := p.order()
+	p.sessionID = order.Uint32(header[4:])
+	p.transactionID = order.Uint32(header[8:])
+	p.packetID = order.Uint32(header[12:])
+	length := order.Uint32(header[16:])
+	if length%4 != 0 || length > 1<<20 {
+		return nil, fmt.Errorf("invalid AgentX payload length %d", length)
+	}
+	p.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, p.payload); err != nil {
+		return nil, err
+	}
+	if p.flags&agentxNonDefaultContext != 0 {
+		d := p.decoder()
+		context, err := d.octetString()
+		if err != nil {
+			return nil, err
+		}
+		p.context = context
+		p.payload = d.buf
+	}
+	return p, nil
+}
+
+// decoder returns a decoder for the payload.
+func (p *agentxPDU) decoder() *agentxDecoder {
+	return &agentxDecoder{buf: p.payload, order: p.order()}
+}
+
+// agentxEncoder appends AgentX fields to a buffer.
+type agentxEncoder struct {
+	buf   []byte
+	order binary.ByteOrder
+}
+
+// newAgentXEncoder returns an encoder for network byte order, which is what
+// PDUs are sent in.
+func newAgentXEncoder() *agentxEncoder {
+	return &agentxEncoder{order: binary.BigEndian}
+}
+
+func (e *agentxEncoder) uint16(v uint16) {
+	var b [2]byte
+	e.order.PutUint16(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *agentxEncoder) uint32(v uint32) {
+	var b [4]byte
+	e.order.PutUint32(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+func (e *agentxEncoder) uint64(v uint64) {
+	var b [8]byte
+	e.order.PutUint64(b[:], v)
+	e.buf = append(e.buf, b[:]...)
+}
+
+// oid encodes an Object Identifier, RFC 2741 section 5.1. It has at most 255
+// 32 bit sub-identifiers after the prefix.
+func (e *agentxEncoder) oid(o Oid, include bool) error {
+	full := o
+	prefix := 0
+	if len(o) > len(agentxInternetPrefix) && o[:len(agentxInternetPrefix)].Equal(agentxInternetPrefix) &&
+		o[4] > 0 && o[4] < 256 {
+		prefix = o[4]
+		o = o[5:]
+	}
+	if len(o) > 255 {
+		return fmt.Errorf("oid %v has more than the 255 sub-identifiers AgentX allows", full)
+	}
+	for _, subid := range o {
+		if subid < 0 || uint64(subid) > math.MaxUint32 {
+			return fmt.Errorf("oid %v has a sub-identifier that doesn't fit in 32 bits", full)
+		}
+	}
+	includeByte := byte(0)
+	if include {
+		includeByte = 1
+	}
+	e.buf = append(e.buf, byte(len(o)), byte(prefix), includeByte, 0)
+	for _, subid := range o {
+		e.uint32(uint32(subid))
+	}
+	return nil
+}
+
+// integer encodes an Integer, a 32 bit value in AgentX.
+func (e *agentxEncoder) integer(v int64) error {
+	if v < math.MinInt32 || v > math.MaxInt32 {
+		return fmt.Errorf("integer %d doesn't fit in 32 bits", v)
+	}
+	e.uint32(uint32(int32(v)))
+	return nil
+}
+
+// octetString encodes an Octet String, RFC 2741 section 5.3. It is padded to
+// a multiple of 4 bytes.
+func (e *agentxEncoder) octetString(s string) {
+	e.uint32(uint32(len(s)))
+	e.buf = append(e.buf, s...)
+	for len(e.buf)%4 != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+// varbind encodes a VarBind, RFC 2741 section 5.4.
+func (e *agentxEncoder) varbind(v SNMPValue) error {
+	start := len(e.buf)
+	e.uint32(0) // The type and reserved field, filled in below.
+	if err := e.oid(v.Oid, false); err != nil {
+		e.buf = e.buf[:start]
+		return err
+	}
+
+	var valueType uint16
+	switch val := v.Value.(type) {
+	default:
+		e.buf = e.buf[:start]
+		return fmt.Errorf("couldn't encode %T as an AgentX value", val)
+	case nil:
+		valueType = agentxNull
+	case int:
+		if err := e.integer(int64(val)); err != nil {
+			e.buf = e.buf[:start]
+			return err
+		}
+		valueType = agentxInteger
+	case int64:
+		if err := e.integer(val); err != nil {
+			e.buf = e.buf[:start]
+			return err
+		}
+		valueType = agentxInteger
+	case string:
+		valueType = agentxOctetString
+		e.octetString(val)
+	case []byte:
+		valueType = agentxOctetString
+		e.octetString(string(val))
+	case Oid:
+		if err := e.oid(val, false); err != nil {
+			e.buf = e.buf[:start]
+			return err
+		}
+		valueType = agentxOid
+	case net.IP:
+		ip := val.To4()
+		if ip == nil {
+			e.buf = e.buf[:start]
+			return fmt.Errorf("couldn't encode %v as an IpAddress", val)
+		}
+		valueType = agentxIPAddress
+		e.octetString(string(ip))
+	case Counter:
+		valueType = agentxCounter32
+		e.uint32(uint32(val))
+	case Gauge:
+		valueType = agentxGauge32
+		e.uint32(uint32(val))
+	case time.Duration:
+		// TimeTicks are hundredths of seconds, an unsigned 32 bit value.
+		ticks := val / (10 * time.Millisecond)
+		if ticks < 0 || ticks > math.MaxUint32 {
+			e.buf = e.buf[:start]
+			return fmt.Errorf("duration %v doesn't fit in TimeTicks", val)
+		}
+		valueType = agentxTimeTicks
+		e.uint32(uint32(ticks))
+	case Counter64:
+		valueType = agentxCounter64
+		e.uint64(uint64(val))
+	case OpaqueData:
+		valueType = agentxOpaque
+		e.octetString(string(val))
+	case Gauge64, float32, float64:
+		// Wrapped in an Opaque, as in BER. The encoding is a few bytes, so
+		// its length is the second one.
+		enc, _ := appendValue(nil, val)
+		valueType = agentxOpaque
+		e.octetString(string(enc[2:]))
+	case bool:
+		// AgentX only has the SMIv2 types, which represent booleans as a
+		// TruthValue, RFC 2579.
+		valueType = agentxInteger
+		if val {
+			e.uint32(1)
+		} else {
+			e.uint32(2)
+		}
+	case BitString:
+		// And bit strings as BITS, an Octet String, RFC 2578 section 7.1.4.
+		valueType = agentxOctetString
+		e.octetString(string(val.Bytes))
+	case BERType:
+		if val != NoSuchObject && val != NoSuchInstance && val != EndOfMibView {
+			e.buf = e.buf[:start]
+			return fmt.Errorf("couldn't encode BER type %v as an AgentX value", val)
+		}
+		valueType = uint16(val)
+	}
+	e.order.PutUint16(e.buf[start:], valueType)
+	return nil
+}
+
+// agentxDecoder reads AgentX fields from the front of a buffer.
+type agentxDecoder struct {
+	buf   []byte
+	order binary.ByteOrder
+}
+
+var errAgentXParse = errors.New("malformed AgentX PDU")
+
+func (d *agentxDecoder) next(n int) ([]byte, error) {
+	if len(d.buf) < n {
+		return nil, errAgentXParse
+	}
+	result := d.buf[:n]
+	d.buf = d.buf[n:]
+	return result, nil
+}
+
+func (d *agentxDecoder) uint16() (uint16, error) {
+	b, err := d.next(2)
+	if err != nil {
+		return 0, err
+	}
+	return d.order.Uint16(b), nil
+}
+
+func (d *agentxDecoder) uint32() (uint32, error) {
+	b, err := d.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return d.order.Uint32(b), nil
+}
+
+func (d *agentxDecoder) uint64() (uint64, error) {
+	b, err := d.next(8)
+	if err != nil {
+		return 0, err
+	}
+	return d.order.Uint64(b), nil
+}
+
+// oid decodes an Object Identifier, and its include field.
+func (d *agentxDecoder) oid() (Oid, bool, error) {
+	header, err := d.next(4)
+	if err != nil {
+		return nil, false, err
+	}
+	numSubids, prefix, include := int(header[0]), int(header[1]), header[2] != 0
+	var result Oid
+	if prefix != 0 {
+		result = append(agentxInternetPrefix.Copy(), prefix)
+	} else if numSubids == 0 {
+		// The null oid, which has no subids at all.
+		return nil, include, nil
+	}
+	for i := 0; i < numSubids; i++ {
+		subid, err := d.uint32()
+		if err != nil {
+			return nil, false, err
+		}
+		result = append(result, int(subid))
+	}
+	return result, include, nil
+}
+
+func (d *agentxDecoder) octetString() (string, error) {
+	length, err := d.uint32()
+	if err != nil {
+		return "", err
+	}
+	if uint64(length) > uint64(len(d.buf)) {
+		return "", errAgentXParse
+	}
+	b, err := d.next((int(length) + 3) &^ 3)
+	if err != nil {
+		return "", err
+	}
+	return string(b[:length]), nil
+}
+
+// varbind decodes a VarBind into the same Go types DecodeSequence uses.
+func (d *agentxDecoder) varbind() (SNMPValue, error) {
+	valueType, err := d.uint16()
+	if err != nil {
+		return SNMPValue{}, err
+	}
+	if _, err := d.uint16(); err != nil {
+		return SNMPValue{}, err
+	}
+	oid, _, err := d.oid()
+	if err != nil {
+		return SNMPValue{}, err
+	}
+
+	var value interface{}
+	switch valueType {
+	case agentxNull:
+		value = nil
+	case agentxInteger:
+		var v uint32
+		v, err = d.uint32()
+		value = int64(int32(v))
+	case agentxOctetString:
+		value, err = d.octetString()
+	case agentxOid:
+		value, _, err = d.oid()
+	case agentxIPAddress:
+		var s string
+		if s, err = d.octetString(); err == nil && len(s) != 4 {
+			err = fmt.Errorf("%w: IP address of %d bytes", errAgentXParse, len(s))
+		}
+		if err == nil {
+			value = net.IPv4(s[0], s[1], s[2], s[3])
+		}
+	case agentxCounter32:
+		var v uint32
+		v, err = d.uint32()
+		value = Counter(v)
+	case agentxGauge32:
+		var v uint32
+		v, err = d.uint32()
+		value = Gauge(v)
+	case agentxTimeTicks:
+		var v uint32
+		v, err = d.uint32()
+		value = time.Duration(v) * 10 * time.Millisecond
+	case agentxCounter64:
+		var v uint64
+		v, err = d.uint64()
+		value = Counter64(v)
+	case agentxOpaque:
+		var s string
+		if s, err = d.octetString(); err == nil {
+			value, err = decodeOpaque([]byte(s))
+		}
+	case uint16(NoSuchObject), uint16(NoSuchInstance), uint16(EndOfMibView):
+		value = BERType(valueType)
+	default:
+		return SNMPValue{}, fmt.Errorf("%w: unsupported value type %d", errAgentXParse, valueType)
+	}
+	if err != nil {
+		return SNMPValue{}, err
+	}
+	return SNMPValue{oid, value}, nil
+}
+
+// agentxSearchRange is a SearchRange, RFC 2741 section 5.2. A nil end means
+// there is no upper bound.
+type agentxSearchRange struct {
+	start   Oid
+	include bool
+	end     Oid
+}
+
+func (d *agentxDecoder) searchRanges() ([]agentxSearchRange, error) {
+	var result []agentxSearchRange
+	for len(d.buf) > 0 {
+		start, include, err := d.oid()
+		if err != nil {
+			return nil, err
+		}
+		end, _, err := d.oid()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, agentxSearchRange{start, include, end})
+	}
+	return result, nil
+}
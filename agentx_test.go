@@ -0,0 +1,182 @@
+package wapsnmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAgentXOidEncoding(t *testing.T) {
+	tests := []struct {
+		oid     Oid
+		include bool
+		want    string
+	}{
+		// The internet prefix is abbreviated, RFC 2741 section 5.1.
+		{MustParseOid(".1.3.6.1.2.1.1.1.0"), false, "04020000" + "00000001" + "00000001" + "00000001" + "00000000"},
+		{MustParseOid(".1.3.6.1.4.1.8072"), true, "02040100" + "00000001" + "00001f88"},
+		{MustParseOid(".1.2.3"), false, "03000000" + "00000001" + "00000002" + "00000003"},
+		{nil, false, "00000000"},
+	}
+
+	for _, test := range tests {
+		e := newAgentXEncoder()
+		if err := e.oid(test.oid, test.include); err != nil {
+			t.Errorf("error encoding %v: %v", test.oid, err)
+		}
+		if got := hex.EncodeToString(e.buf); got != test.want {
+			t.Errorf("encoding %v => %v, want %v", test.oid, got, test.want)
+		}
+
+		d := &agentxDecoder{buf: e.buf, order: binary.BigEndian}
+		oid, include, err := d.oid()
+		if err != nil || !oid.Equal(test.oid) || include != test.include {
+			t.Errorf("decoding %v => %v, %v, %v", test.want, oid, include, err)
+		}
+	}
+}
+
+func TestAgentXVarbinds(t *testing.T) {
+	oid := MustParseOid(".1.3.6.1.2.1.1.1.0")
+	values := []interface{}{
+		nil,
+		int64(-42),
+		"test",
+		MustParseOid(".1.3.6.1.2.1.1"),
+		net.IPv4(192, 0, 2, 1),
+		Counter(123),
+		Gauge(456),
+		12345 * 10 * time.Millisecond,
+		Counter64(1 << 40),
+		OpaqueData{0x04, 0x01, 0x41},
+		Gauge64(1 << 63),
+		float32(1.5),
+		float64(-2.25),
+		NoSuchObject,
+		NoSuchInstance,
+		EndOfMibView,
+	}
+
+	for _, value := range values {
+		e := newAgentXEncoder()
+		if err := e.varbind(SNMPValue{oid, value}); err != nil {
+			t.Errorf("error encoding %v: %v", value, err)
+			continue
+		}
+		if len(e.buf)%4 != 0 {
+			t.Errorf("encoding of %v is %d bytes, not 32 bit aligned", value, len(e.buf))
+		}
+		d := &agentxDecoder{buf: e.buf, order: binary.BigEndian}
+		got, err := d.varbind()
+		if err != nil || !reflect.DeepEqual(got, SNMPValue{oid, value}) || len(d.buf) != 0 {
+			t.Errorf("round trip of %v => %v, %v", value, got, err)
+		}
+	}
+
+	// The types AgentX lacks are sent as their SMIv2 equivalents.
+	converted := []struct {
+		value, want interface{}
+	}{
+		{true, int64(1)},
+		{false, int64(2)},
+		{BitString{Bytes: []byte{0xa0}, BitLength: 3}, "\xa0"},
+		{net.IP{192, 0, 2, 1}, net.IPv4(192, 0, 2, 1)},
+	}
+	for _, test := range converted {
+		e := newAgentXEncoder()
+		if err := e.varbind(SNMPValue{oid, test.value}); err != nil {
+			t.Errorf("error encoding %v: %v", test.value, err)
+			continue
+		}
+		d := &agentxDecoder{buf: e.buf, order: binary.BigEndian}
+		got, err := d.varbind()
+		if err != nil || !reflect.DeepEqual(got, SNMPValue{oid, test.want}) {
+			t.Errorf("round trip of %v => %#v, %v, want %#v", test.value, got.Value, err, test.want)
+		}
+	}
+
+	if err := newAgentXEncoder().varbind(SNMPValue{oid, int8(1)}); err == nil {
+		t.Errorf("encoding an int8 returned no error")
+	}
+
+	// The payload of an IpAddress is 4 bytes.
+	e := newAgentXEncoder()
+	e.varbind(SNMPValue{oid, "12345"})
+	e.buf[1] = byte(agentxIPAddress)
+	d := &agentxDecoder{buf: e.buf, order: binary.BigEndian}
+	if got, err := d.varbind(); err == nil {
+		t.Errorf("decoding a 5 byte IpAddress => %v, want an error", got)
+	}
+}
+
+func TestAgentXEncodeOutOfRange(t *testing.T) {
+	// The length of an oid is a byte, after the internet prefix.
+	long := make(Oid, 256)
+	if e := newAgentXEncoder(); e.oid(long[1:], false) != nil {
+		t.Errorf("encoding an oid of 255 sub-identifiers returned an error")
+	}
+	if e := newAgentXEncoder(); e.oid(append(MustParseOid(".1.3.6.1.2"), long[1:]...), false) != nil {
+		t.Errorf("encoding an oid of 255 sub-identifiers after the prefix returned an error")
+	}
+	if e := newAgentXEncoder(); e.oid(long, false) == nil {
+		t.Errorf("encoding an oid of 256 sub-identifiers returned no error")
+	}
+
+	oid := MustParseOid(".1.3.6.1.2.1.1.1.0")
+	for _, v := range []SNMPValue{
+		{long, nil},
+		{Oid{1, -1}, nil},
+		{oid, long},
+		{oid, int64(math.MaxInt32 + 1)},
+		{oid, int64(math.MinInt32 - 1)},
+		{oid, time.Duration(math.MaxUint32+1) * 10 * time.Millisecond},
+		{oid, -10 * time.Millisecond},
+	} {
+		e := newAgentXEncoder()
+		if err := e.varbind(v); err == nil || len(e.buf) != 0 {
+			t.Errorf("encoding %v = %v => %x, %v, want an error", v.Oid, v.Value, e.buf, err)
+		}
+	}
+	for _, value := range []interface{}{int64(math.MaxInt32), int64(math.MinInt32)} {
+		e := newAgentXEncoder()
+		if err := e.varbind(SNMPValue{oid, value}); err != nil {
+			t.Errorf("error encoding %v: %v", value, err)
+		}
+	}
+}
+
+func TestReadAgentXPDU(t *testing.T) {
+	// A little endian Get PDU in a non-default context.
+	e := &agentxEncoder{order: binary.LittleEndian}
+	e.buf = append(e.buf, 1, agentxGet, agentxNonDefaultContext, 0)
+	e.uint32(5)  // session ID
+	e.uint32(6)  // transaction ID
+	e.uint32(7)  // packet ID
+	e.uint32(32) // payload length
+	e.octetString("ctx")
+	e.oid(MustParseOid(".1.3.6.1.2.1.1.1.0"), false)
+	e.oid(nil, false)
+
+	p, err := readAgentXPDU(bytes.NewReader(e.buf))
+	if err != nil {
+		t.Fatalf("readAgentXPDU() returned error %v", err)
+	}
+	if p.pduType != agentxGet || p.sessionID != 5 || p.transactionID != 6 || p.packetID != 7 || p.context != "ctx" {
+		t.Errorf("got PDU %+v", p)
+	}
+	ranges, err := p.decoder().searchRanges()
+	want := []agentxSearchRange{{MustParseOid(".1.3.6.1.2.1.1.1.0"), false, nil}}
+	if err != nil || !reflect.DeepEqual(ranges, want) {
+		t.Errorf("got search ranges %v, %v, want %v", ranges, err, want)
+	}
+
+	// Truncated PDUs are rejected.
+	if _, err := readAgentXPDU(bytes.NewReader(e.buf[:30])); err == nil {
+		t.Errorf("readAgentXPDU() of a truncated PDU returned no error")
+	}
+}
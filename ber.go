@@ -21,7 +21,9 @@ parse BER.
 */
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math"
 	"net"
 	"time"
 )
@@ -38,9 +40,25 @@ type Counter64 uint64
 // Gauge is a type to distinguish Gauge32 from just an int.
 type Gauge uint32
 
-// Gauge64 is a type to distinguish Gauge64 from just an int.
+// Gauge64 is a type to distinguish Gauge64 from just an int. It isn't an
+// SMIv2 type, agents send it wrapped in an Opaque.
 type Gauge64 uint64
 
+// Unsigned32 is the SMIv2 Unsigned32, which is encoded exactly like Gauge32.
+type Unsigned32 = Gauge
+
+// OpaqueData is the content of an Opaque value that isn't one of the wrapped
+// types of draft-perkins-opaque-01 (Counter64, Gauge64, float32, float64 and
+// int64).
+type OpaqueData []byte
+
+// BitString is an ASN.1 BIT STRING. SMIv2 BITS are encoded as an OCTET
+// STRING instead, only SNMPv1 agents send these.
+type BitString struct {
+	Bytes     []byte // The bits, packed in bytes, the first bit in the high bit of the first byte.
+	BitLength int    // The number of bits.
+}
+
 // Constants for the different types of the TLV fields.
 const (
 	AsnBoolean     BERType = 0x01
@@ -78,18 +96,36 @@ const (
 	AsnTimeticks BERType = AsnApplication | 0x03
 	Opaque       BERType = AsnApplication | 0x04
 	AsnCounter64 BERType = AsnApplication | 0x06
+	// AsnUInteger32 is the UInteger32 of RFC 1442, which SMIv2 replaced by
+	// Unsigned32. Some old agents still send it.
+	AsnUInteger32 BERType = AsnApplication | 0x07
 
 	AsnGetRequest     BERType = 0xa0
 	AsnGetNextRequest BERType = 0xa1
 	AsnGetResponse    BERType = 0xa2
 	AsnSetRequest     BERType = 0xa3
+	AsnTrap           BERType = 0xa4
 	AsnGetBulkRequest BERType = 0xa5
+	AsnInformRequest  BERType = 0xa6
 	AsnTrapV2         BERType = 0xa7
+	AsnReport         BERType = 0xa8
 
+	NoSuchObject   BERType = 0x80
 	NoSuchInstance BERType = 0x81
 	EndOfMibView   BERType = 0x82
 )
 
+// The types of draft-perkins-opaque-01, which are wrapped in an Opaque with
+// an extension tag (opaqueTag, then one of these).
+const (
+	opaqueTag       byte = 0x9f
+	opaqueCounter64 byte = 0x76
+	opaqueFloat     byte = 0x78
+	opaqueDouble    byte = 0x79
+	opaqueInt64     byte = 0x7a
+	opaqueUInt64    byte = 0x7b
+)
+
 // SNMPVersion is a type to indicate which SNMP version is in use.
 type SNMPVersion uint8
 
@@ -100,6 +136,7 @@ type UnsupportedBerType []byte
 const (
 	SNMPv1  SNMPVersion = 0
 	SNMPv2c SNMPVersion = 1
+	SNMPv3  SNMPVersion = 3
 )
 
 // EncodeLength encodes an integer value as a BER compliant length value.
@@ -119,12 +156,14 @@ func EncodeLength(length uint64) []byte {
 	// specified in a 127-byte encoded integer, however, going out on a limb
 	// here, I don't think I'm going to support a use case that insane.
 
-	r := EncodeUInt(length)
-	numOctets := len(r)
+	numOctets := 1
+	for l := length; l > 255; l >>= 8 {
+		numOctets++
+	}
 	result := make([]byte, 1+numOctets)
 	result[0] = 0x80 | byte(numOctets)
-	for i, b := range r {
-		result[1+i] = b
+	for i := 0; i < numOctets; i++ {
+		result[numOctets-i] = byte(length >> uint(8*i))
 	}
 	return result
 }
@@ -136,6 +175,9 @@ func EncodeLength(length uint64) []byte {
 func DecodeLength(toparse []byte) (uint64, int, error) {
 	// If the first bit is zero, the rest of the first byte indicates the length. Values up to 127 are encoded this way (unless you're using indefinite length, but we don't support that)
 
+	if len(toparse) == 0 {
+		return 0, 0, fmt.Errorf("missing length")
+	}
 	if toparse[0] == 0x80 {
 		return 0, 0, fmt.Errorf("we don't support indefinite length encoding")
 	}
@@ -159,10 +201,31 @@ func DecodeLength(toparse []byte) (uint64, int, error) {
 	return val, 1 + numOctets, nil
 }
 
+// tlvBounds returns the start and end index of the value of the BER element
+// starting at idx.
+func tlvBounds(b []byte, idx int) (int, int, error) {
+	if idx+1 >= len(b) {
+		return 0, 0, fmt.Errorf("BER element @ idx %d is truncated", idx)
+	}
+	length, lenLen, err := DecodeLength(b[idx+1:])
+	if err != nil {
+		return 0, 0, err
+	}
+	start := idx + 1 + lenLen
+	end := start + int(length)
+	if end > len(b) || end < start {
+		return 0, 0, fmt.Errorf("BER element @ idx %d is truncated", idx)
+	}
+	return start, end, nil
+}
+
 // DecodeInteger decodes an integer.
 //
 // Will error out if it's longer than 64 bits.
 func DecodeInteger(toparse []byte) (int64, error) {
+	if len(toparse) == 0 {
+		return 0, fmt.Errorf("integer has no content")
+	}
 	if len(toparse) > 8 {
 		return 0, fmt.Errorf("don't support more than 64 bits")
 	}
@@ -180,6 +243,14 @@ func DecodeInteger(toparse []byte) (int64, error) {
 //
 // Will error out if it's longer than 64 bits.
 func DecodeUInt(toparse []byte) (uint64, error) {
+	if len(toparse) == 0 {
+		return 0, fmt.Errorf("integer has no content")
+	}
+	// Some agents add a leading zero to keep the sign bit clear, it's not part
+	// of the value.
+	for len(toparse) > 8 && toparse[0] == 0 {
+		toparse = toparse[1:]
+	}
 	if len(toparse) > 8 {
 		return 0, fmt.Errorf("don't support more than 64 bits")
 	}
@@ -190,16 +261,34 @@ func DecodeUInt(toparse []byte) (uint64, error) {
 	return val, nil
 }
 
+// decodeUInt32 decodes the content of a Counter32, Gauge32 or TimeTicks.
+func decodeUInt32(toparse []byte) (uint64, error) {
+	val, err := DecodeUInt(toparse)
+	if err != nil {
+		return 0, fmt.Errorf("error decoding integer %v: %v", toparse, err)
+	}
+	if val > math.MaxUint32 {
+		return 0, fmt.Errorf("error decoding integer %v: larger than 32 bits", toparse)
+	}
+	return val, nil
+}
+
 // EncodeInteger encodes an integer to BER format.
 func EncodeInteger(toEncode int64) []byte {
+	return appendInteger(nil, toEncode)
+}
+
+// appendInteger appends the BER encoding of an integer to dst.
+func appendInteger(dst []byte, toEncode int64) []byte {
 	// Calculate the length we'll need for the encoded value.
-	var l int64 = 1
+	l := 1
 	if toEncode > 0 {
 		for i := toEncode; i > 255; i >>= 8 {
 			l++
 		}
 	} else {
-		for i := -toEncode; i > 255; i >>= 8 {
+		// ^toEncode is -toEncode-1, which can't overflow.
+		for i := ^toEncode; i > 255; i >>= 8 {
 			l++
 		}
 		// Ensure room for the sign if necessary.
@@ -207,41 +296,105 @@ func EncodeInteger(toEncode int64) []byte {
 			l++
 		}
 	}
+	if l > 8 {
+		// Every int64 fits in 8 bytes of two's complement.
+		l = 8
+	}
 
-	// Now create a byte array of the correct length and copy the value into it.
-	result := make([]byte, l)
-	for i := int64(0); i < l; i++ {
-		result[i] = byte(toEncode >> uint(8*(l-i-1)))
+	if toEncode > 0 && byte(toEncode>>uint(8*(l-1))) > 127 {
+		dst = append(dst, 0)
 	}
-	if result[0] > 127 && toEncode > 0 {
-		result = append([]byte{0}, result...)
+	for i := l - 1; i >= 0; i-- {
+		dst = append(dst, byte(toEncode>>uint(8*i)))
 	}
-	/*
-		// Chop off superfluous 0xff's.
-		s := 0
-		for ; s+1 < len(result) && result[s] == 0xff && result[s+1] == 0xff; s++ {
-		}
-		return result[s:]*/
-	return result
+	return dst
 }
 
 // EncodeUInt encodes an unsigned integer to BER format.
 func EncodeUInt(toEncode uint64) []byte {
+	return appendUInt(nil, toEncode)
+}
+
+// appendUInt appends the BER encoding of an unsigned integer to dst. Like all
+// integers in BER it's two's complement, so values with the high bit set get
+// a leading zero to keep them from reading as negative.
+func appendUInt(dst []byte, toEncode uint64) []byte {
 	// Calculate the length we'll need for the encoded value.
-	var l int64 = 1
+	l := 1
 	for i := toEncode; i > 255; i >>= 8 {
 		l++
 	}
 
-	// Now create a byte array of the correct length and copy the value into it.
-	result := make([]byte, l)
-	for i := int64(0); i < l; i++ {
-		result[i] = byte(toEncode >> uint(8*(l-i-1)))
+	if byte(toEncode>>uint(8*(l-1))) > 127 {
+		dst = append(dst, 0)
 	}
-	return result
+	for i := l - 1; i >= 0; i-- {
+		dst = append(dst, byte(toEncode>>uint(8*i)))
+	}
+	return dst
 }
 
-// DecodeSequence decodes BER binary data into into *[]interface{}.
+// backfillLength fills in the length of the BER element starting at start in
+// dst, which has a one byte placeholder for it after the type. Lengths that
+// need the long form move the content to make room.
+func backfillLength(dst []byte, start int) []byte {
+	length := len(dst) - start - 2
+	if length <= 0x7f {
+		dst[start+1] = byte(length)
+		return dst
+	}
+	numOctets := 0
+	for l := length; l > 0; l >>= 8 {
+		numOctets++
+	}
+	for i := 0; i < numOctets; i++ {
+		dst = append(dst, 0)
+	}
+	copy(dst[start+2+numOctets:], dst[start+2:start+2+length])
+	dst[start+1] = 0x80 | byte(numOctets)
+	for i := 0; i < numOctets; i++ {
+		dst[start+2+i] = byte(length >> uint(8*(numOctets-i-1)))
+	}
+	return dst
+}
+
+// decodeOpaque decodes the content of an Opaque, unwrapping the types of
+// draft-perkins-opaque-01.
+func decodeOpaque(content []byte) (interface{}, error) {
+	if len(content) < 3 || content[0] != opaqueTag || int(content[2]) != len(content)-3 {
+		// Copied, as the packet may be a pooled buffer.
+		return OpaqueData(append([]byte{}, content...)), nil
+	}
+	value := content[3:]
+	switch content[1] {
+	case opaqueCounter64, opaqueUInt64:
+		val, err := DecodeUInt(value)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding opaque integer %v: %v", value, err)
+		}
+		if content[1] == opaqueCounter64 {
+			return Counter64(val), nil
+		}
+		return Gauge64(val), nil
+	case opaqueInt64:
+		return DecodeInteger(value)
+	case opaqueFloat:
+		if len(value) != 4 {
+			return nil, fmt.Errorf("error decoding opaque float %v: length is not 4", value)
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(value)), nil
+	case opaqueDouble:
+		if len(value) != 8 {
+			return nil, fmt.Errorf("error decoding opaque double %v: length is not 8", value)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(value)), nil
+	}
+	return OpaqueData(append([]byte{}, content...)), nil
+}
+
+// DecodeSequence decodes BER binary data into into *[]interface{}. Elements
+// that don't fit in the sequence, or the sequence in the data, are rejected;
+// bytes after the sequence are ignored.
 func DecodeSequence(toparse []byte) ([]interface{}, error) {
 	var result []interface{}
 
@@ -254,100 +407,32 @@ func DecodeSequence(toparse []byte) ([]interface{}, error) {
 	if sqType != Sequence && (toparse[0]&0x20 == 0) {
 		return nil, fmt.Errorf("byte array parsed in is not a sequence")
 	}
-	seqLength, seqLenLen, err := DecodeLength(toparse[1:])
+	_, seqEnd, err := tlvBounds(toparse, 0)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse sequence length (seq len len: %d)", seqLenLen)
-	}
-
-	if seqLength == 0 {
-		return result, nil
+		return nil, fmt.Errorf("failed to parse sequence length: %v", err)
 	}
+	// Bytes after the sequence, e.g. the padding of a decrypted scoped PDU,
+	// aren't part of it.
+	toparse = toparse[:seqEnd]
 
-	lidx := 0
-	idx := 1 + seqLenLen
-	// Let's guarantee progress.
-	for idx < len(toparse) && idx > lidx {
+	_, lenLen, _ := DecodeLength(toparse[1:])
+	idx := 1 + lenLen
+	for idx < len(toparse) {
 		berType := toparse[idx]
-		berLength, berLenLen, err := DecodeLength(toparse[idx+1:])
+		if BERType(berType)&AsnExtensionID == AsnExtensionID {
+			return nil, fmt.Errorf("multi-byte BER type @ idx %v isn't supported", idx)
+		}
+		start, end, err := tlvBounds(toparse, idx)
 		if err != nil {
-			return nil, fmt.Errorf("length parse error @ idx %v", idx)
+			return nil, fmt.Errorf("length parse error @ idx %v: %v", idx, err)
 		}
-		berValue := toparse[idx+1+berLenLen : idx+1+berLenLen+int(berLength)]
-		berAll := toparse[idx : idx+1+berLenLen+int(berLength)]
-
-		switch BERType(berType) {
-		case AsnBoolean:
-			if int(berLength) != 1 {
-				return nil, fmt.Errorf("boolean length != 1 @ idx %v", idx)
-			}
-			result = append(result, berValue[0] == 0)
-		case AsnInteger:
-			decodedValue, err := DecodeInteger(berValue)
-			if err != nil {
-				return nil, err
-			}
-			result = append(result, decodedValue)
-		case AsnOctetStr:
-			result = append(result, string(berValue))
-		case AsnNull:
-			result = append(result, nil)
-		case AsnObjectID:
-			oid, err := DecodeOid(berValue)
-			if err != nil {
-				return nil, fmt.Errorf("error decoding oid %v: %v", berValue, err)
-			}
-			result = append(result, *oid)
-		case AsnCounter32:
-			val, err := DecodeUInt(berValue)
-			if err != nil {
-				return nil, fmt.Errorf("error decoding integer %v: %v", berValue, err)
-			}
-			result = append(result, Counter(val))
-		case AsnCounter64:
-			val, err := DecodeUInt(berValue)
-			if err != nil {
-				return nil, fmt.Errorf("error decoding integer %v: %v", berValue, err)
-			}
-			result = append(result, Counter64(val))
-		case AsnGauge32:
-			val, err := DecodeUInt(berValue)
-			if err != nil {
-				return nil, fmt.Errorf("error decoding integer %v: %v", berValue, err)
-			}
-			result = append(result, Gauge(val))
-		case AsnTimeticks:
-			val, err := DecodeInteger(berValue)
-			if err != nil {
-				return nil, fmt.Errorf("error decoding integer %v: %v", berValue, err)
-			}
-			result = append(result, time.Duration(val)*10*time.Millisecond)
-		case AsnIpaddress:
-			if len(berValue) != 4 {
-				return nil, fmt.Errorf("error decoding IP address %v: length is not 4", berValue)
-			}
-			result = append(result, net.IPv4(berValue[0], berValue[1], berValue[2], berValue[3]))
-		case Sequence:
-			pdu, err := DecodeSequence(berAll)
-			if err != nil {
-				return nil, err
-			}
-			result = append(result, pdu)
-		case AsnGetNextRequest, AsnGetRequest, AsnGetResponse, AsnTrapV2:
-			pdu, err := DecodeSequence(berAll)
-			if err != nil {
-				return nil, err
-			}
-			result = append(result, pdu)
-		case NoSuchInstance:
-			return nil, fmt.Errorf("no such instance. Received bytes: %v", toparse)
-		case EndOfMibView:
-			result = append(result, EndOfMibView)
-		default:
-			result = append(result, UnsupportedBerType(berAll))
+		val, err := decodeValue(BERType(berType), toparse[start:end], toparse[idx:end], idx)
+		if err != nil {
+			return nil, err
 		}
+		result = append(result, val)
 
-		lidx = idx
-		idx = idx + 1 + berLenLen + int(berLength)
+		idx = end
 	}
 
 	return result, nil
@@ -355,106 +440,184 @@ func DecodeSequence(toparse []byte) ([]interface{}, error) {
 
 // EncodeSequence will encode an []interface{} into an SNMP bytestream.
 func EncodeSequence(toEncode []interface{}) ([]byte, error) {
-	switch toEncode[0].(type) {
-	default:
+	return AppendSequence(nil, toEncode)
+}
+
+// AppendSequence encodes an []interface{} like EncodeSequence, and appends it
+// to dst. When dst has room for it, e.g. a buffer that is reused for every
+// packet, it doesn't allocate.
+func AppendSequence(dst []byte, toEncode []interface{}) ([]byte, error) {
+	if len(toEncode) == 0 {
+		return nil, fmt.Errorf("sequence to encode is empty")
+	}
+	seqType, ok := toEncode[0].(BERType)
+	if !ok {
 		return nil, fmt.Errorf("first element of sequence to encode should be sequence type")
-	case BERType:
-		// OK
 	}
 
-	seqType := toEncode[0].(BERType)
-	var toEncap []byte
+	start := len(dst)
+	dst = append(dst, byte(seqType), 0)
 	for _, val := range toEncode[1:] {
-		switch val := val.(type) {
-		default:
-			return nil, fmt.Errorf("couldn't handle type %T", val)
-		case nil:
-			toEncap = append(toEncap, byte(AsnNull))
-			toEncap = append(toEncap, 0)
-		case int:
-			enc := EncodeInteger(int64(val))
-			// TODO encode length ?
-			toEncap = append(toEncap, byte(AsnInteger))
-			toEncap = append(toEncap, byte(len(enc)))
-			for _, b := range enc {
-				toEncap = append(toEncap, b)
-			}
-		case int64:
-			enc := EncodeInteger(val)
-			// TODO encode length ?
-			toEncap = append(toEncap, byte(AsnInteger))
-			toEncap = append(toEncap, byte(len(enc)))
-			for _, b := range enc {
-				toEncap = append(toEncap, b)
-			}
-		case Counter:
-			enc := EncodeUInt(uint64(val))
-			// TODO encode length ?
-			toEncap = append(toEncap, byte(AsnCounter32))
-			toEncap = append(toEncap, byte(len(enc)))
-			for _, b := range enc {
-				toEncap = append(toEncap, b)
-			}
-		case Gauge:
-			enc := EncodeUInt(uint64(val))
-			// TODO encode length ?
-			toEncap = append(toEncap, byte(AsnGauge32))
-			toEncap = append(toEncap, byte(len(enc)))
-			for _, b := range enc {
-				toEncap = append(toEncap, b)
-			}
-		case string:
-			enc := []byte(val)
-			toEncap = append(toEncap, byte(AsnOctetStr))
-			for _, b := range EncodeLength(uint64(len(enc))) {
-				toEncap = append(toEncap, b)
-			}
-			for _, b := range enc {
-				toEncap = append(toEncap, b)
-			}
-		case Oid:
-			enc, err := val.Encode()
-			if err != nil {
-				return nil, err
-			}
-			toEncap = append(toEncap, byte(AsnObjectID))
-			encLen := EncodeLength(uint64(len(enc)))
-			for _, b := range encLen {
-				toEncap = append(toEncap, b)
-			}
-			for _, b := range enc {
-				toEncap = append(toEncap, b)
-			}
-		case net.IP:
-			valIPv4 := val.To4()
-			if valIPv4 == nil {
-				return nil, fmt.Errorf("can only encode IPv4 addresses")
-			}
-			enc := []byte(valIPv4)
-			toEncap = append(toEncap, byte(AsnIpaddress))
-			toEncap = append(toEncap, byte(len(enc)))
-			for _, b := range enc {
-				toEncap = append(toEncap, b)
-			}
-		case []interface{}:
-			enc, err := EncodeSequence(val)
-			if err != nil {
-				return nil, err
-			}
-			for _, b := range enc {
-				toEncap = append(toEncap, b)
-			}
+		var err error
+		if dst, err = appendValue(dst, val); err != nil {
+			return nil, err
 		}
 	}
+	return backfillLength(dst, start), nil
+}
 
-	l := EncodeLength(uint64(len(toEncap)))
-	// Encode length ...
-	result := []byte{byte(seqType)}
-	for _, b := range l {
-		result = append(result, b)
+// appendValue appends the BER encoding of a value to dst.
+func appendValue(dst []byte, val interface{}) ([]byte, error) {
+	start := len(dst)
+	switch val := val.(type) {
+	default:
+		return nil, fmt.Errorf("couldn't handle type %T", val)
+	case nil:
+		return append(dst, byte(AsnNull), 0), nil
+	case BERType:
+		// The exception values, which like null have no content.
+		if val != NoSuchObject && val != NoSuchInstance && val != EndOfMibView {
+			return nil, fmt.Errorf("couldn't encode BER type %v as a value", val)
+		}
+		return append(dst, byte(val), 0), nil
+	case UnsupportedBerType:
+		// Already encoded, e.g. passed through from a decoded packet.
+		return append(dst, val...), nil
+	case []interface{}:
+		return AppendSequence(dst, val)
+	case int:
+		dst = appendInteger(append(dst, byte(AsnInteger), 0), int64(val))
+	case int64:
+		dst = appendInteger(append(dst, byte(AsnInteger), 0), val)
+	case Counter:
+		dst = appendUInt(append(dst, byte(AsnCounter32), 0), uint64(val))
+	case Gauge:
+		dst = appendUInt(append(dst, byte(AsnGauge32), 0), uint64(val))
+	case Counter64:
+		dst = appendUInt(append(dst, byte(AsnCounter64), 0), uint64(val))
+	case Gauge64:
+		dst = appendUInt(append(dst, byte(Opaque), 0, opaqueTag, opaqueUInt64, 0), uint64(val))
+		dst[start+4] = byte(len(dst) - start - 5)
+	case float32:
+		dst = binary.BigEndian.AppendUint32(append(dst, byte(Opaque), 0, opaqueTag, opaqueFloat, 4), math.Float32bits(val))
+	case float64:
+		dst = binary.BigEndian.AppendUint64(append(dst, byte(Opaque), 0, opaqueTag, opaqueDouble, 8), math.Float64bits(val))
+	case OpaqueData:
+		dst = append(append(dst, byte(Opaque), 0), val...)
+	case bool:
+		enc := byte(0)
+		if val {
+			enc = 0xff
+		}
+		dst = append(dst, byte(AsnBoolean), 0, enc)
+	case time.Duration:
+		// TimeTicks are hundredths of seconds, an unsigned 32 bit value.
+		ticks := val / (10 * time.Millisecond)
+		if ticks < 0 || ticks > math.MaxUint32 {
+			return nil, fmt.Errorf("duration %v doesn't fit in TimeTicks", val)
+		}
+		dst = appendUInt(append(dst, byte(AsnTimeticks), 0), uint64(ticks))
+	case []byte:
+		dst = append(append(dst, byte(AsnOctetStr), 0), val...)
+	case string:
+		dst = append(append(dst, byte(AsnOctetStr), 0), val...)
+	case BitString:
+		if val.BitLength < 0 || val.BitLength > 8*len(val.Bytes) || 8*len(val.Bytes)-val.BitLength > 7 {
+			return nil, fmt.Errorf("bit string of %d bits can't have %d bytes", val.BitLength, len(val.Bytes))
+		}
+		dst = append(append(dst, byte(AsnBitStr), 0, byte(8*len(val.Bytes)-val.BitLength)), val.Bytes...)
+	case Oid:
+		var err error
+		if dst, err = val.appendEncoded(append(dst, byte(AsnObjectID), 0)); err != nil {
+			return nil, err
+		}
+	case net.IP:
+		valIPv4 := val.To4()
+		if valIPv4 == nil {
+			return nil, fmt.Errorf("can only encode IPv4 addresses")
+		}
+		dst = append(append(dst, byte(AsnIpaddress), 0), valIPv4...)
 	}
-	for _, b := range toEncap {
-		result = append(result, b)
+	return backfillLength(dst, start), nil
+}
+
+// decodeValue decodes a BER element of the given type, with content berValue.
+// berAll is the whole element, and idx its position for error messages.
+func decodeValue(berType BERType, berValue, berAll []byte, idx int) (interface{}, error) {
+	switch berType {
+	case AsnBoolean:
+		if len(berValue) != 1 {
+			return nil, fmt.Errorf("boolean length != 1 @ idx %v", idx)
+		}
+		return berValue[0] != 0, nil
+	case AsnInteger:
+		val, err := DecodeInteger(berValue)
+		if err != nil {
+			return nil, err
+		}
+		return val, nil
+	case AsnBitStr:
+		if len(berValue) == 0 || berValue[0] > 7 || (len(berValue) == 1 && berValue[0] != 0) {
+			return nil, fmt.Errorf("error decoding bit string %v: invalid number of unused bits", berValue)
+		}
+		return BitString{Bytes: append([]byte{}, berValue[1:]...),
+			BitLength: 8*(len(berValue)-1) - int(berValue[0])}, nil
+	case AsnOctetStr:
+		return string(berValue), nil
+	case AsnNull:
+		return nil, nil
+	case AsnObjectID:
+		oid, err := decodeOid(berValue)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding oid %v: %v", berValue, err)
+		}
+		return oid, nil
+	case AsnCounter32:
+		val, err := decodeUInt32(berValue)
+		if err != nil {
+			return nil, err
+		}
+		return Counter(val), nil
+	case AsnCounter64:
+		val, err := DecodeUInt(berValue)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding integer %v: %v", berValue, err)
+		}
+		return Counter64(val), nil
+	case AsnGauge32, AsnUInteger32:
+		val, err := decodeUInt32(berValue)
+		if err != nil {
+			return nil, err
+		}
+		return Gauge(val), nil
+	case Opaque:
+		val, err := decodeOpaque(berValue)
+		if err != nil {
+			return nil, err
+		}
+		return val, nil
+	case AsnTimeticks:
+		val, err := decodeUInt32(berValue)
+		if err != nil {
+			return nil, err
+		}
+		return time.Duration(val) * 10 * time.Millisecond, nil
+	case AsnIpaddress:
+		if len(berValue) != 4 {
+			return nil, fmt.Errorf("error decoding IP address %v: length is not 4", berValue)
+		}
+		return net.IPv4(berValue[0], berValue[1], berValue[2], berValue[3]), nil
+	case Sequence, AsnGetNextRequest, AsnGetRequest, AsnGetResponse, AsnSetRequest, AsnTrap, AsnGetBulkRequest,
+		AsnTrapV2, AsnInformRequest, AsnReport:
+		pdu, err := DecodeSequence(berAll)
+		if err != nil {
+			return nil, err
+		}
+		return pdu, nil
+	case NoSuchObject, NoSuchInstance, EndOfMibView:
+		// Exceptions stand in for the value of their varbind.
+		return berType, nil
+	default:
+		return UnsupportedBerType(append([]byte{}, berAll...)), nil
 	}
-	return result, nil
 }
@@ -5,7 +5,9 @@ import (
 	"encoding/hex"
 	"net"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCounter32Decoding(t *testing.T) {
@@ -81,13 +83,15 @@ func TestLengthDecodingEncoding(t *testing.T) {
 
 func TestDecodeEncodeInteger(t *testing.T) {
 	tests := map[int64][]byte{
-		3:          {0x03},
-		523:        {0x02, 0x0b},
-		1191105458: {0x46, 0xfe, 0xd3, 0xb2},
-		-91:        {0xff, 0xa5},
-		-654854:    {0xff, 0xf6, 0x01, 0xfa},
-		16495265:   {0x00, 0xfb, 0xb2, 0xa1},
-		9544834:    {0x00, 0x91, 0xa4, 0x82},
+		3:                  {0x03},
+		523:                {0x02, 0x0b},
+		1191105458:         {0x46, 0xfe, 0xd3, 0xb2},
+		-91:                {0xff, 0xa5},
+		-654854:            {0xff, 0xf6, 0x01, 0xfa},
+		16495265:           {0x00, 0xfb, 0xb2, 0xa1},
+		9544834:            {0x00, 0x91, 0xa4, 0x82},
+		-1 << 63:           {0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		-0x3cfcfcfcfcfcfd0: {0xfc, 0x30, 0x30, 0x30, 0x30, 0x30, 0x30, 0x30},
 	}
 
 	for testValue, testEncode := range tests {
@@ -119,9 +123,10 @@ func TestSequenceDecoding(t *testing.T) {
 		{"300b04067075626c6963020100", []interface{}{Sequence, "public", int64(0)}},
 		{"3013060b2b060102010202010a84234104566060eb", []interface{}{Sequence, MustParseOid("1.3.6.1.2.1.2.2.1.10.547"), Counter(1449156843)}},
 		{"300f060a2b060102010202010508420100", []interface{}{Sequence, MustParseOid("1.3.6.1.2.1.2.2.1.5.8"), Gauge(0)}},
-		{"3012060a2b0601020102020105344204ffffffff", []interface{}{Sequence, MustParseOid("1.3.6.1.2.1.2.2.1.5.52"), Gauge(4294967295)}},
+		{"3013060a2b060102010202010534420500ffffffff", []interface{}{Sequence, MustParseOid("1.3.6.1.2.1.2.2.1.5.52"), Gauge(4294967295)}},
 		{"300f060a2b060102010202011601060100", []interface{}{Sequence, MustParseOid("1.3.6.1.2.1.2.2.1.22.1"), MustParseOid("0.0")}},
 		{"3006400401020304", []interface{}{Sequence, net.ParseIP("1.2.3.4")}},
+		{"3006430404926fa4", []interface{}{Sequence, 76705700 * 10 * time.Millisecond}},
 	}
 
 	for _, test := range tests {
@@ -162,10 +167,13 @@ func TestSequenceDecoding(t *testing.T) {
 	}
 }
 
-func TestDecodeNoSuchInstance(t *testing.T) {
-	_, err := DecodeSequence([]byte{0x30, 0x0b, 0x06, 0x07, 0x2b, 0x06, 0x01, 0x02, 0x01, 0x01, 0x03, 0x81, 0x00})
-	if err == nil {
-		t.Error("got nil error for this decode, wanted error")
+func TestDecodeExceptions(t *testing.T) {
+	for _, exception := range []BERType{NoSuchObject, NoSuchInstance, EndOfMibView} {
+		got, err := DecodeSequence([]byte{0x30, 0x0b, 0x06, 0x07, 0x2b, 0x06, 0x01, 0x02, 0x01, 0x01, 0x03, byte(exception), 0x00})
+		want := []interface{}{Sequence, MustParseOid(".1.3.6.1.2.1.1.3"), exception}
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("DecodeSequence() of exception %#x => %v, %v, want %v", exception, got, err, want)
+		}
 	}
 }
 
@@ -187,3 +195,258 @@ func TestTrapV2(t *testing.T) {
 		t.Fatalf("Failed to decode trap sequence, got %q want 'test'", v)
 	}
 }
+
+func TestValueRoundTrip(t *testing.T) {
+	values := []interface{}{
+		nil,
+		true,
+		false,
+		int64(-129),
+		int64(1 << 40),
+		"string",
+		MustParseOid(".1.3.6.1.2.1.1.1.0"),
+		net.IPv4(192, 0, 2, 1),
+		Counter(4294967295),
+		Gauge(1),
+		Unsigned32(12),
+		Counter64(1<<64 - 1),
+		Gauge64(1 << 40),
+		time.Duration(4294967295) * 10 * time.Millisecond,
+		float32(1.5),
+		float64(-2.25),
+		OpaqueData{0x04, 0x01, 0x41},
+		BitString{Bytes: []byte{0xa0}, BitLength: 3},
+		BitString{Bytes: []byte{}, BitLength: 0},
+		NoSuchObject,
+		NoSuchInstance,
+		EndOfMibView,
+		UnsupportedBerType{0x45, 0x01, 0x02},
+	}
+	for _, value := range values {
+		enc, err := EncodeSequence([]interface{}{Sequence, value})
+		if err != nil {
+			t.Errorf("EncodeSequence() of %T %v returned error %v", value, value, err)
+			continue
+		}
+		got, err := DecodeSequence(enc)
+		want := []interface{}{Sequence, value}
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("DecodeSequence(EncodeSequence(%T %v)) => %#v, %v, want %#v", value, value, got, err, want)
+		}
+	}
+}
+
+func TestDecodeValues(t *testing.T) {
+	tests := []struct {
+		encoded string
+		want    interface{}
+	}{
+		// Counter64 with a leading zero to keep the sign bit clear.
+		{"4609 00ffffffffffffffff", Counter64(1<<64 - 1)},
+		// TimeTicks are unsigned.
+		{"4304 ffffffff", time.Duration(4294967295) * 10 * time.Millisecond},
+		// Some agents leave out the leading zero of unsigned values.
+		{"4204 ffffffff", Gauge(4294967295)},
+		// The UInteger32 of RFC 1442.
+		{"4701 05", Gauge(5)},
+		// The wrapped types of draft-perkins-opaque-01.
+		{"4405 9f760201ff", Counter64(511)},
+		{"4404 9f7a01ff", int64(-1)},
+		{"4407 9f78043fc00000", float32(1.5)},
+		{"4403 040141", OpaqueData{0x04, 0x01, 0x41}},
+		{"0101 01", true},
+		{"0302 0680", BitString{Bytes: []byte{0x80}, BitLength: 2}},
+		{"0402 4142", "AB"},
+	}
+	for _, test := range tests {
+		value, _ := hex.DecodeString(strings.ReplaceAll(test.encoded, " ", ""))
+		got, err := DecodeSequence(append([]byte{byte(Sequence), byte(len(value))}, value...))
+		want := []interface{}{Sequence, test.want}
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("DecodeSequence(%s) => %#v, %v, want %#v", test.encoded, got, err, want)
+		}
+	}
+}
+
+func TestEncodeUnsigned(t *testing.T) {
+	tests := []struct {
+		value   interface{}
+		encoded string
+	}{
+		{Counter(0x7fffffff), "41047fffffff"},
+		{Counter(0x80000000), "41050080000000"},
+		{Counter(0xffffffff), "410500ffffffff"},
+		{Gauge(0x80000000), "42050080000000"},
+		{Gauge(0xffffffff), "420500ffffffff"},
+		{time.Duration(0x80000000) * 10 * time.Millisecond, "43050080000000"},
+		{time.Duration(0xffffffff) * 10 * time.Millisecond, "430500ffffffff"},
+		{Counter64(0x80000000), "46050080000000"},
+		{Counter64(0xffffffff), "460500ffffffff"},
+		{Counter64(1 << 63), "4609008000000000000000"},
+		{Gauge64(1 << 63), "440c9f7b09008000000000000000"},
+	}
+	for _, test := range tests {
+		enc, err := EncodeSequence([]interface{}{Sequence, test.value})
+		if err != nil {
+			t.Errorf("EncodeSequence() of %T %v returned error %v", test.value, test.value, err)
+			continue
+		}
+		if got := hex.EncodeToString(enc[2:]); got != test.encoded {
+			t.Errorf("EncodeSequence() of %T %v => %s, want %s", test.value, test.value, got, test.encoded)
+		}
+		got, err := DecodeSequence(enc)
+		want := []interface{}{Sequence, test.value}
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("DecodeSequence(EncodeSequence(%T %v)) => %#v, %v, want %#v", test.value, test.value, got, err, want)
+		}
+	}
+}
+
+func TestEncodeInvalidValues(t *testing.T) {
+	for _, value := range []interface{}{
+		-10 * time.Millisecond,
+		BitString{Bytes: []byte{0x80}, BitLength: 9},
+		BitString{Bytes: []byte{0x80, 0x00}, BitLength: 1},
+		net.ParseIP("2001:db8::1"),
+		AsnGetRequest,
+	} {
+		if _, err := EncodeSequence([]interface{}{Sequence, value}); err == nil {
+			t.Errorf("EncodeSequence() of %T %v returned no error", value, value)
+		}
+	}
+}
+
+func TestEncodeLongLengths(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	enc, err := EncodeSequence([]interface{}{Sequence, long, []interface{}{Sequence, long}})
+	if err != nil {
+		t.Fatalf("EncodeSequence() returned error %v", err)
+	}
+	// 300 is 0x012c, in the long form.
+	if want := "30820264" + "0482012c"; hex.EncodeToString(enc[:8]) != want {
+		t.Errorf("EncodeSequence() starts with %x, want %s", enc[:8], want)
+	}
+	got, err := DecodeSequence(enc)
+	want := []interface{}{Sequence, long, []interface{}{Sequence, long}}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("DecodeSequence(EncodeSequence()) => %v, want the long strings back", err)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	for _, encoded := range []string{
+		"",
+		"30",
+		"3005020100",           // Sequence longer than the packet.
+		"3003020500",           // Integer longer than the sequence.
+		"300102",               // Length missing.
+		"3080020100",           // Indefinite length.
+		"30898000000000000000", // Length larger than 64 bits.
+		"3088ffffffffffffffff", // Length that doesn't fit in an int.
+		"30050288ffffffffffffffff01",
+		"30020200",         // Integer without content.
+		"3003060181",       // Oid ending in the middle of a sub-identifier.
+		"30071f8101020000", // Multi-byte type.
+		"3003010200",       // Boolean longer than 1 byte.
+		"3003030107",       // Bit string with unused bits but no bits.
+		"300440020102",     // IP address that isn't 4 bytes.
+		"0403616263",       // Not a sequence.
+		"3004300302",       // Truncated nested sequence.
+	} {
+		packet, _ := hex.DecodeString(encoded)
+		if got, err := DecodeSequence(packet); err == nil {
+			t.Errorf("DecodeSequence(%s) => %v, want an error", encoded, got)
+		}
+	}
+
+	// Bytes after the sequence, like the padding of a decrypted scoped PDU,
+	// are ignored.
+	packet, _ := hex.DecodeString("30030201000000")
+	if got, err := DecodeSequence(packet); err != nil || !reflect.DeepEqual(got, []interface{}{Sequence, int64(0)}) {
+		t.Errorf("DecodeSequence() with trailing bytes => %v, %v", got, err)
+	}
+}
+
+func FuzzDecodeSequence(f *testing.F) {
+	for _, seed := range []string{
+		"3003020100",
+		"3013060b2b060102010202010a84234104566060eb",
+		"3012060a2b0601020102020105344204ffffffff",
+		"3006400401020304",
+		"3006430404926fa4",
+		"3009300702010102020101",
+		"30074405 9f760201ff",
+		"3032020101040b5b52305f4340637469215da220020478fc2ffa0201000201003012301006082b06010201010300430404926fa4",
+	} {
+		packet, _ := hex.DecodeString(strings.ReplaceAll(seed, " ", ""))
+		f.Add(packet)
+	}
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		decoded, err := DecodeSequence(packet)
+		if err != nil {
+			return
+		}
+		// Everything that decodes can be encoded again.
+		enc, err := EncodeSequence(decoded)
+		if err != nil {
+			t.Fatalf("EncodeSequence(DecodeSequence(%x)) returned error %v", packet, err)
+		}
+		if _, err := DecodeSequence(enc); err != nil {
+			t.Fatalf("DecodeSequence(EncodeSequence(DecodeSequence(%x))) returned error %v", packet, err)
+		}
+	})
+}
+
+// benchmarkResponse returns a GetResponse message with 50 varbinds, like a
+// GetBulk response of an interface table.
+func benchmarkResponse() []interface{} {
+	varbinds := []interface{}{Sequence}
+	for i := 1; i <= 50; i++ {
+		varbinds = append(varbinds, []interface{}{Sequence, Oid{1, 3, 6, 1, 2, 1, 2, 2, 1, 10, i}, Counter(i * 1000003)})
+	}
+	return []interface{}{Sequence, int(SNMPv2c), "public",
+		[]interface{}{AsnGetResponse, 12345, 0, 0, varbinds}}
+}
+
+func BenchmarkEncodeSequence(b *testing.B) {
+	msg := benchmarkResponse()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := EncodeSequence(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendSequence(b *testing.B) {
+	msg := benchmarkResponse()
+	buf := make([]byte, 0, bufSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if buf, err = AppendSequence(buf[:0], msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestAppendSequence(t *testing.T) {
+	msg := benchmarkResponse()
+	want, err := EncodeSequence(msg)
+	if err != nil {
+		t.Fatalf("EncodeSequence() returned error %v", err)
+	}
+	prefix := []byte{1, 2, 3}
+	got, err := AppendSequence(append([]byte{}, prefix...), msg)
+	if err != nil {
+		t.Fatalf("AppendSequence() returned error %v", err)
+	}
+	if !reflect.DeepEqual(got, append(prefix, want...)) {
+		t.Errorf("AppendSequence() => %x, want %x after %x", got, want, prefix)
+	}
+
+	buf := make([]byte, 0, bufSize)
+	if allocs := testing.AllocsPerRun(10, func() { buf, _ = AppendSequence(buf[:0], msg) }); allocs != 0 {
+		t.Errorf("AppendSequence() into a large enough buffer made %v allocations, want 0", allocs)
+	}
+}
@@ -0,0 +1,291 @@
+package wapsnmp
+
+/* This file implements a cursor over BER encoded packets, which decodes only
+   the elements it's asked for, instead of building the []interface{} tree
+   DecodeSequence returns.
+
+   References : X.690 section 8.1 (encoding of a data value), RFC 3416
+                section 3 (PDU definitions).
+*/
+
+import (
+	"fmt"
+)
+
+// maxDecoderDepth is how many constructed elements a Decoder can be in at
+// once. SNMP messages nest 4 deep.
+const maxDecoderDepth = 16
+
+// Decoder reads a BER encoded packet one element at a time. Next moves to the
+// next element of the constructed element the decoder is in, or of the packet
+// itself at first. Enter moves into the current element, and Leave back out
+// of it, skipping the elements that weren't read.
+//
+// The bytes a Decoder returns refer to the packet, the values it decodes
+// don't.
+type Decoder struct {
+	packet []byte
+	pos    int // Where the next element starts.
+	end    int // Where the elements of the constructed element the decoder is in end.
+	ends   [maxDecoderDepth]int
+	depth  int
+
+	// The current element.
+	tag          BERType
+	start        int
+	contentStart int
+	contentEnd   int
+
+	err error
+}
+
+// NewDecoder returns a Decoder positioned before the first element of packet.
+func NewDecoder(packet []byte) *Decoder {
+	return &Decoder{packet: packet, end: len(packet), start: -1}
+}
+
+// Next moves to the next element, and returns whether there is one. It
+// returns false at the end of the constructed element the decoder is in, and
+// when the element is malformed, see Err.
+func (d *Decoder) Next() bool {
+	d.start = -1
+	if d.err != nil || d.pos >= d.end {
+		return false
+	}
+	tag := BERType(d.packet[d.pos])
+	if tag&AsnExtensionID == AsnExtensionID {
+		d.err = fmt.Errorf("multi-byte BER type @ idx %v isn't supported", d.pos)
+		return false
+	}
+	start, end, err := tlvBounds(d.packet[:d.end], d.pos)
+	if err != nil {
+		d.err = fmt.Errorf("length parse error @ idx %v: %v", d.pos, err)
+		return false
+	}
+	d.tag, d.start, d.contentStart, d.contentEnd = tag, d.pos, start, end
+	d.pos = end
+	return true
+}
+
+// Err returns why Next returned false, or nil at the end of a constructed
+// element.
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Tag returns the type of the current element.
+func (d *Decoder) Tag() BERType {
+	return d.tag
+}
+
+// Bytes returns the content of the current element.
+func (d *Decoder) Bytes() []byte {
+	if d.start < 0 {
+		return nil
+	}
+	return d.packet[d.contentStart:d.contentEnd]
+}
+
+// Raw returns the current element, including its type and length.
+func (d *Decoder) Raw() []byte {
+	if d.start < 0 {
+		return nil
+	}
+	return d.packet[d.start:d.contentEnd]
+}
+
+// Enter moves into the current element, which has to be a sequence or a PDU.
+// Next then returns its elements.
+func (d *Decoder) Enter() error {
+	if d.start < 0 {
+		return fmt.Errorf("no BER element to enter")
+	}
+	if !constructed(d.tag) {
+		return fmt.Errorf("BER element @ idx %v of type %v isn't a sequence", d.start, d.tag)
+	}
+	if d.depth == maxDecoderDepth {
+		return fmt.Errorf("BER element @ idx %v is nested more than %d deep", d.start, maxDecoderDepth)
+	}
+	d.ends[d.depth] = d.end
+	d.depth++
+	d.pos, d.end = d.contentStart, d.contentEnd
+	d.start = -1
+	return nil
+}
+
+// Leave moves out of the element the decoder entered last. Next then returns
+// the element after it.
+func (d *Decoder) Leave() error {
+	if d.depth == 0 {
+		return fmt.Errorf("BER decoder isn't in an element")
+	}
+	d.depth--
+	d.pos, d.end = d.end, d.ends[d.depth]
+	d.start = -1
+	return nil
+}
+
+// Value decodes the current element like DecodeSequence does.
+func (d *Decoder) Value() (interface{}, error) {
+	if d.start < 0 {
+		return nil, fmt.Errorf("no BER element to decode")
+	}
+	return decodeValue(d.tag, d.Bytes(), d.Raw(), d.start)
+}
+
+// Int decodes the current element, which has to be an integer.
+func (d *Decoder) Int() (int64, error) {
+	if d.start < 0 || d.tag != AsnInteger {
+		return 0, fmt.Errorf("BER element @ idx %v isn't an integer", d.start)
+	}
+	return DecodeInteger(d.Bytes())
+}
+
+// Oid decodes the current element, which has to be an object identifier.
+func (d *Decoder) Oid() (Oid, error) {
+	if d.start < 0 || d.tag != AsnObjectID {
+		return nil, fmt.Errorf("BER element @ idx %v isn't an oid", d.start)
+	}
+	oid, err := decodeOid(d.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("error decoding oid %v: %v", d.Bytes(), err)
+	}
+	return oid, nil
+}
+
+// count returns the number of elements in the current element, without
+// decoding them.
+func (d *Decoder) count() int {
+	n := 0
+	for pos := d.contentStart; pos < d.contentEnd; n++ {
+		_, end, err := tlvBounds(d.packet[:d.contentEnd], pos)
+		if err != nil {
+			// Next will report it.
+			return n
+		}
+		pos = end
+	}
+	return n
+}
+
+// next moves to the next element, which has to be there.
+func (d *Decoder) next(what string) error {
+	if d.Next() {
+		return nil
+	}
+	if d.err != nil {
+		return d.err
+	}
+	return fmt.Errorf("%s is missing", what)
+}
+
+// nextInt moves to the next element, and decodes it as an integer.
+func (d *Decoder) nextInt(what string) (int64, error) {
+	if err := d.next(what); err != nil {
+		return 0, err
+	}
+	val, err := d.Int()
+	if err != nil {
+		return 0, fmt.Errorf("malformed %s: %v", what, err)
+	}
+	return val, nil
+}
+
+// leave checks the element the decoder entered last has no elements left, and
+// leaves it.
+func (d *Decoder) leave(what string) error {
+	if d.Next() {
+		return fmt.Errorf("%s has more elements than expected", what)
+	}
+	if d.err != nil {
+		return d.err
+	}
+	return d.Leave()
+}
+
+// constructed returns whether elements of type t contain other elements.
+func constructed(t BERType) bool {
+	switch t {
+	case Sequence, AsnGetNextRequest, AsnGetRequest, AsnGetResponse, AsnSetRequest, AsnTrap, AsnGetBulkRequest,
+		AsnTrapV2, AsnInformRequest, AsnReport:
+		return true
+	}
+	return false
+}
+
+// readPDU decodes the current element, a PDU other than GetBulkRequest and
+// the SNMPv1 Trap.
+func readPDU(d *Decoder) (*PDU, error) {
+	pduType := d.Tag()
+	if pduType == AsnGetBulkRequest || pduType == AsnTrap {
+		return nil, fmt.Errorf("unexpected PDU type %v", pduType)
+	}
+	if err := d.Enter(); err != nil {
+		return nil, fmt.Errorf("unexpected PDU type %v: %v", pduType, err)
+	}
+	requestID, err := d.nextInt("request ID")
+	if err != nil {
+		return nil, err
+	}
+	errorStatus, err := d.nextInt("error-status")
+	if err != nil {
+		return nil, err
+	}
+	errorIndex, err := d.nextInt("error-index")
+	if err != nil {
+		return nil, err
+	}
+	if err := d.next("varbind list"); err != nil {
+		return nil, err
+	}
+	varbinds, err := readVarbinds(d)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.leave("PDU"); err != nil {
+		return nil, err
+	}
+	return &PDU{pduType, int(requestID), ErrorStatus(errorStatus), int(errorIndex), varbinds}, nil
+}
+
+// readVarbinds decodes the current element, a varbind list.
+func readVarbinds(d *Decoder) ([]SNMPValue, error) {
+	if d.Tag() != Sequence {
+		return nil, fmt.Errorf("malformed varbind list %x", d.Raw())
+	}
+	result := make([]SNMPValue, 0, d.count())
+	if err := d.Enter(); err != nil {
+		return nil, err
+	}
+	for d.Next() {
+		raw := d.Raw()
+		if d.Tag() != Sequence {
+			return nil, fmt.Errorf("malformed varbind %x", raw)
+		}
+		if err := d.Enter(); err != nil {
+			return nil, err
+		}
+		if !d.Next() || d.Tag() != AsnObjectID {
+			return nil, fmt.Errorf("malformed varbind %x", raw)
+		}
+		oid, err := d.Oid()
+		if err != nil {
+			return nil, err
+		}
+		if !d.Next() {
+			return nil, fmt.Errorf("malformed varbind %x", raw)
+		}
+		value, err := d.Value()
+		if err != nil {
+			return nil, err
+		}
+		if err := d.leave("varbind"); err != nil {
+			return nil, err
+		}
+		result = append(result, SNMPValue{oid, value})
+	}
+	if err := d.Err(); err != nil {
+		return nil, err
+	}
+	return result, d.Leave()
+}
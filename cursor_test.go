@@ -0,0 +1,238 @@
+package wapsnmp
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// decodeTree decodes the current element of d like DecodeSequence does, but
+// with the cursor.
+func decodeTree(d *Decoder) ([]interface{}, error) {
+	result := []interface{}{d.Tag()}
+	if err := d.Enter(); err != nil {
+		return nil, err
+	}
+	for d.Next() {
+		if constructed(d.Tag()) {
+			sub, err := decodeTree(d)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, sub)
+			continue
+		}
+		val, err := d.Value()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, val)
+	}
+	if err := d.Err(); err != nil {
+		return nil, err
+	}
+	return result, d.Leave()
+}
+
+func TestDecoder(t *testing.T) {
+	// GetResponse with sysUpTime.0 and sysName.0, after a community.
+	packet, _ := hex.DecodeString("303c02010104067075626c6963a22f020478fc2ffa0201000201003021301006082b06010201010300430404926fa4300d06082b0601020101050004017a")
+	d := NewDecoder(packet)
+	if !d.Next() || d.Tag() != Sequence {
+		t.Fatalf("Next() => %v, want the message", d.Tag())
+	}
+	if err := d.Enter(); err != nil {
+		t.Fatalf("Enter() returned error %v", err)
+	}
+	if version, err := d.nextInt("version"); err != nil || version != 1 {
+		t.Errorf("version => %v, %v, want 1", version, err)
+	}
+	if !d.Next() || d.Tag() != AsnOctetStr || string(d.Bytes()) != "public" {
+		t.Errorf("community => %v %q, want public", d.Tag(), d.Bytes())
+	}
+	if !d.Next() || d.Tag() != AsnGetResponse {
+		t.Fatalf("Next() => %v, want the PDU", d.Tag())
+	}
+	pdu, err := readPDU(d)
+	if err != nil {
+		t.Fatalf("readPDU() returned error %v", err)
+	}
+	want := []SNMPValue{
+		{MustParseOid(".1.3.6.1.2.1.1.3.0"), decodeTicks(t, "04926fa4")},
+		{MustParseOid(".1.3.6.1.2.1.1.5.0"), "z"},
+	}
+	if pdu.RequestID != 0x78fc2ffa || !reflect.DeepEqual(pdu.VarBinds, want) {
+		t.Errorf("readPDU() => %+v, want request ID 0x78fc2ffa and %v", pdu, want)
+	}
+	if d.Next() || d.Err() != nil {
+		t.Errorf("Next() after the PDU => %v, %v, want the end of the message", d.Tag(), d.Err())
+	}
+	if err := d.Leave(); err != nil || d.Next() {
+		t.Errorf("Leave() => %v, want the end of the packet", err)
+	}
+	if err := d.Leave(); err == nil {
+		t.Errorf("Leave() at the top level returned no error")
+	}
+
+	// Leave skips the elements that weren't read.
+	d = NewDecoder(packet)
+	d.Next()
+	d.Enter()
+	d.Next()
+	if err := d.Leave(); err != nil || d.Next() {
+		t.Errorf("Leave() after the first element => %v, want the end of the packet", err)
+	}
+
+	// Only sequences and PDUs can be entered.
+	d = NewDecoder(packet)
+	d.Next()
+	d.Enter()
+	d.Next()
+	if err := d.Enter(); err == nil {
+		t.Errorf("Enter() of an integer returned no error")
+	}
+	if _, err := d.Oid(); err == nil {
+		t.Errorf("Oid() of an integer returned no error")
+	}
+}
+
+// decodeTicks decodes TimeTicks content.
+func decodeTicks(t *testing.T, content string) interface{} {
+	b, _ := hex.DecodeString(content)
+	val, err := decodeValue(AsnTimeticks, b, nil, 0)
+	if err != nil {
+		t.Fatalf("decodeValue(%s) returned error %v", content, err)
+	}
+	return val
+}
+
+func TestDecoderMalformed(t *testing.T) {
+	for _, encoded := range []string{
+		"",
+		"30",
+		"3005020100",           // Sequence longer than the packet.
+		"3003020500",           // Integer longer than the sequence.
+		"300102",               // Length missing.
+		"3080020100",           // Indefinite length.
+		"3088ffffffffffffffff", // Length that doesn't fit in an int.
+		"30020200",             // Integer without content.
+		"3003060181",           // Oid ending in the middle of a sub-identifier.
+		"30071f8101020000",     // Multi-byte type.
+		"0403616263",           // Not a sequence.
+		"3004300302",           // Truncated nested sequence.
+	} {
+		packet, _ := hex.DecodeString(encoded)
+		d := NewDecoder(packet)
+		if !d.Next() {
+			if d.Err() == nil && len(packet) > 0 {
+				t.Errorf("Next() of %s returned false without error", encoded)
+			}
+			continue
+		}
+		if got, err := decodeTree(d); err == nil {
+			t.Errorf("decodeTree(%s) => %v, want an error", encoded, got)
+		}
+	}
+
+	// Nesting deeper than a Decoder supports is an error, not a crash.
+	packet := []byte{}
+	for i := 0; i < 2*maxDecoderDepth; i++ {
+		packet = append([]byte{byte(Sequence), byte(len(packet))}, packet...)
+	}
+	d := NewDecoder(packet)
+	d.Next()
+	if _, err := decodeTree(d); err == nil {
+		t.Errorf("decodeTree() of %d nested sequences returned no error", 2*maxDecoderDepth)
+	}
+}
+
+func TestReadVarbinds(t *testing.T) {
+	for _, encoded := range []string{
+		"3000",
+		"30083006060129020101",
+		"300e300c06082b0601020101050005 00",
+		"3003020101",               // Not a varbind.
+		"30053003020101",           // Varbind without oid.
+		"300530030601 29",          // Varbind without value.
+		"30083006060129 0500 0500", // Varbind with an extra element.
+		"0400",                     // Not a varbind list.
+	} {
+		packet, _ := hex.DecodeString(strings.ReplaceAll(encoded, " ", ""))
+		var want []SNMPValue
+		decoded, wantErr := DecodeSequence(packet)
+		if wantErr == nil {
+			want, wantErr = decodeVarbinds(decoded)
+		}
+
+		d := NewDecoder(packet)
+		d.Next()
+		got, err := readVarbinds(d)
+		if (err != nil) != (wantErr != nil) || (err == nil && !reflect.DeepEqual(got, want)) {
+			t.Errorf("readVarbinds(%s) => %v, %v, want %v, %v", encoded, got, err, want, wantErr)
+		}
+	}
+}
+
+func BenchmarkDecodeSequence(b *testing.B) {
+	packet, err := EncodeSequence(benchmarkResponse())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		decoded, err := DecodeSequence(packet)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := decodePDU(decoded[3].([]interface{})); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecoder(b *testing.B) {
+	packet, err := EncodeSequence(benchmarkResponse())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		d := NewDecoder(packet)
+		d.Next()
+		d.Enter()
+		d.Next()
+		d.Next()
+		d.Next()
+		if _, err := readPDU(d); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func FuzzDecoder(f *testing.F) {
+	for _, seed := range []string{
+		"3003020100",
+		"3013060b2b060102010202010a84234104566060eb",
+		"3009300702010102020101",
+		"3032020101040b5b52305f4340637469215da220020478fc2ffa0201000201003012301006082b06010201010300430404926fa4",
+	} {
+		packet, _ := hex.DecodeString(seed)
+		f.Add(packet)
+	}
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		d := NewDecoder(packet)
+		if !d.Next() || !constructed(d.Tag()) {
+			return
+		}
+		got, err := decodeTree(d)
+		if err != nil {
+			return
+		}
+		// What the cursor decodes, DecodeSequence decodes the same.
+		want, err := DecodeSequence(packet)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("decodeTree(%x) => %v, DecodeSequence() => %v, %v", packet, got, want, err)
+		}
+	})
+}
@@ -0,0 +1,297 @@
+package wapsnmp
+
+/* This file implements SNMPv3 engine discovery, timeliness and the handling
+   of Report PDUs.
+
+   References : RFC 3414 section 3.2 (timeliness) and section 4 (discovery).
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Errors signalled by the agent through usmStats Report PDUs. Use errors.Is
+// to check for them on the error returned by an SNMPv3 request.
+var (
+	ErrUnsupportedSecLevel = errors.New("unsupported security level")
+	ErrNotInTimeWindow     = errors.New("not in time window")
+	ErrUnknownUserName     = errors.New("unknown user name")
+	ErrUnknownEngineID     = errors.New("unknown engine ID")
+	ErrWrongDigest         = errors.New("wrong digest")
+	ErrDecryptionError     = errors.New("decryption error")
+)
+
+// usmStatsOid is the prefix of the usmStats counters, RFC 3414 section 5.
+var usmStatsOid = MustParseOid(".1.3.6.1.6.3.15.1.1")
+
+// usmStatsErrors maps the usmStats counters to their errors.
+var usmStatsErrors = map[int]error{
+	1: ErrUnsupportedSecLevel,
+	2: ErrNotInTimeWindow,
+	3: ErrUnknownUserName,
+	4: ErrUnknownEngineID,
+	5: ErrWrongDigest,
+	6: ErrDecryptionError,
+}
+
+// ReportError is returned when an agent answers a request with a Report PDU.
+type ReportError struct {
+	Oid   Oid         // The counter reported by the agent.
+	Value interface{} // The value of that counter.
+	Err   error       // One of the ErrXxx usmStats errors, nil for other reports.
+}
+
+// Error returns a description of the report.
+func (e *ReportError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("received report %v: %v = %v", e.Err, e.Oid, e.Value)
+	}
+	return fmt.Sprintf("received report %v = %v", e.Oid, e.Value)
+}
+
+// Unwrap returns the usmStats error, so errors.Is works on a ReportError.
+func (e *ReportError) Unwrap() error {
+	return e.Err
+}
+
+// newReportError converts a Report PDU into a ReportError.
+func newReportError(pdu []interface{}) error {
+	if len(pdu) < 5 {
+		return fmt.Errorf("malformed report PDU %v", pdu)
+	}
+	varbinds, ok := pdu[4].([]interface{})
+	if !ok || len(varbinds) < 2 {
+		return fmt.Errorf("report PDU without varbinds %v", pdu)
+	}
+	varbind, ok := varbinds[1].([]interface{})
+	if !ok || len(varbind) != 3 {
+		return fmt.Errorf("malformed varbind in report PDU %v", varbinds[1])
+	}
+	oid, ok := varbind[1].(Oid)
+	if !ok {
+		return fmt.Errorf("malformed varbind in report PDU %v", varbinds[1])
+	}
+
+	result := &ReportError{Oid: oid, Value: varbind[2]}
+	if len(oid) == len(usmStatsOid)+2 && oid.Within(usmStatsOid) {
+		result.Err = usmStatsErrors[oid[len(usmStatsOid)]]
+	}
+	return result
+}
+
+// engineTime returns the current estimate of the authoritative engine's time.
+// u.mu must be held.
+func (u *USM) engineTime() int64 {
+	if u.engineTimeAt.IsZero() {
+		return u.AuthoritativeEngineTime
+	}
+	return u.AuthoritativeEngineTime + int64(time.Since(u.engineTimeAt)/time.Second)
+}
+
+// setEngine records the authoritative engine's ID, boots and time from a
+// received message.
+func (u *USM) setEngine(header *usmHeader) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.AuthoritativeEngineID = header.engineID
+	u.AuthoritativeEngineBoots = header.engineBoots
+	u.AuthoritativeEngineTime = header.engineTime
+	u.engineTimeAt = time.Now()
+}
+
+// discovered returns whether the authoritative engine ID is known.
+func (u *USM) discovered() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.AuthoritativeEngineID != ""
+}
+
+// updateEngineTime records the boots and time of an authentic message if
+// they are newer than what is known, RFC 3414 section 3.2 step 7b.
+func (u *USM) updateEngineTime(header *usmHeader) {
+	u.mu.Lock()
+	newer := header.engineID == u.AuthoritativeEngineID && (header.engineBoots > u.AuthoritativeEngineBoots ||
+		(header.engineBoots == u.AuthoritativeEngineBoots && header.engineTime > u.engineTime()))
+	u.mu.Unlock()
+	if newer {
+		u.setEngine(header)
+	}
+}
+
+// timeWindow is how many seconds a message may be older than the known
+// engine time, RFC 3414 section 3.2 step 7b.
+const timeWindow = 150
+
+// checkTimeliness returns ErrNotInTimeWindow if an authentic message comes
+// from an earlier boot of the engine, or is more than timeWindow seconds older
+// than its known time, RFC 3414 section 3.2 step 7b. Such a message may be a
+// replay.
+func (u *USM) checkTimeliness(header *usmHeader) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if header.engineBoots == math.MaxInt32 || header.engineBoots < u.AuthoritativeEngineBoots ||
+		(header.engineBoots == u.AuthoritativeEngineBoots && header.engineTime < u.engineTime()-timeWindow) {
+		return fmt.Errorf("response from boot %d at time %d, engine is at boot %d time %d: %w",
+			header.engineBoots, header.engineTime, u.AuthoritativeEngineBoots, u.engineTime(), ErrNotInTimeWindow)
+	}
+	return nil
+}
+
+// Discover learns the authoritative engine ID, boots and time of an SNMPv3
+// agent, as described in RFC 3414 section 4. This is done automatically
+// before the first request, but can be called to rediscover the engine.
+func (w WapSNMP) Discover() error {
+	return w.DiscoverContext(context.Background())
+}
+
+// DiscoverContext is Discover with a context. Cancelling ctx aborts the
+// discovery.
+func (w WapSNMP) DiscoverContext(ctx context.Context) error {
+	if w.usm == nil {
+		return errors.New("SNMPv3 requires USM settings")
+	}
+	return w.discover(ctx, w.usm)
+}
+
+// discover learns the authoritative engine into usm.
+func (w WapSNMP) discover(ctx context.Context, usm *USM) error {
+	// Send an empty, unauthenticated request with an unknown engine ID, the
+	// agent will answer with a usmStatsUnknownEngineIDs report.
+	probe := &USM{}
+	msgID := RandomRequestID()
+	pdu := []interface{}{AsnGetRequest, RandomRequestID(), 0, 0, []interface{}{Sequence}}
+	req, err := probe.encodeMessage(msgID, pdu)
+	if err != nil {
+		return err
+	}
+	var resp v3Response
+	if _, err := w.roundTrip(ctx, int64(msgID), req, probe.acceptResponse(msgID, pduRequestID(pdu), &resp)); err != nil {
+		return err
+	}
+	header := resp.header
+	if resp.pdu[0] != AsnReport {
+		return fmt.Errorf("expected a report in answer to engine discovery, got %v", resp.pdu[0])
+	}
+	if header.engineID == "" {
+		return errors.New("agent did not send its engine ID during discovery")
+	}
+
+	// Many agents already send boots and time in this report. Agents that
+	// don't will answer the first authenticated request with a
+	// usmStatsNotInTimeWindows report, which exchangeV3 handles.
+	usm.setEngine(header)
+	return nil
+}
+
+// withoutEngine returns a USM with the user and context of u, and no engine.
+func (u *USM) withoutEngine() *USM {
+	return &USM{UserName: u.UserName, AuthProtocol: u.AuthProtocol, AuthPassword: u.AuthPassword,
+		PrivProtocol: u.PrivProtocol, PrivPassword: u.PrivPassword, ContextName: u.ContextName,
+		ContextEngineID: u.ContextEngineID}
+}
+
+// v3Response is a response accepted by USM.acceptResponse.
+type v3Response struct {
+	pdu    []interface{}
+	header *usmHeader
+}
+
+// acceptResponse returns a function for roundTrip that accepts the response
+// to the SNMPv3 message msgID, and stores it in resp. Reports are accepted
+// too, as they tell why the request failed.
+func (u *USM) acceptResponse(msgID int, requestID int64, resp *v3Response) func([]byte) error {
+	return func(raw []byte) error {
+		pdu, header, err := u.decodeMessage(raw)
+		if err != nil {
+			return err
+		}
+		if header.msgID != int64(msgID) {
+			return fmt.Errorf("response has message ID %d, want %d", header.msgID, msgID)
+		}
+		if pdu[0] != AsnReport {
+			if pdu[0] != AsnGetResponse || len(pdu) < 2 {
+				return fmt.Errorf("response is not a GetResponse: %v", pdu)
+			}
+			if pdu[1] != requestID {
+				return fmt.Errorf("response has request ID %v, want %d", pdu[1], requestID)
+			}
+			// Reports are exempt, a notInTimeWindow report is how the agent
+			// tells its time.
+			if header.flags&msgFlagAuth != 0 {
+				if err := u.checkTimeliness(header); err != nil {
+					return err
+				}
+			}
+		}
+		resp.pdu, resp.header = pdu, header
+		return nil
+	}
+}
+
+// exchangeV3 sends a request PDU in an SNMPv3 message and returns the
+// response PDU, and the size of the response message. Discovers the engine
+// first if needed, and recovers from reports that signal stale engine
+// information.
+func (w WapSNMP) exchangeV3(ctx context.Context, pdu MessagePDU) (*PDU, int, error) {
+	if w.usm == nil {
+		return nil, 0, errors.New("SNMPv3 requires USM settings")
+	}
+	if !w.usm.discovered() {
+		if err := w.DiscoverContext(ctx); err != nil {
+			return nil, 0, fmt.Errorf("engine discovery failed: %v", err)
+		}
+	}
+
+	// After a usmStatsUnknownEngineIDs report the engine is rediscovered
+	// into usm, and only replaces the known one once a request to it gets a
+	// response. Anyone can send the report, or answer the discovery, but
+	// only the agent can authenticate the response.
+	usm := w.usm
+	resynced, rediscovered := false, false
+	for {
+		msgID := RandomRequestID()
+		req, err := usm.encodeMessage(msgID, pdu.Sequence())
+		if err != nil {
+			return nil, 0, err
+		}
+		var v3Resp v3Response
+		size, err := w.roundTrip(ctx, int64(msgID), req, usm.acceptResponse(msgID, pduRequestID(pdu.Sequence()), &v3Resp))
+		if err != nil {
+			return nil, 0, err
+		}
+		resp, header := v3Resp.pdu, v3Resp.header
+		authentic := header.flags&msgFlagAuth != 0
+		if resp[0] != AsnReport {
+			// A response from a rediscovered engine is authentic, unless
+			// the user has no authentication, so adopt the engine.
+			if usm != w.usm {
+				w.usm.setEngine(header)
+			} else if authentic {
+				w.usm.updateEngineTime(header)
+			}
+			respPDU, err := decodePDU(resp)
+			return respPDU, size, err
+		}
+
+		reportErr := newReportError(resp)
+		switch {
+		case errors.Is(reportErr, ErrNotInTimeWindow) && authentic && !resynced:
+			// Only trust the clock of an authentic report.
+			usm.setEngine(header)
+			resynced = true
+		case errors.Is(reportErr, ErrUnknownEngineID) && !rediscovered:
+			// The agent changed its engine ID, e.g. after a reconfiguration.
+			usm = w.usm.withoutEngine()
+			if err := w.discover(ctx, usm); err != nil {
+				return nil, 0, fmt.Errorf("engine rediscovery failed: %v", err)
+			}
+			rediscovered = true
+		default:
+			return nil, 0, reportErr
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package wapsnmp
+
+import (
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestDiscoverV3(t *testing.T) {
+	rand.Seed(0)
+
+	oid := MustParseOid("1.3.6.1.2.1.1.5.0")
+	agent := testAgentUSM()
+
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	// Expect an empty noAuthNoPriv discovery request. The agent answers with
+	// an unauthenticated usmStatsUnknownEngineIDs report.
+	udpStub.Expect("303d020103301002041f5b0412020240000401040201030410300e0400020100020100040004000400301404000400a0" +
+		"0e020453f65ff90201000201003000").AndRespond([]string{
+		"3072020103301102041f5b0412020300ffe304010002010304223020041180001f8880e9bd0c1d12667a510000000002" +
+			"0105020203e80400040004003036041180001f8880e9bd0c1d12667a51000000000400a81f020453f65ff90201000201" +
+			"003011300f060a2b060106030f01010400410101",
+	})
+	// Followed by the authenticated GET.
+	udpStub.Expect("3081820201033010020406f4bd2a0202400004010502010304363034041180001f8880e9bd0c1d12667a510000000002" +
+		"0105020203e804086175746875736572040c22b95201a5c04e388620081e04003033041180001f8880e9bd0c1d12667a" +
+		"51000000000400a01c020478fc2ffa020100020100300e300c06082b060102010105000500").AndRespond([]string{
+		"30818a0201033011020406f4bd2a020300ffe304010102010304363034041180001f8880e9bd0c1d12667a5100000000" +
+			"020105020203e804086175746875736572040c989de575107c18161ddda7430400303a041180001f8880e9bd0c1d1266" +
+			"7a51000000000400a223020478fc2ffa0201000201003015301306082b060102010105000407726f7574657231",
+	})
+
+	usm := testAgentUSM()
+	usm.AuthoritativeEngineID = ""
+	usm.AuthoritativeEngineBoots = 0
+	usm.AuthoritativeEngineTime = 0
+	wsnmp := NewWapSNMPv3OnConn("magic_host", usm, 2*time.Second, 5, udpStub)
+	defer wsnmp.Close()
+	val, err := wsnmp.Get(oid)
+	if err != nil {
+		t.Fatalf("Get() returned error %v", err)
+	}
+	if val != "router1" {
+		t.Errorf("Get() => %v, want router1", val)
+	}
+	if usm.AuthoritativeEngineID != agent.AuthoritativeEngineID || usm.AuthoritativeEngineBoots != 5 {
+		t.Errorf("discovered engine %x boots %d, want %x boots 5", usm.AuthoritativeEngineID, usm.AuthoritativeEngineBoots, agent.AuthoritativeEngineID)
+	}
+}
+
+func TestV3NotInTimeWindow(t *testing.T) {
+	rand.Seed(0)
+
+	oid := MustParseOid("1.3.6.1.2.1.1.5.0")
+
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	// Expect a GET with a stale engine time, the agent will send its clock in
+	// an authenticated report.
+	udpStub.Expect("308181020103301002041f5b04120202400004010502010304353033041180001f8880e9bd0c1d12667a510000000002" +
+		"010502010a04086175746875736572040c28fd6fe51afea423c4be289704003033041180001f8880e9bd0c1d12667a51" +
+		"000000000400a01c020478fc2ffa020100020100300e300c06082b060102010105000500").AndRespond([]string{
+		"308186020103301102041f5b0412020300ffe304010102010304363034041180001f8880e9bd0c1d12667a5100000000" +
+			"020105020203e804086175746875736572040c11ea402b8b3de4ffd32c8b2804003036041180001f8880e9bd0c1d1266" +
+			"7a51000000000400a81f020478fc2ffa0201000201003011300f060a2b060106030f01010200410101",
+	})
+	// The GET is retried with the agent's clock.
+	udpStub.Expect("3081820201033010020453f65ff90202400004010502010304363034041180001f8880e9bd0c1d12667a510000000002" +
+		"0105020203e804086175746875736572040c8df15a618400dd24c43c00df04003033041180001f8880e9bd0c1d12667a" +
+		"51000000000400a01c020478fc2ffa020100020100300e300c06082b060102010105000500").AndRespond([]string{
+		"30818a0201033011020453f65ff9020300ffe304010102010304363034041180001f8880e9bd0c1d12667a5100000000" +
+			"020105020203e804086175746875736572040ce2a13732f978331fa356c9a00400303a041180001f8880e9bd0c1d1266" +
+			"7a51000000000400a223020478fc2ffa0201000201003015301306082b060102010105000407726f7574657231",
+	})
+
+	usm := testAgentUSM()
+	usm.AuthoritativeEngineTime = 10
+	wsnmp := NewWapSNMPv3OnConn("magic_host", usm, 2*time.Second, 5, udpStub)
+	defer wsnmp.Close()
+	val, err := wsnmp.Get(oid)
+	if err != nil {
+		t.Fatalf("Get() returned error %v", err)
+	}
+	if val != "router1" {
+		t.Errorf("Get() => %v, want router1", val)
+	}
+	if usm.AuthoritativeEngineTime != 1000 {
+		t.Errorf("engine time after resync is %d, want 1000", usm.AuthoritativeEngineTime)
+	}
+}
+
+func TestV3ReportError(t *testing.T) {
+	rand.Seed(0)
+
+	udpStub := NewUdpStub(t)
+	udpStub.Expect("308182020103301002041f5b04120202400004010502010304363034041180001f8880e9bd0c1d12667a510000000002" +
+		"0105020203e804086175746875736572040ce91942ca615a7fca444fdb1a04003033041180001f8880e9bd0c1d12667a" +
+		"51000000000400a01c020478fc2ffa020100020100300e300c06082b060102010105000500").AndRespond([]string{
+		"307a020103301102041f5b0412020300ffe3040100020103042a3028041180001f8880e9bd0c1d12667a510000000002" +
+			"0105020203e804086175746875736572040004003036041180001f8880e9bd0c1d12667a51000000000400a81f020478" +
+			"fc2ffa0201000201003011300f060a2b060106030f01010500410107",
+	})
+
+	usm := testAgentUSM()
+	usm.AuthPassword = "wrongpassword"
+	wsnmp := NewWapSNMPv3OnConn("magic_host", usm, 2*time.Second, 5, udpStub)
+	_, err := wsnmp.Get(MustParseOid("1.3.6.1.2.1.1.5.0"))
+	if !errors.Is(err, ErrWrongDigest) {
+		t.Fatalf("Get() returned error %v, want %v", err, ErrWrongDigest)
+	}
+	var reportErr *ReportError
+	if !errors.As(err, &reportErr) || reportErr.Value != Counter(7) {
+		t.Errorf("Get() returned error %#v, want a ReportError with value 7", err)
+	}
+}
+
+func TestV3ResponseNotInTimeWindow(t *testing.T) {
+	rand.Seed(0)
+
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	// Expect a GET at engine time 1200. The responses from an earlier boot
+	// and from more than 150 seconds before are dropped, e.g. as replays.
+	udpStub.Expect("308182020103301002041f5b04120202400004010502010304363034041180001f8880e9bd0c1d12667a510000000002" +
+		"0105020204b004086175746875736572040cb8a58ef251a8168666f5682304003033041180001f8880e9bd0c1d12667a" +
+		"51000000000400a01c020478fc2ffa020100020100300e300c06082b060102010105000500").AndRespond([]string{
+		"308186020103301102041f5b0412020300ffe304010102010304363034041180001f8880e9bd0c1d12667a5100000000" +
+			"0201040202138804086175746875736572040cfa8b18ebce6a40ffa6655e2e04003036041180001f8880e9bd0c1d1266" +
+			"7a51000000000400a21f020478fc2ffa0201000201003011300f06082b0601020101050004036f6c64",
+		"308186020103301102041f5b0412020300ffe304010102010304363034041180001f8880e9bd0c1d12667a5100000000" +
+			"020105020203e804086175746875736572040c3608150349fd8e99a5f525e204003036041180001f8880e9bd0c1d1266" +
+			"7a51000000000400a21f020478fc2ffa0201000201003011300f06082b0601020101050004036f6c64",
+		"30818a020103301102041f5b0412020300ffe304010102010304363034041180001f8880e9bd0c1d12667a5100000000" +
+			"0201050202044c04086175746875736572040c5b7dcb397538ca05e1f168750400303a041180001f8880e9bd0c1d1266" +
+			"7a51000000000400a223020478fc2ffa0201000201003015301306082b060102010105000407726f7574657231",
+	})
+
+	usm := testAgentUSM()
+	usm.AuthoritativeEngineTime = 1200
+	wsnmp := NewWapSNMPv3OnConn("magic_host", usm, 2*time.Second, 5, udpStub)
+	defer wsnmp.Close()
+	val, err := wsnmp.Get(MustParseOid("1.3.6.1.2.1.1.5.0"))
+	if err != nil || val != "router1" {
+		t.Errorf("Get() => %v, %v, want router1", val, err)
+	}
+	if usm.AuthoritativeEngineBoots != 5 || usm.AuthoritativeEngineTime != 1200 {
+		t.Errorf("engine at boots %d time %d after stale responses, want boots 5 time 1200",
+			usm.AuthoritativeEngineBoots, usm.AuthoritativeEngineTime)
+	}
+}
+
+func TestV3Rediscover(t *testing.T) {
+	rand.Seed(0)
+
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	// Expect a GET to the known engine. The agent changed its engine ID, and
+	// answers with an unauthenticated usmStatsUnknownEngineIDs report.
+	udpStub.Expect("308182020103301002041f5b04120202400004010502010304363034041180001f8880e9bd0c1d12667a51000000" +
+		"00020105020203e804086175746875736572040c82f10567c779303583643a6604003033041180001f8880e9bd0c1d12667a" +
+		"51000000000400a01c020478fc2ffa020100020100300e300c06082b060102010105000500").AndRespond([]string{
+		"3071020103301102041f5b0412020300ffe30401000201030421301f041180001f88807c2b4d9a15e3f0620000000002" +
+			"010102010a0400040004003036041180001f88807c2b4d9a15e3f062000000000400a81f020478fc2ffa020100020100" +
+			"3011300f060a2b060106030f01010400410101",
+	})
+	// Followed by a discovery of the new engine.
+	udpStub.Expect("303d0201033010020453f65ff9020240000401040201030410300e0400020100020100040004000400301404000400a0" +
+		"0e020406f4bd2a0201000201003000").AndRespond([]string{
+		"30710201033011020453f65ff9020300ffe30401000201030421301f041180001f88807c2b4d9a15e3f0620000000002" +
+			"010102010a0400040004003036041180001f88807c2b4d9a15e3f062000000000400a81f020406f4bd2a020100020100" +
+			"3011300f060a2b060106030f01010400410101",
+	})
+	// And the GET to the new engine, whose authenticated response makes it
+	// the known one.
+	udpStub.Expect("308181020103301002042f0d18fb0202400004010502010304353033041180001f88807c2b4d9a15e3f0620000000002" +
+		"010102010a04086175746875736572040c34ce79e42554776ee029a7e904003033041180001f88807c2b4d9a15e3f062" +
+		"000000000400a01c020478fc2ffa020100020100300e300c06082b060102010105000500").AndRespond([]string{
+		"308189020103301102042f0d18fb020300ffe304010102010304353033041180001f88807c2b4d9a15e3f06200000000" +
+			"02010102010a04086175746875736572040c703af90ba01414333a352d650400303a041180001f88807c2b4d9a15e3f0" +
+			"62000000000400a223020478fc2ffa0201000201003015301306082b060102010105000407726f7574657231",
+	})
+
+	usm := testAgentUSM()
+	wsnmp := NewWapSNMPv3OnConn("magic_host", usm, 2*time.Second, 5, udpStub)
+	defer wsnmp.Close()
+	val, err := wsnmp.Get(MustParseOid("1.3.6.1.2.1.1.5.0"))
+	if err != nil || val != "router1" {
+		t.Errorf("Get() => %v, %v, want router1", val, err)
+	}
+	if want := "80001f88807c2b4d9a15e3f06200000000"; hex.EncodeToString([]byte(usm.AuthoritativeEngineID)) != want ||
+		usm.AuthoritativeEngineBoots != 1 || usm.AuthoritativeEngineTime != 10 {
+		t.Errorf("engine %x boots %d time %d after rediscovery, want %s boots 1 time 10",
+			usm.AuthoritativeEngineID, usm.AuthoritativeEngineBoots, usm.AuthoritativeEngineTime, want)
+	}
+}
+
+func TestV3RediscoverForged(t *testing.T) {
+	rand.Seed(0)
+
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	// Expect a GET to the known engine. Someone else answers with a
+	// usmStatsUnknownEngineIDs report, and the discovery with another
+	// engine ID, but can't answer the GET to that engine.
+	udpStub.Expect("308182020103301002041f5b04120202400004010502010304363034041180001f8880e9bd0c1d12667a51000000" +
+		"00020105020203e804086175746875736572040c82f10567c779303583643a6604003033041180001f8880e9bd0c1d12667a" +
+		"51000000000400a01c020478fc2ffa020100020100300e300c06082b060102010105000500").AndRespond([]string{
+		"3071020103301102041f5b0412020300ffe30401000201030421301f041180001f88807c2b4d9a15e3f0620000000002" +
+			"010102010a0400040004003036041180001f88807c2b4d9a15e3f062000000000400a81f020478fc2ffa020100020100" +
+			"3011300f060a2b060106030f01010400410101",
+	})
+	udpStub.Expect("303d0201033010020453f65ff9020240000401040201030410300e0400020100020100040004000400301404000400a0" +
+		"0e020406f4bd2a0201000201003000").AndRespond([]string{
+		"30710201033011020453f65ff9020300ffe30401000201030421301f041180001f88807c2b4d9a15e3f0620000000002" +
+			"010102010a0400040004003036041180001f88807c2b4d9a15e3f062000000000400a81f020406f4bd2a020100020100" +
+			"3011300f060a2b060106030f01010400410101",
+	})
+	udpStub.Expect("308181020103301002042f0d18fb0202400004010502010304353033041180001f88807c2b4d9a15e3f0620000000002" +
+		"010102010a04086175746875736572040c34ce79e42554776ee029a7e904003033041180001f88807c2b4d9a15e3f062" +
+		"000000000400a01c020478fc2ffa020100020100300e300c06082b060102010105000500").AndRespond([]string{
+		"3071020103301102042f0d18fb020300ffe30401000201030421301f041180001f88807c2b4d9a15e3f0620000000002" +
+			"010102010a0400040004003036041180001f88807c2b4d9a15e3f062000000000400a81f020478fc2ffa020100020100" +
+			"3011300f060a2b060106030f01010400410101",
+	})
+
+	usm := testAgentUSM()
+	engineID := usm.AuthoritativeEngineID
+	wsnmp := NewWapSNMPv3OnConn("magic_host", usm, 2*time.Second, 5, udpStub)
+	defer wsnmp.Close()
+	if _, err := wsnmp.Get(MustParseOid("1.3.6.1.2.1.1.5.0")); !errors.Is(err, ErrUnknownEngineID) {
+		t.Errorf("Get() returned error %v, want %v", err, ErrUnknownEngineID)
+	}
+	if usm.AuthoritativeEngineID != engineID || usm.AuthoritativeEngineBoots != 5 {
+		t.Errorf("engine %x boots %d after the forged reports, want %x boots 5",
+			usm.AuthoritativeEngineID, usm.AuthoritativeEngineBoots, engineID)
+	}
+}
@@ -0,0 +1,179 @@
+package wapsnmp
+
+/* This file implements an engine that talks to many agents from a single
+   unconnected UDP socket.
+
+   References : RFC 3417 section 3 (SNMP over UDP).
+*/
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Engine sends the requests of many sessions from a single UDP socket, and
+// routes the responses to them by source address and request ID. Use it
+// instead of NewWapSNMP when polling so many devices that a socket for each
+// would exhaust the file descriptors.
+//
+// Agents have to answer from the address the requests were sent to, as
+// RFC 3417 requires. Responses from other addresses are dropped.
+type Engine struct {
+	conn net.PacketConn
+
+	mu          sync.Mutex
+	sessions    map[string]*requestMux  // By target address.
+	repetitions map[string]*repetitions // By target address, outlive the sessions.
+	closed      bool
+}
+
+// NewEngine creates an Engine on a UDP socket bound to address, e.g. ":0".
+func NewEngine(address string) (*Engine, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on %v: %v", address, err)
+	}
+	return NewEngineOnConn(conn), nil
+}
+
+// NewEngineOnConn creates an Engine on an existing unconnected socket.
+func NewEngineOnConn(conn net.PacketConn) *Engine {
+	e := &Engine{conn: conn, sessions: make(map[string]*requestMux), repetitions: make(map[string]*repetitions)}
+	go e.read()
+	return e
+}
+
+// Addr returns the local address of the engine's socket.
+func (e *Engine) Addr() net.Addr {
+	return e.conn.LocalAddr()
+}
+
+// Session returns a WapSNMP that sends its requests through the engine. The
+// target is a host, which is contacted on port 161, or a host:port. There can
+// be one session per target address, closing it makes room for a new one. A
+// new session starts with the max-repetitions GetTable learned in the previous
+// ones.
+func (e *Engine) Session(target, community string, version SNMPVersion, timeout time.Duration, retries int) (*WapSNMP, error) {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "161")
+	}
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &engineConn{engine: e, addr: addr}
+	mux := newRequestMux(conn)
+	mux.delivered = true
+	conn.mux = mux
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil, net.ErrClosed
+	}
+	if _, ok := e.sessions[addr.String()]; ok {
+		return nil, fmt.Errorf("engine already has a session with %v", addr)
+	}
+	e.sessions[addr.String()] = mux
+	reps, ok := e.repetitions[addr.String()]
+	if !ok {
+		reps = newRepetitions(defaultMaxRepetitions)
+		e.repetitions[addr.String()] = reps
+	}
+	return &WapSNMP{Target: target, Community: community, Version: version, timeout: timeout, retries: retries,
+		conn: conn, mux: mux, reps: reps}, nil
+}
+
+// SessionV3 returns a WapSNMP that talks SNMPv3 through the engine, using the
+// User-based Security Model settings in usm.
+func (e *Engine) SessionV3(target string, usm *USM, timeout time.Duration, retries int) (*WapSNMP, error) {
+	w, err := e.Session(target, "", SNMPv3, timeout, retries)
+	if err != nil {
+		return nil, err
+	}
+	w.usm = usm
+	return w, nil
+}
+
+// read routes the datagrams received on the socket until it is closed.
+func (e *Engine) read() {
+	buf := make([]byte, bufSize)
+	for {
+		n, addr, err := e.conn.ReadFrom(buf)
+		if err != nil && transientReadError(err) {
+			continue
+		}
+		if err != nil {
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			e.closed = true
+			for _, mux := range e.sessions {
+				mux.stop(err)
+			}
+			return
+		}
+		e.mu.Lock()
+		mux := e.sessions[addr.String()]
+		e.mu.Unlock()
+		if mux != nil {
+			mux.deliver(buf[:n])
+		}
+	}
+}
+
+// closeSession removes a session, and fails its requests in progress.
+func (e *Engine) closeSession(addr *net.UDPAddr, mux *requestMux) {
+	e.mu.Lock()
+	if e.sessions[addr.String()] == mux {
+		delete(e.sessions, addr.String())
+	}
+	e.mu.Unlock()
+	mux.stop(net.ErrClosed)
+}
+
+// Close closes the engine's socket. The requests of all sessions fail.
+func (e *Engine) Close() error {
+	return e.conn.Close()
+}
+
+// engineConn is the net.Conn of an Engine session. Writes go to the target
+// through the engine's socket, responses are delivered by Engine.read.
+type engineConn struct {
+	engine *Engine
+	addr   *net.UDPAddr
+	mux    *requestMux
+}
+
+func (c *engineConn) Read(b []byte) (int, error) {
+	return 0, errors.New("engine sessions don't read from their connection")
+}
+
+func (c *engineConn) Write(b []byte) (int, error) {
+	return c.engine.conn.WriteTo(b, c.addr)
+}
+
+func (c *engineConn) Close() error {
+	c.engine.closeSession(c.addr, c.mux)
+	return nil
+}
+
+func (c *engineConn) LocalAddr() net.Addr {
+	return c.engine.conn.LocalAddr()
+}
+
+func (c *engineConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// The engine's socket is shared, so the deadlines of one session can't be
+// set on it. Requests time out on their own.
+func (c *engineConn) SetDeadline(t time.Time) error      { return nil }
+func (c *engineConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *engineConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,125 @@
+package wapsnmp
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startNamedTestAgents starts test agents on loopback, each with its own
+// sysName.0.
+func startNamedTestAgents(t *testing.T, count int) []*Agent {
+	var agents []*Agent
+	for i := 0; i < count; i++ {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("error creating socket: %v", err)
+		}
+		a := newTestAgent()
+		name := fmt.Sprintf("agent%d", i)
+		a.RegisterScalar(MustParseOid(".1.3.6.1.2.1.1.5"), func() interface{} { return name }, nil)
+		a.conn = conn
+		go a.Serve()
+		agents = append(agents, a)
+	}
+	return agents
+}
+
+func TestEngine(t *testing.T) {
+	agents := startNamedTestAgents(t, 5)
+	for _, a := range agents {
+		defer a.Close()
+	}
+	e, err := NewEngine("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewEngine() returned error %v", err)
+	}
+	defer e.Close()
+
+	var sessions []*WapSNMP
+	for _, a := range agents {
+		s, err := e.Session(a.Addr().String(), "public", SNMPv2c, time.Second, 2)
+		if err != nil {
+			t.Fatalf("Session() returned error %v", err)
+		}
+		sessions = append(sessions, s)
+	}
+
+	var wg sync.WaitGroup
+	for i, s := range sessions {
+		for j := 0; j < 10; j++ {
+			wg.Add(1)
+			go func(i int, s *WapSNMP) {
+				defer wg.Done()
+				want := fmt.Sprintf("agent%d", i)
+				if value, err := s.Get(MustParseOid(".1.3.6.1.2.1.1.5.0")); err != nil || value != want {
+					t.Errorf("Get(sysName.0) from agent %d => %v, %v, want %v", i, value, err, want)
+				}
+			}(i, s)
+		}
+	}
+	wg.Wait()
+
+	table, err := sessions[0].GetTable(MustParseOid(".1.3.6.1.2.1.2.2.1.2"))
+	if err != nil || len(table) != 2 {
+		t.Errorf("GetTable() => %v, %v, want 2 entries", table, err)
+	}
+
+	// Only one session per target, until it is closed.
+	if _, err := e.Session(agents[0].Addr().String(), "public", SNMPv2c, time.Second, 2); err == nil {
+		t.Errorf("Session() with an existing target returned no error")
+	}
+	sessions[0].SetMaxRepetitions(7)
+	sessions[0].Close()
+	if _, err := sessions[0].Get(MustParseOid(".1.3.6.1.2.1.1.5.0")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Get() on a closed session returned %v, want %v", err, net.ErrClosed)
+	}
+	s, err := e.Session(agents[0].Addr().String(), "public", SNMPv2c, time.Second, 2)
+	if err != nil {
+		t.Errorf("Session() after closing the old one returned error %v", err)
+	} else if got := s.MaxRepetitions(); got != 7 {
+		t.Errorf("MaxRepetitions() of a new session => %d, want 7 from the old one", got)
+	}
+
+	e.Close()
+	if _, err := sessions[1].Get(MustParseOid(".1.3.6.1.2.1.1.5.0")); err == nil {
+		t.Errorf("Get() after closing the engine returned no error")
+	}
+}
+
+func TestEngineDropsOtherSources(t *testing.T) {
+	rand.Seed(0)
+
+	// A silent agent, and another socket sending its response.
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error creating socket: %v", err)
+	}
+	defer silent.Close()
+	other, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error creating socket: %v", err)
+	}
+	defer other.Close()
+
+	e, err := NewEngine("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewEngine() returned error %v", err)
+	}
+	defer e.Close()
+	s, err := e.Session(silent.LocalAddr().String(), "public", SNMPv2c, 200*time.Millisecond, 0)
+	if err != nil {
+		t.Fatalf("Session() returned error %v", err)
+	}
+
+	response, _ := (&Message{SNMPv2c, "public", &PDU{Type: AsnGetResponse, RequestID: 0x78fc2ffa,
+		VarBinds: []VarBind{{MustParseOid(".1.3.6.1.2.1.1.5.0"), "spoofed"}}}}).Marshal()
+	time.AfterFunc(20*time.Millisecond, func() { other.WriteTo(response, e.Addr()) })
+	if value, err := s.Get(MustParseOid(".1.3.6.1.2.1.1.5.0")); err == nil {
+		t.Errorf("Get(sysName.0) accepted a response from another address: %v", value)
+	}
+}
@@ -0,0 +1,144 @@
+package wapsnmp
+
+/* This file defines the error-status values of SNMP responses, and the
+   SNMPError returned when an agent answers with one. It also defines the
+   ExceptionError returned when an agent answers with an exception value.
+
+   References : RFC 1157 section 4.1.1, RFC 3416 section 3 and 4.2.1.
+*/
+
+import "fmt"
+
+// ErrorStatus is the error-status of a response PDU.
+type ErrorStatus int
+
+// The error-status values. SNMPv1 only uses NoError through GenErr.
+const (
+	NoError             ErrorStatus = 0
+	TooBig              ErrorStatus = 1
+	NoSuchName          ErrorStatus = 2
+	BadValue            ErrorStatus = 3
+	ReadOnly            ErrorStatus = 4
+	GenErr              ErrorStatus = 5
+	NoAccess            ErrorStatus = 6
+	WrongType           ErrorStatus = 7
+	WrongLength         ErrorStatus = 8
+	WrongEncoding       ErrorStatus = 9
+	WrongValue          ErrorStatus = 10
+	NoCreation          ErrorStatus = 11
+	InconsistentValue   ErrorStatus = 12
+	ResourceUnavailable ErrorStatus = 13
+	CommitFailed        ErrorStatus = 14
+	UndoFailed          ErrorStatus = 15
+	AuthorizationError  ErrorStatus = 16
+	NotWritable         ErrorStatus = 17
+	InconsistentName    ErrorStatus = 18
+)
+
+var errorStatusNames = []string{
+	"noError", "tooBig", "noSuchName", "badValue", "readOnly", "genErr", "noAccess", "wrongType",
+	"wrongLength", "wrongEncoding", "wrongValue", "noCreation", "inconsistentValue",
+	"resourceUnavailable", "commitFailed", "undoFailed", "authorizationError", "notWritable",
+	"inconsistentName",
+}
+
+// String returns the name of the error-status as used in the RFCs, e.g.
+// "noSuchName".
+func (e ErrorStatus) String() string {
+	if e >= 0 && int(e) < len(errorStatusNames) {
+		return errorStatusNames[e]
+	}
+	return fmt.Sprintf("errorStatus(%d)", int(e))
+}
+
+// Error makes ErrorStatus an error, so MIB handlers can return one.
+func (e ErrorStatus) Error() string {
+	return e.String()
+}
+
+// v1 maps an error-status to the closest one SNMPv1 has, as described in
+// RFC 3584 section 4.4.
+func (e ErrorStatus) v1() ErrorStatus {
+	switch e {
+	case WrongValue, WrongEncoding, WrongType, WrongLength, InconsistentValue:
+		return BadValue
+	case NoAccess, NotWritable, NoCreation, InconsistentName, AuthorizationError:
+		return NoSuchName
+	case ResourceUnavailable, CommitFailed, UndoFailed:
+		return GenErr
+	}
+	return e
+}
+
+// SNMPError is returned when an agent answers a request with a non-zero
+// error-status. It matches its ErrorStatus with errors.Is, e.g.
+// errors.Is(err, NoSuchName).
+type SNMPError struct {
+	Status ErrorStatus
+	Index  int // The error-index, starting at 1. 0 if no varbind caused it.
+	Oid    Oid // The oid of the varbind that caused it, nil if none.
+}
+
+// Name returns the name of the error-status, e.g. "noSuchName".
+func (e *SNMPError) Name() string {
+	return e.Status.String()
+}
+
+func (e *SNMPError) Error() string {
+	if e.Oid != nil {
+		return fmt.Sprintf("agent returned error %v for %v", e.Status, e.Oid)
+	}
+	return fmt.Sprintf("agent returned error %v", e.Status)
+}
+
+// Is makes errors.Is match an SNMPError with its ErrorStatus.
+func (e *SNMPError) Is(target error) bool {
+	status, ok := target.(ErrorStatus)
+	return ok && status == e.Status
+}
+
+// responseError returns an SNMPError if a response PDU has a non-zero
+// error-status.
+func responseError(pdu *PDU) error {
+	if pdu.ErrorStatus == NoError {
+		return nil
+	}
+	result := &SNMPError{Status: pdu.ErrorStatus, Index: pdu.ErrorIndex}
+	if pdu.ErrorIndex >= 1 && pdu.ErrorIndex <= len(pdu.VarBinds) {
+		result.Oid = pdu.VarBinds[pdu.ErrorIndex-1].Oid
+	}
+	return result
+}
+
+// IsException returns whether a varbind value is one of the exceptions an
+// agent returns instead of a value: NoSuchObject, NoSuchInstance or
+// EndOfMibView. Exceptions only concern their own varbind, the other varbinds
+// of the response have their values.
+func IsException(value interface{}) bool {
+	return value == NoSuchObject || value == NoSuchInstance || value == EndOfMibView
+}
+
+// exceptionName returns the name of an exception as used in the RFCs.
+func exceptionName(exception BERType) string {
+	switch exception {
+	case NoSuchObject:
+		return "noSuchObject"
+	case NoSuchInstance:
+		return "noSuchInstance"
+	case EndOfMibView:
+		return "endOfMibView"
+	}
+	return fmt.Sprintf("exception(%#x)", uint8(exception))
+}
+
+// ExceptionError is returned by Get when the agent answers with an exception
+// instead of a value. GetMultiple and GetBulk return exceptions as the values
+// of their varbinds instead, check them with IsException.
+type ExceptionError struct {
+	Oid       Oid
+	Exception BERType // NoSuchObject, NoSuchInstance or EndOfMibView.
+}
+
+func (e *ExceptionError) Error() string {
+	return fmt.Sprintf("agent returned %v for %v", exceptionName(e.Exception), e.Oid)
+}
@@ -0,0 +1,121 @@
+package wapsnmp
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestErrorStatusString(t *testing.T) {
+	tests := []struct {
+		status ErrorStatus
+		want   string
+	}{
+		{NoError, "noError"},
+		{NoSuchName, "noSuchName"},
+		{NotWritable, "notWritable"},
+		{InconsistentName, "inconsistentName"},
+		{ErrorStatus(42), "errorStatus(42)"},
+	}
+
+	for _, test := range tests {
+		if got := test.status.String(); got != test.want {
+			t.Errorf("ErrorStatus(%d).String() => %q, want %q", int(test.status), got, test.want)
+		}
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	pdu := &PDU{AsnGetResponse, 1, NoSuchName, 2, []VarBind{
+		{MustParseOid(".1.3.6.1.2.1.1.1.0"), nil},
+		{MustParseOid(".1.3.6.1.2.1.1.2.0"), nil}}}
+	err := responseError(pdu)
+
+	var snmpErr *SNMPError
+	if !errors.As(err, &snmpErr) {
+		t.Fatalf("responseError() => %v, want an SNMPError", err)
+	}
+	if snmpErr.Status != NoSuchName || snmpErr.Name() != "noSuchName" || snmpErr.Index != 2 ||
+		!snmpErr.Oid.Equal(MustParseOid(".1.3.6.1.2.1.1.2.0")) {
+		t.Errorf("got %+v, want noSuchName for the second varbind", snmpErr)
+	}
+	if !errors.Is(err, NoSuchName) || errors.Is(err, TooBig) {
+		t.Errorf("errors.Is(%v) doesn't match its status", err)
+	}
+
+	// An error-index out of range has no oid.
+	pdu.ErrorStatus, pdu.ErrorIndex = TooBig, 0
+	if err := responseError(pdu); !errors.As(err, &snmpErr) || snmpErr.Oid != nil || !errors.Is(err, TooBig) {
+		t.Errorf("responseError() => %v, want tooBig without oid", err)
+	}
+
+	pdu.ErrorStatus = NoError
+	if err := responseError(pdu); err != nil {
+		t.Errorf("responseError() without error-status => %v", err)
+	}
+}
+
+func TestClientSNMPErrors(t *testing.T) {
+	a, wsnmp := startTestAgent(t, "public", SNMPv1)
+	defer a.Close()
+	defer wsnmp.Close()
+
+	missing := MustParseOid(".1.3.6.1.2.1.1.2.0")
+	if _, err := wsnmp.Get(missing); !errors.Is(err, NoSuchName) {
+		t.Errorf("SNMPv1 Get() of a missing instance returned %v, want noSuchName", err)
+	}
+	_, err := wsnmp.GetMultiple([]Oid{MustParseOid(".1.3.6.1.2.1.1.1.0"), missing})
+	var snmpErr *SNMPError
+	if !errors.As(err, &snmpErr) || snmpErr.Index != 2 || !snmpErr.Oid.Equal(missing) {
+		t.Errorf("SNMPv1 GetMultiple() returned %v, want noSuchName for %v", err, missing)
+	}
+
+	a2, wsnmp2 := startTestAgent(t, "private", SNMPv2c)
+	defer a2.Close()
+	defer wsnmp2.Close()
+	if _, err := wsnmp2.Set(MustParseOid(".1.3.6.1.2.1.1.1.0"), "x"); !errors.Is(err, NotWritable) {
+		t.Errorf("Set() of a read-only object returned %v, want notWritable", err)
+	}
+	if _, err := wsnmp2.SetMultiple(map[string]interface{}{".1.3.6.1.2.1.1.4.0": 1}); !errors.Is(err, WrongType) {
+		t.Errorf("SetMultiple() with the wrong type returned %v, want wrongType", err)
+	}
+	result, err := wsnmp2.SetMultiple(map[string]interface{}{".1.3.6.1.2.1.1.4.0": "admin"})
+	if err != nil || result[".1.3.6.1.2.1.1.4.0"] != "admin" {
+		t.Errorf("SetMultiple() => %v, %v, want sysContact.0 set to admin", result, err)
+	}
+}
+
+func TestGetExceptions(t *testing.T) {
+	a, wsnmp := startTestAgent(t, "public", SNMPv2c)
+	defer a.Close()
+	defer wsnmp.Close()
+	sysDescr := MustParseOid(".1.3.6.1.2.1.1.1.0")
+	missingInstance := MustParseOid(".1.3.6.1.2.1.1.1.1")
+	missingObject := MustParseOid(".1.3.6.1.2.1.2.2.1.3.1")
+
+	// One missing oid doesn't fail the others.
+	got, err := wsnmp.GetMultiple([]Oid{sysDescr, missingInstance, missingObject})
+	want := map[string]interface{}{
+		sysDescr.String():        "test agent",
+		missingInstance.String(): NoSuchInstance,
+		missingObject.String():   NoSuchObject,
+	}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("GetMultiple() => %v, %v, want %v", got, err, want)
+	}
+
+	var exception *ExceptionError
+	if _, err := wsnmp.Get(missingInstance); !errors.As(err, &exception) || exception.Exception != NoSuchInstance ||
+		!exception.Oid.Equal(missingInstance) {
+		t.Errorf("Get(%v) returned %v, want an ExceptionError with noSuchInstance", missingInstance, err)
+	}
+
+	bulk, err := wsnmp.GetBulkArray(MustParseOid(".1.3.6.1.2.1.2.2.1.2.1"), 3)
+	wantBulk := []SNMPValue{
+		{MustParseOid(".1.3.6.1.2.1.2.2.1.2.2"), "eth0"},
+		{MustParseOid(".1.3.6.1.2.1.2.2.1.2.2"), EndOfMibView},
+	}
+	if err != nil || !reflect.DeepEqual(bulk, wantBulk) {
+		t.Errorf("GetBulkArray() past the end of the MIB => %v, %v, want %v", bulk, err, wantBulk)
+	}
+}
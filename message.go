@@ -0,0 +1,223 @@
+package wapsnmp
+
+/* This file implements typed SNMPv1 and SNMPv2c messages and PDUs, on top of
+   EncodeSequence, and DecodeSequence or a Decoder.
+
+   References : RFC 1157 section 4, RFC 3416 section 3 (PDU definitions).
+*/
+
+import (
+	"errors"
+	"fmt"
+)
+
+// VarBind is a variable binding, an oid and its value.
+type VarBind = SNMPValue
+
+// MessagePDU is a PDU that can be sent in a Message: *PDU, *BulkPDU or
+// *TrapV1.
+type MessagePDU interface {
+	// Sequence returns the PDU in the form EncodeSequence takes.
+	Sequence() []interface{}
+}
+
+// PDU is any PDU except GetBulkRequest and the SNMPv1 Trap: a Get, GetNext,
+// Set, Response, SNMPv2-Trap, Inform or Report.
+type PDU struct {
+	Type        BERType
+	RequestID   int
+	ErrorStatus ErrorStatus
+	ErrorIndex  int
+	VarBinds    []VarBind
+}
+
+// BulkPDU is a GetBulkRequest PDU.
+type BulkPDU struct {
+	RequestID      int
+	NonRepeaters   int
+	MaxRepetitions int
+	VarBinds       []VarBind
+}
+
+// Message is an SNMPv1 or SNMPv2c message.
+type Message struct {
+	Version   SNMPVersion
+	Community string
+	PDU       MessagePDU
+}
+
+// Marshal encodes the varbind.
+func (v *VarBind) Marshal() ([]byte, error) {
+	return EncodeSequence([]interface{}{Sequence, v.Oid, v.Value})
+}
+
+// Unmarshal decodes a varbind.
+func (v *VarBind) Unmarshal(b []byte) error {
+	decoded, err := DecodeSequence(b)
+	if err != nil {
+		return err
+	}
+	varbinds, err := decodeVarbinds([]interface{}{Sequence, decoded})
+	if err != nil {
+		return err
+	}
+	*v = varbinds[0]
+	return nil
+}
+
+// Sequence returns the PDU in the form EncodeSequence takes.
+func (p *PDU) Sequence() []interface{} {
+	return []interface{}{p.Type, p.RequestID, int(p.ErrorStatus), p.ErrorIndex, encodeVarbinds(p.VarBinds)}
+}
+
+// Marshal encodes the PDU.
+func (p *PDU) Marshal() ([]byte, error) {
+	return EncodeSequence(p.Sequence())
+}
+
+// Unmarshal decodes a PDU.
+func (p *PDU) Unmarshal(b []byte) error {
+	d := NewDecoder(b)
+	if err := d.next("PDU"); err != nil {
+		return err
+	}
+	result, err := readPDU(d)
+	if err != nil {
+		return err
+	}
+	*p = *result
+	return nil
+}
+
+// decodePDU converts a PDU as returned by DecodeSequence into a PDU.
+func decodePDU(pdu []interface{}) (*PDU, error) {
+	if len(pdu) != 5 {
+		return nil, fmt.Errorf("PDU has %d elements, want 4", len(pdu)-1)
+	}
+	pduType, ok := pdu[0].(BERType)
+	if !ok || pduType == AsnGetBulkRequest || pduType == AsnTrap {
+		return nil, fmt.Errorf("unexpected PDU type %v", pdu[0])
+	}
+	requestID, ok1 := pdu[1].(int64)
+	errorStatus, ok2 := pdu[2].(int64)
+	errorIndex, ok3 := pdu[3].(int64)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, fmt.Errorf("malformed request ID %v, error-status %v or error-index %v", pdu[1], pdu[2], pdu[3])
+	}
+	varbinds, err := decodeVarbinds(pdu[4])
+	if err != nil {
+		return nil, err
+	}
+	return &PDU{pduType, int(requestID), ErrorStatus(errorStatus), int(errorIndex), varbinds}, nil
+}
+
+// Sequence returns the PDU in the form EncodeSequence takes.
+func (p *BulkPDU) Sequence() []interface{} {
+	return []interface{}{AsnGetBulkRequest, p.RequestID, p.NonRepeaters, p.MaxRepetitions, encodeVarbinds(p.VarBinds)}
+}
+
+// Marshal encodes the PDU.
+func (p *BulkPDU) Marshal() ([]byte, error) {
+	return EncodeSequence(p.Sequence())
+}
+
+// Unmarshal decodes a GetBulkRequest PDU.
+func (p *BulkPDU) Unmarshal(b []byte) error {
+	decoded, err := DecodeSequence(b)
+	if err != nil {
+		return err
+	}
+	result, err := decodeBulkPDU(decoded)
+	if err != nil {
+		return err
+	}
+	*p = *result
+	return nil
+}
+
+// decodeBulkPDU converts a PDU as returned by DecodeSequence into a BulkPDU.
+func decodeBulkPDU(pdu []interface{}) (*BulkPDU, error) {
+	if len(pdu) != 5 || pdu[0] != AsnGetBulkRequest {
+		return nil, fmt.Errorf("not a GetBulkRequest PDU: %v", pdu)
+	}
+	requestID, ok1 := pdu[1].(int64)
+	nonRepeaters, ok2 := pdu[2].(int64)
+	maxRepetitions, ok3 := pdu[3].(int64)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, fmt.Errorf("malformed request ID %v, non-repeaters %v or max-repetitions %v", pdu[1], pdu[2], pdu[3])
+	}
+	varbinds, err := decodeVarbinds(pdu[4])
+	if err != nil {
+		return nil, err
+	}
+	return &BulkPDU{int(requestID), int(nonRepeaters), int(maxRepetitions), varbinds}, nil
+}
+
+// Marshal encodes the message.
+func (m *Message) Marshal() ([]byte, error) {
+	return m.AppendMarshal(nil)
+}
+
+// AppendMarshal encodes the message, and appends it to dst.
+func (m *Message) AppendMarshal(dst []byte) ([]byte, error) {
+	if m.PDU == nil {
+		return nil, errors.New("message has no PDU")
+	}
+	return AppendSequence(dst, []interface{}{Sequence, int(m.Version), m.Community, m.PDU.Sequence()})
+}
+
+// Unmarshal decodes an SNMPv1 or SNMPv2c message. The PDU is a *BulkPDU for
+// GetBulkRequests, a *TrapV1 for SNMPv1 traps and a *PDU otherwise.
+func (m *Message) Unmarshal(b []byte) error {
+	d := NewDecoder(b)
+	if err := d.next("message"); err != nil {
+		return err
+	}
+	if err := d.Enter(); err != nil {
+		return fmt.Errorf("malformed message: %v", err)
+	}
+	version, err := d.nextInt("version")
+	if err != nil {
+		return err
+	}
+	if version != int64(SNMPv1) && version != int64(SNMPv2c) {
+		return fmt.Errorf("unsupported SNMP version %d", version)
+	}
+	if err := d.next("community"); err != nil {
+		return err
+	}
+	if d.Tag() != AsnOctetStr {
+		return fmt.Errorf("malformed community %x", d.Raw())
+	}
+	community := string(d.Bytes())
+	if err := d.next("PDU"); err != nil {
+		return err
+	}
+
+	var result MessagePDU
+	switch d.Tag() {
+	case AsnGetBulkRequest, AsnTrap:
+		// Rare enough to decode the simple way.
+		pdu, err := DecodeSequence(d.Raw())
+		if err != nil {
+			return err
+		}
+		if d.Tag() == AsnGetBulkRequest {
+			result, err = decodeBulkPDU(pdu)
+		} else {
+			result, err = DecodeTrapV1(pdu)
+		}
+		if err != nil {
+			return err
+		}
+	default:
+		if result, err = readPDU(d); err != nil {
+			return err
+		}
+	}
+	if err := d.leave("message"); err != nil {
+		return err
+	}
+	*m = Message{SNMPVersion(version), community, result}
+	return nil
+}
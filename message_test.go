@@ -0,0 +1,146 @@
+package wapsnmp
+
+import (
+	"encoding/hex"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMessageMarshal(t *testing.T) {
+	// The GetRequest for sysDescr.0 from TestGet.
+	msg := &Message{SNMPv2c, "public", &PDU{Type: AsnGetRequest, RequestID: 0x78fc2ffa,
+		VarBinds: []VarBind{{MustParseOid(".1.3.6.1.2.1.1.1.0"), nil}}}}
+	want := "302902010104067075626c6963a01c020478fc2ffa020100020100300e300c06082b060102010101000500"
+	got, err := msg.Marshal()
+	if err != nil || hex.EncodeToString(got) != want {
+		t.Errorf("Marshal() => %x, %v, want %v", got, err, want)
+	}
+
+	var decoded Message
+	if err := decoded.Unmarshal(got); err != nil {
+		t.Fatalf("Unmarshal() returned error %v", err)
+	}
+	if !reflect.DeepEqual(&decoded, msg) {
+		t.Errorf("Unmarshal() => %+v, want %+v", decoded, msg)
+	}
+
+	// Version 256 is not SNMPv1, though it is in a byte.
+	wrapped, _ := hex.DecodeString("302a0202010004067075626c6963a01c020478fc2ffa020100020100300e300c06082b060102010101000500")
+	if err := decoded.Unmarshal(wrapped); err == nil {
+		t.Errorf("Unmarshal() of a version 256 message returned no error")
+	}
+
+	if _, err := (&Message{Version: SNMPv2c}).Marshal(); err == nil {
+		t.Errorf("Marshal() of a message without PDU returned no error")
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	oid := MustParseOid(".1.3.6.1.2.1.2.2.1.2")
+	tests := []MessagePDU{
+		&PDU{AsnGetResponse, 12345, NoSuchName, 1, []VarBind{
+			{oid, "eth0"}, {MustParseOid(".1.3.6.1.2.1.1.3.0"), 42 * time.Second}}},
+		&PDU{AsnSetRequest, 1, NoError, 0, []VarBind{{oid, int64(-7)}}},
+		&PDU{AsnReport, 2, NoError, 0, []VarBind{}},
+		&BulkPDU{3, 1, 25, []VarBind{{sysUpTimeOid, nil}, {oid, nil}}},
+		&TrapV1{MustParseOid(".1.3.6.1.4.1.8072"), net.IPv4(192, 0, 2, 1), 6, 1, time.Second, []VarBind{{oid, "x"}}},
+	}
+
+	for _, pdu := range tests {
+		encoded, err := (&Message{SNMPv1, "private", pdu}).Marshal()
+		if err != nil {
+			t.Errorf("Marshal() of %+v returned error %v", pdu, err)
+			continue
+		}
+		var msg Message
+		if err := msg.Unmarshal(encoded); err != nil {
+			t.Errorf("Unmarshal() of %+v returned error %v", pdu, err)
+			continue
+		}
+		if msg.Version != SNMPv1 || msg.Community != "private" || !reflect.DeepEqual(msg.PDU, pdu) {
+			t.Errorf("round trip of %+v => %+v", pdu, msg)
+		}
+	}
+}
+
+func TestPDUUnmarshal(t *testing.T) {
+	bulk := &BulkPDU{RequestID: 7, NonRepeaters: 1, MaxRepetitions: 10,
+		VarBinds: []VarBind{{sysUpTimeOid, nil}, {MustParseOid(".1.3.6.1.2.1.2.2.1.2"), nil}}}
+	encoded, err := bulk.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() returned error %v", err)
+	}
+	var gotBulk BulkPDU
+	if err := gotBulk.Unmarshal(encoded); err != nil || !reflect.DeepEqual(&gotBulk, bulk) {
+		t.Errorf("BulkPDU.Unmarshal() => %+v, %v, want %+v", gotBulk, err, bulk)
+	}
+	// A GetBulkRequest is not a PDU, and the other way around.
+	var pdu PDU
+	if err := pdu.Unmarshal(encoded); err == nil {
+		t.Errorf("PDU.Unmarshal() of a GetBulkRequest returned no error")
+	}
+	encoded, _ = (&PDU{Type: AsnGetRequest, RequestID: 1}).Marshal()
+	if err := gotBulk.Unmarshal(encoded); err == nil {
+		t.Errorf("BulkPDU.Unmarshal() of a GetRequest returned no error")
+	}
+
+	// Malformed PDUs.
+	for _, malformed := range []string{
+		"a000",                       // No fields.
+		"a0090201010201000201",       // Truncated.
+		"a00b0201010201000201000400", // Varbind list is not a sequence.
+	} {
+		raw, _ := hex.DecodeString(malformed)
+		if err := pdu.Unmarshal(raw); err == nil {
+			t.Errorf("PDU.Unmarshal(%v) returned no error", malformed)
+		}
+	}
+}
+
+func TestVarBindMarshal(t *testing.T) {
+	v := VarBind{MustParseOid(".1.3.6.1.2.1.1.1.0"), "test"}
+	encoded, err := v.Marshal()
+	want := "301006082b06010201010100040474657374"
+	if err != nil || hex.EncodeToString(encoded) != want {
+		t.Errorf("Marshal() => %x, %v, want %v", encoded, err, want)
+	}
+	var got VarBind
+	if err := got.Unmarshal(encoded); err != nil || !reflect.DeepEqual(got, v) {
+		t.Errorf("Unmarshal() => %v, %v, want %v", got, err, v)
+	}
+	if err := got.Unmarshal([]byte{0x30, 0x03, 0x02, 0x01, 0x01}); err == nil {
+		t.Errorf("Unmarshal() of a varbind without oid returned no error")
+	}
+}
+
+func FuzzMessageUnmarshal(f *testing.F) {
+	for _, m := range []*Message{
+		{SNMPv2c, "public", &PDU{Type: AsnGetResponse, RequestID: 1,
+			VarBinds: []VarBind{{MustParseOid(".1.3.6.1.2.1.1.5.0"), "name"}}}},
+		{SNMPv2c, "public", &BulkPDU{RequestID: 2, MaxRepetitions: 10,
+			VarBinds: []VarBind{{MustParseOid(".1.3.6.1.2.1.2.2.1"), nil}}}},
+	} {
+		packet, _ := m.Marshal()
+		f.Add(packet)
+	}
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		var m Message
+		m.Unmarshal(packet)
+	})
+}
+
+func BenchmarkMessageUnmarshal(b *testing.B) {
+	packet, err := EncodeSequence(benchmarkResponse())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var msg Message
+		if err := msg.Unmarshal(packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
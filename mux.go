@@ -0,0 +1,313 @@
+package wapsnmp
+
+/* This file implements the demultiplexing of responses, so concurrent
+   requests can share one connection.
+
+   References : RFC 3416 section 4.1 (request-id), RFC 3412 section 6.2
+                (msgID).
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// packetPool holds the buffers datagrams are received and requests encoded in,
+// so polling at a high rate doesn't allocate one per packet.
+var packetPool = sync.Pool{New: func() interface{} {
+	b := make([]byte, 0, bufSize)
+	return &b
+}}
+
+// getPacket returns an empty buffer from packetPool.
+func getPacket() *[]byte {
+	b := packetPool.Get().(*[]byte)
+	*b = (*b)[:0]
+	return b
+}
+
+// putPacket returns a buffer to packetPool. Nothing may refer to it anymore.
+func putPacket(b *[]byte) {
+	if cap(*b) > bufSize {
+		// Don't keep the buffers of unusually large requests around.
+		return
+	}
+	packetPool.Put(b)
+}
+
+// muxWaiter is a request waiting for its response.
+type muxWaiter struct {
+	responses chan *[]byte
+	discarded error // Why the last datagram no request was waiting for was dropped.
+}
+
+// requestMux hands the responses arriving on a connection to the requests
+// waiting for them, matching them by request ID, or message ID for SNMPv3.
+// Unless an Engine delivers the responses, the mux reads them from the
+// connection itself, starting with the first request and stopping when the
+// connection is closed.
+type requestMux struct {
+	conn      net.Conn
+	delivered bool // Responses are passed to deliver, instead of read from conn.
+	startOnce sync.Once
+	stopOnce  sync.Once
+
+	mu      sync.Mutex
+	waiters map[int64]*muxWaiter
+	done    chan struct{} // Closed when the mux stops.
+	err     error         // Why the mux stopped.
+}
+
+func newRequestMux(conn net.Conn) *requestMux {
+	return &requestMux{conn: conn, waiters: make(map[int64]*muxWaiter), done: make(chan struct{})}
+}
+
+// responseID returns the request ID of an SNMPv1 or SNMPv2c message, or the
+// message ID of an SNMPv3 message.
+func responseID(packet []byte) (int64, error) {
+	d := NewDecoder(packet)
+	if err := d.next("message"); err != nil {
+		return 0, err
+	}
+	if err := d.Enter(); err != nil {
+		return 0, fmt.Errorf("malformed message: %v", err)
+	}
+	version, err := d.nextInt("version")
+	if err != nil {
+		return 0, err
+	}
+	// SNMPv3 messages have msgGlobalData where SNMPv1 and v2c have the
+	// community, which is followed by the PDU.
+	if err := d.next("message header"); err != nil {
+		return 0, err
+	}
+	if version != int64(SNMPv3) {
+		if err := d.next("PDU"); err != nil {
+			return 0, err
+		}
+	}
+	if err := d.Enter(); err != nil {
+		return 0, fmt.Errorf("malformed message: %v", err)
+	}
+	return d.nextInt("request ID")
+}
+
+// read delivers the datagrams received on the connection until it is closed.
+func (m *requestMux) read() {
+	buf := make([]byte, bufSize)
+	for {
+		n, err := m.conn.Read(buf)
+		switch {
+		case err == nil:
+			m.deliver(buf[:n])
+		case transientReadError(err):
+			m.discard(err)
+		default:
+			// The connection is closed or broken, reading again would fail
+			// again right away.
+			m.stop(err)
+			return
+		}
+	}
+}
+
+// transientReadError returns whether a connection can still be read from after
+// a read failed with err: a timeout, a temporary error, or an ICMP port
+// unreachable, which a connected UDP socket reports as connection refused.
+func transientReadError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && (netErr.Timeout() || netErr.Temporary()) {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// deliver hands a received datagram to the request waiting for it. The
+// datagram is copied, so packet can be reused.
+func (m *requestMux) deliver(packet []byte) {
+	id, err := responseID(packet)
+	if err != nil {
+		m.discard(err)
+		return
+	}
+	m.mu.Lock()
+	w, ok := m.waiters[id]
+	m.mu.Unlock()
+	if !ok {
+		m.discard(fmt.Errorf("response has request ID %d, no request is waiting for it", id))
+		return
+	}
+	response := getPacket()
+	*response = append(*response, packet...)
+	select {
+	case w.responses <- response:
+	default:
+		// The request has enough responses queued, drop duplicates.
+		putPacket(response)
+	}
+}
+
+// discard tells the waiting requests why a datagram was dropped, so they can
+// report it if they time out.
+func (m *requestMux) discard(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, w := range m.waiters {
+		w.discarded = err
+	}
+}
+
+// stop makes the requests in progress, and all later ones, fail with err.
+func (m *requestMux) stop(err error) {
+	m.stopOnce.Do(func() {
+		m.err = err
+		close(m.done)
+	})
+}
+
+// register makes the responses with the given ID go to the returned waiter.
+func (m *requestMux) register(id int64) (*muxWaiter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.waiters[id]; ok {
+		return nil, fmt.Errorf("a request with ID %d is already in progress", id)
+	}
+	w := &muxWaiter{responses: make(chan *[]byte, 4)}
+	m.waiters[id] = w
+	return w, nil
+}
+
+// unregister stops the delivery of responses to the waiter with the given ID,
+// and returns the buffers of the responses it didn't take.
+func (m *requestMux) unregister(id int64) {
+	m.mu.Lock()
+	w := m.waiters[id]
+	delete(m.waiters, id)
+	m.mu.Unlock()
+	for {
+		select {
+		case response := <-w.responses:
+			putPacket(response)
+		default:
+			return
+		}
+	}
+}
+
+// contextErr returns ctx.Err(), or context.DeadlineExceeded as soon as the
+// deadline has passed, even if ctx did not notice yet.
+func contextErr(ctx context.Context) error {
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return ctx.Err()
+}
+
+// poll sends a packet and waits for a response with the given ID that accept
+// accepts, and returns the size of that response. Responses it rejects are
+// discarded while waiting for the right one. The response passed to accept is
+// reused after it returns, so accept must copy what it keeps. When an attempt
+// fails, policy decides whether to try again. Cancelling ctx aborts the wait,
+// and poll returns ctx.Err().
+func (m *requestMux) poll(ctx context.Context, id int64, toSend []byte, policy RetryPolicy, accept func([]byte) error) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	select {
+	case <-m.done:
+		return 0, m.err
+	default:
+	}
+	w, err := m.register(id)
+	if err != nil {
+		return 0, err
+	}
+	defer m.unregister(id)
+	if !m.delivered {
+		m.startOnce.Do(func() { go m.read() })
+	}
+
+	var rejected error
+	for attempt := 0; ; attempt++ {
+		size, err := m.attempt(ctx, w, toSend, policy.AttemptTimeout(attempt), accept, &rejected)
+		if err == nil {
+			return size, nil
+		}
+		if ctxErr := contextErr(ctx); ctxErr != nil {
+			return 0, ctxErr
+		}
+		if m.stopped() {
+			return 0, m.err
+		}
+
+		delay, retry := policy.Retry(attempt, err)
+		if !retry {
+			return 0, err
+		}
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return 0, ctx.Err()
+			case <-m.done:
+				timer.Stop()
+				return 0, m.err
+			}
+		}
+	}
+}
+
+// stopped returns whether the mux stopped.
+func (m *requestMux) stopped() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// attempt sends a packet once, waits up to timeout for a response that accept
+// accepts, and returns its size. The last reason accept gave for rejecting a
+// response is kept in rejected, over attempts.
+func (m *requestMux) attempt(ctx context.Context, w *muxWaiter, toSend []byte, timeout time.Duration, accept func([]byte) error, rejected *error) (int, error) {
+	if err := m.conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, err
+	}
+	if _, err := m.conn.Write(toSend); err != nil {
+		return 0, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case response := <-w.responses:
+			size := len(*response)
+			err := accept(*response)
+			putPacket(response)
+			if err == nil {
+				return size, nil
+			}
+			*rejected = err
+		case <-timer.C:
+			if *rejected != nil {
+				return 0, &timeoutError{*rejected}
+			}
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			return 0, &timeoutError{w.discarded}
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-m.done:
+			return 0, m.err
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package wapsnmp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestResponseID(t *testing.T) {
+	v2c, _ := (&Message{SNMPv2c, "public", &PDU{Type: AsnGetResponse, RequestID: 1234}}).Marshal()
+	if id, err := responseID(v2c); err != nil || id != 1234 {
+		t.Errorf("responseID() of an SNMPv2c response => %d, %v, want 1234", id, err)
+	}
+	v3, err := testAgentUSM().encodeMessage(5678, []interface{}{AsnGetResponse, 1234, 0, 0, []interface{}{Sequence}})
+	if err != nil {
+		t.Fatalf("error encoding SNMPv3 message: %v", err)
+	}
+	if id, err := responseID(v3); err != nil || id != 5678 {
+		t.Errorf("responseID() of an SNMPv3 response => %d, %v, want 5678", id, err)
+	}
+	if _, err := responseID([]byte{0x30, 0x03, 0x02, 0x01, 0x01}); err == nil {
+		t.Errorf("responseID() of a malformed message returned no error")
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	a, wsnmp := startTestAgent(t, "public", SNMPv2c)
+	defer a.Close()
+	defer wsnmp.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if value, err := wsnmp.Get(MustParseOid(".1.3.6.1.2.1.1.1.0")); err != nil || value != "test agent" {
+				errs <- errors.New("Get(sysDescr.0) got another response")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			oid, value, err := wsnmp.GetNext(MustParseOid(".1.3.6.1.2.1.2.2.1.2.1"))
+			if err != nil || !oid.Equal(MustParseOid(".1.3.6.1.2.1.2.2.1.2.2")) || value != "eth0" {
+				errs <- errors.New("GetNext(ifDescr.1) got another response")
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestResponsesOutOfOrder(t *testing.T) {
+	// An agent that waits for two requests, and answers them in reverse order.
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error creating socket: %v", err)
+	}
+	defer agent.Close()
+	go func() {
+		var responses [][]byte
+		var source net.Addr
+		buf := make([]byte, bufSize)
+		for len(responses) < 2 {
+			n, addr, err := agent.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg Message
+			if err := msg.Unmarshal(buf[:n]); err != nil {
+				return
+			}
+			req := msg.PDU.(*PDU)
+			req.Type = AsnGetResponse
+			req.VarBinds[0].Value = req.VarBinds[0].Oid.String()
+			response, _ := msg.Marshal()
+			responses, source = append(responses, response), addr
+		}
+		agent.WriteTo(responses[1], source)
+		agent.WriteTo(responses[0], source)
+	}()
+
+	conn, err := net.Dial("udp", agent.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	wsnmp := NewWapSNMPOnConn("localhost", "public", SNMPv2c, 2*time.Second, 0, conn)
+	defer wsnmp.Close()
+
+	var wg sync.WaitGroup
+	for _, oid := range []string{".1.3.6.1.2.1.1.1.0", ".1.3.6.1.2.1.1.5.0"} {
+		wg.Add(1)
+		go func(oid string) {
+			defer wg.Done()
+			if value, err := wsnmp.Get(MustParseOid(oid)); err != nil || value != oid {
+				t.Errorf("Get(%v) => %v, %v", oid, value, err)
+			}
+		}(oid)
+	}
+	wg.Wait()
+}
+
+func TestRequestAfterClose(t *testing.T) {
+	a, wsnmp := startTestAgent(t, "public", SNMPv2c)
+	defer a.Close()
+
+	if _, err := wsnmp.Get(MustParseOid(".1.3.6.1.2.1.1.1.0")); err != nil {
+		t.Fatalf("Get() returned error %v", err)
+	}
+	wsnmp.Close()
+	if _, err := wsnmp.Get(MustParseOid(".1.3.6.1.2.1.1.1.0")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Get() after Close() returned %v, want %v", err, net.ErrClosed)
+	}
+}
+
+// brokenConn is a connection whose reads fail for good.
+type brokenConn struct {
+	net.Conn
+	err error
+}
+
+func (c *brokenConn) Read(b []byte) (int, error)  { return 0, c.err }
+func (c *brokenConn) Write(b []byte) (int, error) { return len(b), nil }
+
+func TestBrokenConnection(t *testing.T) {
+	for _, readErr := range []error{io.EOF, io.ErrClosedPipe} {
+		pipe, other := net.Pipe()
+		defer other.Close()
+		wsnmp := NewWapSNMPOnConn("localhost", "public", SNMPv2c, 5*time.Second, 2, &brokenConn{pipe, readErr})
+
+		// The request fails with the read error, instead of timing out while
+		// the mux keeps reading.
+		start := time.Now()
+		if _, err := wsnmp.Get(MustParseOid(".1.3.6.1.2.1.1.1.0")); !errors.Is(err, readErr) {
+			t.Errorf("Get() on a connection failing with %v returned %v", readErr, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Get() on a connection failing with %v took %v", readErr, elapsed)
+		}
+		wsnmp.Close()
+	}
+
+	if !transientReadError(&net.OpError{Op: "read", Err: syscall.ECONNREFUSED}) {
+		t.Errorf("transientReadError(connection refused) => false, want true")
+	}
+}
@@ -0,0 +1,88 @@
+package wapsnmp
+
+/* This file implements the notification originator: sending traps and
+   informs.
+
+   References : RFC 3416 section 4.2.6 and 4.2.7.
+*/
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// startTime is used to calculate sysUpTime.0 for notifications.
+var startTime = time.Now()
+
+// NewWapSNMPNotifier creates a new WapSNMP object to send notifications with.
+// Opens a udp connection to port 162 of the notification receiver.
+func NewWapSNMPNotifier(target, community string, version SNMPVersion, timeout time.Duration, retries int) (*WapSNMP, error) {
+	targetPort := fmt.Sprintf("%s:162", target)
+	conn, err := net.DialTimeout("udp", targetPort, timeout)
+	if err != nil {
+		return nil, fmt.Errorf(`error connecting to ("udp", "%s"): %s`, targetPort, err)
+	}
+	return NewWapSNMPOnConn(target, community, version, timeout, retries, conn), nil
+}
+
+// notificationVarbinds prepends sysUpTime.0 and snmpTrapOID.0 to the
+// varbinds of a notification.
+func notificationVarbinds(trapOid Oid, varbinds []SNMPValue) []SNMPValue {
+	result := make([]SNMPValue, 0, len(varbinds)+2)
+	result = append(result, SNMPValue{sysUpTimeOid, time.Since(startTime)}, SNMPValue{snmpTrapOid, trapOid})
+	return append(result, varbinds...)
+}
+
+// SendTrap sends a trap. Traps are not acknowledged, so this only fails if
+// the trap can't be encoded or sent.
+//
+// With SNMPv1 the trap is translated to a Trap-PDU as described in RFC 3584.
+// The agent-addr is taken from a snmpTrapAddress.0 varbind, or is the local
+// address if there is none.
+func (w WapSNMP) SendTrap(trapOid Oid, varbinds []SNMPValue) error {
+	var pdu MessagePDU
+	switch w.Version {
+	case SNMPv1:
+		trap, err := TrapV1FromV2(notificationVarbinds(trapOid, varbinds))
+		if err != nil {
+			return err
+		}
+		if local, ok := w.conn.LocalAddr().(*net.UDPAddr); ok && trap.AgentAddress.IsUnspecified() && local.IP.To4() != nil {
+			trap.AgentAddress = local.IP.To4()
+		}
+		pdu = trap
+	case SNMPv2c:
+		pdu = &PDU{Type: AsnTrapV2, RequestID: RandomRequestID(), VarBinds: notificationVarbinds(trapOid, varbinds)}
+	default:
+		return fmt.Errorf("can only send traps with SNMPv1 and SNMPv2c, not version %d", w.Version)
+	}
+	req, err := (&Message{w.Version, w.Community, pdu}).Marshal()
+	if err != nil {
+		return err
+	}
+
+	if err := w.conn.SetWriteDeadline(time.Now().Add(w.timeout)); err != nil {
+		return err
+	}
+	_, err = w.conn.Write(req)
+	return err
+}
+
+// SendInform sends an inform, and waits for the receiver to acknowledge it.
+// The inform is retransmitted like any other request.
+func (w WapSNMP) SendInform(trapOid Oid, varbinds []SNMPValue) error {
+	return w.SendInformContext(context.Background(), trapOid, varbinds)
+}
+
+// SendInformContext is SendInform with a context. Cancelling ctx stops
+// waiting for the acknowledgement.
+func (w WapSNMP) SendInformContext(ctx context.Context, trapOid Oid, varbinds []SNMPValue) error {
+	if w.Version == SNMPv1 {
+		return fmt.Errorf("SNMPv1 does not support informs")
+	}
+	_, _, err := w.exchange(ctx, &PDU{Type: AsnInformRequest, RequestID: RandomRequestID(),
+		VarBinds: notificationVarbinds(trapOid, varbinds)})
+	return err
+}
@@ -0,0 +1,92 @@
+package wapsnmp
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// startTestNotifier starts a TrapListener on loopback, and returns a WapSNMP
+// that sends notifications to it.
+func startTestNotifier(t *testing.T) (*TrapListener, <-chan *Notification, *WapSNMP) {
+	l, err := NewTrapListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTrapListener() returned error %v", err)
+	}
+	notifications := l.Notifications(1)
+	conn, err := net.Dial("udp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		t.Fatalf("error connecting to listener: %v", err)
+	}
+	return l, notifications, NewWapSNMPOnConn("localhost", "public", SNMPv2c, time.Second, 2, conn)
+}
+
+func TestSendTrap(t *testing.T) {
+	l, notifications, wsnmp := startTestNotifier(t)
+	defer l.Close()
+	defer wsnmp.Close()
+
+	linkDown := MustParseOid(".1.3.6.1.6.3.1.1.5.3")
+	varbinds := []SNMPValue{{MustParseOid(".1.3.6.1.2.1.2.2.1.1.3"), 3}}
+	if err := wsnmp.SendTrap(linkDown, varbinds); err != nil {
+		t.Fatalf("SendTrap() returned error %v", err)
+	}
+
+	n := receiveNotification(t, notifications)
+	if n.Type != AsnTrapV2 || n.Community != "public" || !n.TrapOID.Equal(linkDown) {
+		t.Errorf("got notification type %v community %q trap oid %v, want linkDown trap", n.Type, n.Community, n.TrapOID)
+	}
+	if n.SysUpTime <= 0 || n.SysUpTime > time.Since(startTime) {
+		t.Errorf("got sysUpTime %v, want up to %v", n.SysUpTime, time.Since(startTime))
+	}
+	want := []SNMPValue{{MustParseOid(".1.3.6.1.2.1.2.2.1.1.3"), int64(3)}}
+	if !reflect.DeepEqual(n.Varbinds, want) {
+		t.Errorf("got varbinds %v, want %v", n.Varbinds, want)
+	}
+}
+
+func TestSendInform(t *testing.T) {
+	l, notifications, wsnmp := startTestNotifier(t)
+	defer l.Close()
+	defer wsnmp.Close()
+
+	coldStart := MustParseOid(".1.3.6.1.6.3.1.1.5.1")
+	if err := wsnmp.SendInform(coldStart, nil); err != nil {
+		t.Fatalf("SendInform() returned error %v", err)
+	}
+
+	n := receiveNotification(t, notifications)
+	if n.Type != AsnInformRequest || !n.TrapOID.Equal(coldStart) {
+		t.Errorf("got notification type %v trap oid %v, want coldStart inform", n.Type, n.TrapOID)
+	}
+}
+
+func TestSendInformUnacknowledged(t *testing.T) {
+	// Nothing listens on this socket, so the inform is never acknowledged.
+	sink, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error creating socket: %v", err)
+	}
+	defer sink.Close()
+	conn, err := net.Dial("udp", sink.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	wsnmp := NewWapSNMPOnConn("localhost", "public", SNMPv2c, 10*time.Millisecond, 2, conn)
+	defer wsnmp.Close()
+
+	if err := wsnmp.SendInform(MustParseOid(".1.3.6.1.6.3.1.1.5.1"), nil); err == nil {
+		t.Errorf("SendInform() without acknowledgement returned no error")
+	}
+
+	// The inform should have been sent once, and retransmitted twice.
+	sink.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, bufSize)
+	for i := 0; i < 3; i++ {
+		if _, _, err := sink.ReadFrom(buf); err != nil {
+			t.Fatalf("received %d informs, want 3: %v", i, err)
+		}
+	}
+}
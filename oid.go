@@ -8,6 +8,7 @@ package wapsnmp
 import (
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 )
@@ -63,62 +64,94 @@ func ParseOid(oid string) (Oid, error) {
 
 // DecodeOid decodes a ASN.1 BER raw oid into an Oid instance.
 func DecodeOid(raw []byte) (*Oid, error) {
+	result, err := decodeOid(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// decodeOid is DecodeOid without the pointer, which would be allocated.
+func decodeOid(raw []byte) (Oid, error) {
 	if len(raw) < 1 {
 		return nil, errors.New("0 byte oid doesn't exist")
 	}
 
-	result := make([]int, 2)
-	result[0] = int(raw[0] / 40)
-	result[1] = int(raw[0] % 40)
-	val := 0
-	for idx, b := range raw {
-		if idx == 0 {
+	// Every byte below 128 ends a sub-identifier, and the first sub-identifier
+	// encodes the first two, as 40 * first + second.
+	n := 1
+	for _, b := range raw {
+		if b < 128 {
+			n++
+		}
+	}
+	result := make(Oid, 0, n)
+	var val uint64
+	for _, b := range raw {
+		val = val*128 + uint64(b&0x7f)
+		limit := uint64(math.MaxUint32)
+		if len(result) == 0 {
+			// The first sub-identifier encodes two, the second can be 32 bits.
+			limit += 80
+		}
+		if val > limit {
+			return nil, fmt.Errorf("oid %v has a sub-identifier larger than 32 bits", raw)
+		}
+		if b >= 128 {
 			continue
 		}
-		if b < 128 {
-			val = val*128 + int(b)
-			result = append(result, val)
-			val = 0
-		} else {
-			val = val*128 + int(b%128)
+		switch {
+		case len(result) > 0:
+			result = append(result, int(val))
+		case val < 80:
+			result = append(result, int(val/40), int(val%40))
+		default:
+			result = append(result, 2, int(val-80))
 		}
+		val = 0
 	}
-	r := Oid(result)
-	return &r, nil
+	if raw[len(raw)-1] >= 128 {
+		return nil, fmt.Errorf("oid %v ends in the middle of a sub-identifier", raw)
+	}
+	return result, nil
+}
+
+// appendSubid appends a sub-identifier in base 128, with the high bit set on
+// all but the last byte.
+func appendSubid(b []byte, val int) []byte {
+	n := 1
+	for v := val >> 7; v > 0; v >>= 7 {
+		n++
+	}
+	for i := n - 1; i > 0; i-- {
+		b = append(b, 0x80|byte(val>>uint(7*i)))
+	}
+	return append(b, byte(val&0x7f))
 }
 
 // Encode encodes the oid into an ASN.1 BER byte array.
 func (o Oid) Encode() ([]byte, error) {
+	return o.appendEncoded(nil)
+}
+
+// appendEncoded appends the ASN.1 BER encoding of the oid to dst.
+func (o Oid) appendEncoded(dst []byte) ([]byte, error) {
 	if len(o) < 2 {
 		return nil, errors.New("oid needs to be at least 2 long")
 	}
-	var result []byte
+	if o[0] < 0 || o[0] > 2 || o[1] < 0 || (o[0] < 2 && o[1] >= 40) || int64(o[1]) > math.MaxUint32 {
+		return nil, fmt.Errorf("oid %v can't start with %d.%d", o, o[0], o[1])
+	}
 	/* Every o is supposed to start with 40 * first_byte + second
 	   byte */
-	start := (40 * o[0]) + o[1]
-	result = append(result, byte(start))
+	dst = appendSubid(dst, (40*o[0])+o[1])
 	for i := 2; i < len(o); i++ {
-		val := o[i]
-
-		var toadd []int
-		if val == 0 {
-			toadd = append(toadd, 0)
-		}
-		for val > 0 {
-			toadd = append(toadd, val%128)
-			val /= 128
-		}
-
-		for i := len(toadd) - 1; i >= 0; i-- {
-			sevenbits := toadd[i]
-			if i != 0 {
-				result = append(result, 128+byte(sevenbits))
-			} else {
-				result = append(result, byte(sevenbits))
-			}
+		if o[i] < 0 || int64(o[i]) > math.MaxUint32 {
+			return nil, fmt.Errorf("oid %v has sub-identifier %d, which doesn't fit in 32 bits", o, o[i])
 		}
+		dst = appendSubid(dst, o[i])
 	}
-	return result, nil
+	return dst, nil
 }
 
 // Copy copies an oid into a new object instance.
@@ -128,6 +161,39 @@ func (o Oid) Copy() Oid {
 	return Oid(dest)
 }
 
+// Equal determines if two oids are the same.
+func (o Oid) Equal(other Oid) bool {
+	if len(o) != len(other) {
+		return false
+	}
+	for idx, val := range other {
+		if o[idx] != val {
+			return false
+		}
+	}
+	return true
+}
+
+// Compare compares two oids lexicographically, the order of the MIB. Returns
+// -1 if o comes before other, 0 if they're equal and 1 if o comes after other.
+func (o Oid) Compare(other Oid) int {
+	for idx := 0; idx < len(o) && idx < len(other); idx++ {
+		if o[idx] < other[idx] {
+			return -1
+		}
+		if o[idx] > other[idx] {
+			return 1
+		}
+	}
+	switch {
+	case len(o) < len(other):
+		return -1
+	case len(o) > len(other):
+		return 1
+	}
+	return 0
+}
+
 // Within determines if an oid has this oid instance as a prefix.
 //
 // E.g. MustParseOid("1.2.3").Within(MustParseOid("1.2")) => true.
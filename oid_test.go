@@ -76,3 +76,51 @@ func TestWithin(t *testing.T) {
 		t.Errorf("Within is not working")
 	}
 }
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.3.6.1", "1.3.6.1", 0},
+		{"1.3.6.1", "1.3.6.2", -1},
+		{"1.3.6.10", "1.3.6.9", 1},
+		{"1.3.6", "1.3.6.1", -1},
+		{"1.3.6.1.0", "1.3.6.1", 1},
+		{".", "1.3", -1},
+	}
+
+	for _, test := range tests {
+		if got := MustParseOid(test.a).Compare(MustParseOid(test.b)); got != test.want {
+			t.Errorf("%v.Compare(%v) => %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestOidEncodeDecodeBounds(t *testing.T) {
+	for _, oid := range []Oid{
+		MustParseOid("2.999.1"), // The first sub-identifier takes 2 bytes.
+		MustParseOid("1.3.6.1.4294967295"),
+		MustParseOid("0.0"),
+	} {
+		enc, err := oid.Encode()
+		if err != nil {
+			t.Errorf("%v.Encode() returned error %v", oid, err)
+			continue
+		}
+		if got, err := DecodeOid(enc); err != nil || !got.Equal(oid) {
+			t.Errorf("DecodeOid(%v.Encode()) => %v, %v", oid, got, err)
+		}
+	}
+
+	for _, oid := range []Oid{{3, 1}, {1, 40}, {1, 3, -1}} {
+		if enc, err := oid.Encode(); err == nil {
+			t.Errorf("%v.Encode() => %x, want an error", oid, enc)
+		}
+	}
+	for _, enc := range [][]byte{{0x2b, 0x86}, {0x2b, 0x90, 0x80, 0x80, 0x80, 0x00}} {
+		if oid, err := DecodeOid(enc); err == nil {
+			t.Errorf("DecodeOid(%x) => %v, want an error", enc, oid)
+		}
+	}
+}
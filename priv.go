@@ -0,0 +1,226 @@
+package wapsnmp
+
+/* This file implements the USM privacy protocols, which encrypt the
+   scopedPDU of SNMPv3 messages.
+
+   References : RFC 3414 section 8 (CBC-DES), RFC 3826 (CFB128-AES-128),
+                draft-blumenthal-aes-usm-04 (AES-192/256),
+                draft-reeder-snmpv3-usm-3desede-00 (key extension used by
+                Cisco for AES-192/256).
+*/
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// PrivProtocol is the USM privacy protocol used to encrypt SNMPv3 PDUs.
+type PrivProtocol uint8
+
+// List of the supported privacy protocols.
+const (
+	NoPriv      PrivProtocol = iota // No encryption.
+	PrivDES                         // CBC-DES, RFC 3414.
+	PrivAES                         // CFB128-AES-128, RFC 3826.
+	PrivAES192                      // CFB128-AES-192, Blumenthal key extension.
+	PrivAES256                      // CFB128-AES-256, Blumenthal key extension.
+	PrivAES192C                     // CFB128-AES-192, Reeder key extension, as used by Cisco.
+	PrivAES256C                     // CFB128-AES-256, Reeder key extension, as used by Cisco.
+)
+
+// String returns the name of the privacy protocol.
+func (p PrivProtocol) String() string {
+	switch p {
+	case NoPriv:
+		return "NoPriv"
+	case PrivDES:
+		return "DES"
+	case PrivAES:
+		return "AES"
+	case PrivAES192:
+		return "AES192"
+	case PrivAES256:
+		return "AES256"
+	case PrivAES192C:
+		return "AES192C"
+	case PrivAES256C:
+		return "AES256C"
+	}
+	return fmt.Sprintf("PrivProtocol(%d)", uint8(p))
+}
+
+// keyLength returns how many bytes of localized key the protocol needs.
+func (p PrivProtocol) keyLength() int {
+	switch p {
+	case PrivDES:
+		// 8 bytes of DES key followed by 8 bytes of pre-IV.
+		return 16
+	case PrivAES:
+		return 16
+	case PrivAES192, PrivAES192C:
+		return 24
+	case PrivAES256, PrivAES256C:
+		return 32
+	}
+	return 0
+}
+
+// localizedPrivKey returns the privacy key localized to the authoritative
+// engine, computing it if needed.
+func (u *USM) localizedPrivKey() ([]byte, error) {
+	if u.privKey != nil && u.privKeyEngine == u.AuthoritativeEngineID {
+		return u.privKey, nil
+	}
+	keyLen := u.PrivProtocol.keyLength()
+	if keyLen == 0 {
+		return nil, fmt.Errorf("unsupported privacy protocol %v", u.PrivProtocol)
+	}
+	engineID := []byte(u.AuthoritativeEngineID)
+	key, err := PasswordToKey(u.AuthProtocol, u.PrivPassword, engineID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hash functions with short digests don't yield enough key material for
+	// the longer AES keys, so it has to be extended.
+	for len(key) < keyLen {
+		switch u.PrivProtocol {
+		case PrivAES192C, PrivAES256C:
+			// Reeder: localize the key again, using the key as password.
+			extra, err := PasswordToKey(u.AuthProtocol, string(key), engineID)
+			if err != nil {
+				return nil, err
+			}
+			key = append(key, extra...)
+		default:
+			// Blumenthal: append the hash of the key so far.
+			newHash, err := u.AuthProtocol.hash()
+			if err != nil {
+				return nil, err
+			}
+			h := newHash()
+			h.Write(key)
+			key = h.Sum(key)
+		}
+	}
+
+	u.privKey = key[:keyLen]
+	u.privKeyEngine = u.AuthoritativeEngineID
+	return u.privKey, nil
+}
+
+// nextSalt returns a new value for the salt of the privacy protocols. The
+// salt starts at a random value and is incremented for every message.
+func (u *USM) nextSalt() (uint64, error) {
+	if !u.saltSet {
+		var b [8]byte
+		if _, err := cryptorand.Read(b[:]); err != nil {
+			return 0, fmt.Errorf("error initializing privacy salt: %v", err)
+		}
+		u.salt = binary.BigEndian.Uint64(b[:])
+		u.saltSet = true
+	}
+	u.salt++
+	return u.salt, nil
+}
+
+// encrypt encrypts an encoded scopedPDU, returning the ciphertext and the
+// msgPrivacyParameters to send along with it. The engine boots and time are
+// the values that go into the message's security parameters.
+func (u *USM) encrypt(plaintext []byte, engineBoots, engineTime int64) ([]byte, []byte, error) {
+	key, err := u.localizedPrivKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	salt, err := u.nextSalt()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privParams := make([]byte, 8)
+	if u.PrivProtocol == PrivDES {
+		// The salt is engineBoots followed by a local counter, the IV is the
+		// salt XOR'ed with the pre-IV.
+		binary.BigEndian.PutUint32(privParams, uint32(engineBoots))
+		binary.BigEndian.PutUint32(privParams[4:], uint32(salt))
+		block, err := des.NewCipher(key[:8])
+		if err != nil {
+			return nil, nil, err
+		}
+		iv := make([]byte, des.BlockSize)
+		for i := range iv {
+			iv[i] = key[8+i] ^ privParams[i]
+		}
+
+		padded := make([]byte, (len(plaintext)+des.BlockSize-1)/des.BlockSize*des.BlockSize)
+		copy(padded, plaintext)
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+		return padded, privParams, nil
+	}
+
+	binary.BigEndian.PutUint64(privParams, salt)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCFBEncrypter(block, aesIV(engineBoots, engineTime, privParams)).XORKeyStream(ciphertext, plaintext)
+	return ciphertext, privParams, nil
+}
+
+// decrypt decrypts a received scopedPDU. The engine boots and time are the
+// values from the message's security parameters.
+func (u *USM) decrypt(ciphertext, privParams []byte, engineBoots, engineTime int64) ([]byte, error) {
+	key, err := u.localizedPrivKey()
+	if err != nil {
+		return nil, err
+	}
+	if len(privParams) != 8 {
+		return nil, fmt.Errorf("msgPrivacyParameters is %d bytes, want 8", len(privParams))
+	}
+
+	var plaintext []byte
+	if u.PrivProtocol == PrivDES {
+		if len(ciphertext)%des.BlockSize != 0 {
+			return nil, errors.New("DES ciphertext is not a multiple of the block size")
+		}
+		block, err := des.NewCipher(key[:8])
+		if err != nil {
+			return nil, err
+		}
+		iv := make([]byte, des.BlockSize)
+		for i := range iv {
+			iv[i] = key[8+i] ^ privParams[i]
+		}
+		plaintext = make([]byte, len(ciphertext))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	} else {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		plaintext = make([]byte, len(ciphertext))
+		cipher.NewCFBDecrypter(block, aesIV(engineBoots, engineTime, privParams)).XORKeyStream(plaintext, ciphertext)
+	}
+
+	// Chop off any padding after the scopedPDU.
+	_, end, err := tlvBounds(plaintext, 0)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failure: %v", err)
+	}
+	return plaintext[:end], nil
+}
+
+// aesIV builds the AES initialization vector: engineBoots, engineTime, salt.
+func aesIV(engineBoots, engineTime int64, salt []byte) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint32(iv, uint32(engineBoots))
+	binary.BigEndian.PutUint32(iv[4:], uint32(engineTime))
+	copy(iv[8:], salt)
+	return iv
+}
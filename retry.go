@@ -0,0 +1,201 @@
+package wapsnmp
+
+/* This file implements the policies that decide how requests are retried,
+   and a circuit breaker for devices that stopped answering.
+
+   References : RFC 3416 section 4.1 (retransmission is the responsibility of
+                the application).
+*/
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrTimeout is returned, possibly wrapped, when no response arrived in time.
+var ErrTimeout = errors.New("timed out waiting for a response")
+
+// ErrCircuitOpen is returned when a CircuitBreaker fails a request without
+// sending it.
+var ErrCircuitOpen = errors.New("circuit breaker open, device is not answering")
+
+// timeoutError is returned when no matching response arrived in time. It
+// matches ErrTimeout, and unwraps to the reason a response was discarded.
+type timeoutError struct {
+	discarded error
+}
+
+func (e *timeoutError) Error() string {
+	if e.discarded != nil {
+		return ErrTimeout.Error() + ", discarded response: " + e.discarded.Error()
+	}
+	return ErrTimeout.Error()
+}
+
+func (e *timeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+func (e *timeoutError) Unwrap() error {
+	return e.discarded
+}
+
+// RetryPolicy decides how long to wait for the response to every attempt of
+// a request, and whether and when to send it again.
+type RetryPolicy interface {
+	// AttemptTimeout returns how long to wait for a response to an attempt.
+	// The first attempt is 0.
+	AttemptTimeout(attempt int) time.Duration
+	// Retry returns whether to send the request again after an attempt
+	// failed with err, e.g. ErrTimeout or a write error, and how long to
+	// wait before doing so.
+	Retry(attempt int, err error) (time.Duration, bool)
+}
+
+// ConstantRetry retries a request a fixed number of times, with the same
+// timeout every time. It's the policy of a new WapSNMP, with Delay 0.
+type ConstantRetry struct {
+	Timeout time.Duration // Timeout of every attempt.
+	Retries int           // Number of retries after the first attempt.
+	Delay   time.Duration // Wait before every retry.
+
+	// RetryOn returns whether to retry after an error. All errors are
+	// retried when it is nil.
+	RetryOn func(err error) bool
+}
+
+// AttemptTimeout implements RetryPolicy.
+func (p *ConstantRetry) AttemptTimeout(attempt int) time.Duration {
+	return p.Timeout
+}
+
+// Retry implements RetryPolicy.
+func (p *ConstantRetry) Retry(attempt int, err error) (time.Duration, bool) {
+	if attempt >= p.Retries || (p.RetryOn != nil && !p.RetryOn(err)) {
+		return 0, false
+	}
+	return p.Delay, true
+}
+
+// ExponentialBackoff retries a request with growing delays, and optionally
+// growing timeouts.
+type ExponentialBackoff struct {
+	Timeout       time.Duration // Timeout of the first attempt.
+	TimeoutGrowth float64       // Factor the timeout grows with every attempt, 1 when 0.
+	MaxTimeout    time.Duration // Upper bound of the timeout, none when 0.
+
+	Delay      time.Duration // Wait before the first retry.
+	Multiplier float64       // Factor the wait grows with every retry, 2 when 0.
+	MaxDelay   time.Duration // Upper bound of the wait, none when 0.
+	// Jitter is the fraction of the wait that is random, between 0 and 1,
+	// so devices that failed together aren't retried together.
+	Jitter float64
+
+	Retries int // Number of retries after the first attempt.
+
+	// RetryOn returns whether to retry after an error. All errors are
+	// retried when it is nil.
+	RetryOn func(err error) bool
+}
+
+// grow returns base multiplied by factor n times, capped at max if it's not 0.
+func grow(base time.Duration, factor float64, n int, max time.Duration) time.Duration {
+	result := float64(base) * math.Pow(factor, float64(n))
+	if max > 0 && result > float64(max) {
+		return max
+	}
+	return time.Duration(result)
+}
+
+// AttemptTimeout implements RetryPolicy.
+func (p *ExponentialBackoff) AttemptTimeout(attempt int) time.Duration {
+	factor := p.TimeoutGrowth
+	if factor == 0 {
+		factor = 1
+	}
+	return grow(p.Timeout, factor, attempt, p.MaxTimeout)
+}
+
+// Retry implements RetryPolicy.
+func (p *ExponentialBackoff) Retry(attempt int, err error) (time.Duration, bool) {
+	if attempt >= p.Retries || (p.RetryOn != nil && !p.RetryOn(err)) {
+		return 0, false
+	}
+	factor := p.Multiplier
+	if factor == 0 {
+		factor = 2
+	}
+	delay := grow(p.Delay, factor, attempt, p.MaxDelay)
+	if p.Jitter > 0 {
+		delay -= time.Duration(p.Jitter * rand.Float64() * float64(delay))
+	}
+	return delay, true
+}
+
+// CircuitBreaker makes the requests to a device fail fast with ErrCircuitOpen
+// after a number of them timed out in a row, so a dead device doesn't stall
+// every request for the full timeout. After Cooldown, one request is let
+// through: if it gets a response the circuit closes again, if it times out
+// the circuit stays open for another Cooldown.
+type CircuitBreaker struct {
+	Threshold int           // Timed out requests in a row that open the circuit, 1 if less.
+	Cooldown  time.Duration // How long the circuit stays open.
+
+	mu        sync.Mutex
+	timeouts  int
+	openUntil time.Time
+	probes    uint64 // The number of requests let through to see if the device is back.
+	probe     uint64 // The one of them that is in flight, 0 if none is.
+}
+
+// NewCircuitBreaker creates a CircuitBreaker.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Threshold: threshold, Cooldown: cooldown}
+}
+
+// threshold returns Threshold, or 1 if it's less.
+func (b *CircuitBreaker) threshold() int {
+	if b.Threshold < 1 {
+		return 1
+	}
+	return b.Threshold
+}
+
+// allow returns ErrCircuitOpen if a request should fail without being sent.
+// Otherwise it returns the probe the request is, 0 if it isn't one, to pass to
+// record.
+func (b *CircuitBreaker) allow() (uint64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.timeouts < b.threshold() {
+		return 0, nil
+	}
+	if b.probe != 0 || time.Now().Before(b.openUntil) {
+		return 0, ErrCircuitOpen
+	}
+	b.probes++
+	b.probe = b.probes
+	return b.probe, nil
+}
+
+// record updates the breaker with the outcome of a request that was allowed
+// as probe.
+func (b *CircuitBreaker) record(probe uint64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe != 0 && probe == b.probe {
+		b.probe = 0
+	}
+	switch {
+	case err == nil:
+		b.timeouts = 0
+	case errors.Is(err, ErrTimeout):
+		b.timeouts++
+		if b.timeouts >= b.threshold() {
+			b.openUntil = time.Now().Add(b.Cooldown)
+		}
+	}
+}
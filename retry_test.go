@@ -0,0 +1,171 @@
+package wapsnmp
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	p := &ExponentialBackoff{Timeout: time.Second, TimeoutGrowth: 2, MaxTimeout: 3 * time.Second,
+		Delay: 100 * time.Millisecond, MaxDelay: 250 * time.Millisecond, Retries: 3}
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		if got := p.AttemptTimeout(attempt); got != want {
+			t.Errorf("AttemptTimeout(%d) => %v, want %v", attempt, got, want)
+		}
+	}
+	for attempt, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 250 * time.Millisecond} {
+		if got, ok := p.Retry(attempt, ErrTimeout); !ok || got != want {
+			t.Errorf("Retry(%d) => %v, %v, want %v", attempt, got, ok, want)
+		}
+	}
+	if _, ok := p.Retry(3, ErrTimeout); ok {
+		t.Errorf("Retry() after the last retry returned true")
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got, _ := p.Retry(0, ErrTimeout); got < 50*time.Millisecond || got > 100*time.Millisecond {
+			t.Fatalf("Retry() with jitter => %v, want between 50ms and 100ms", got)
+		}
+	}
+
+	p.RetryOn = func(err error) bool { return errors.Is(err, ErrTimeout) }
+	if _, ok := p.Retry(0, errors.New("write failed")); ok {
+		t.Errorf("Retry() of an error RetryOn rejects returned true")
+	}
+}
+
+// startSilentAgent starts a socket that counts the requests it receives,
+// without ever answering them.
+func startSilentAgent(t *testing.T) (net.PacketConn, *int32) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error creating socket: %v", err)
+	}
+	var received int32
+	go func() {
+		buf := make([]byte, bufSize)
+		for {
+			if _, _, err := conn.ReadFrom(buf); err != nil {
+				return
+			}
+			atomic.AddInt32(&received, 1)
+		}
+	}()
+	return conn, &received
+}
+
+func TestRetryPolicy(t *testing.T) {
+	silent, received := startSilentAgent(t)
+	defer silent.Close()
+	conn, err := net.Dial("udp", silent.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	wsnmp := NewWapSNMPOnConn("localhost", "public", SNMPv2c, time.Second, 5, conn)
+	defer wsnmp.Close()
+	wsnmp.SetRetryPolicy(&ExponentialBackoff{Timeout: 20 * time.Millisecond, TimeoutGrowth: 2,
+		Delay: 10 * time.Millisecond, Retries: 2})
+
+	start := time.Now()
+	if _, err := wsnmp.Get(MustParseOid(".1.3.6.1.2.1.1.1.0")); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Get() returned %v, want %v", err, ErrTimeout)
+	}
+	// Timeouts of 20, 40 and 80ms, and waits of 10 and 20ms.
+	if elapsed := time.Since(start); elapsed < 170*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Get() took %v, want about 170ms", elapsed)
+	}
+	if got := atomic.LoadInt32(received); got != 3 {
+		t.Errorf("agent received %d requests, want 3", got)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	silent, received := startSilentAgent(t)
+	defer silent.Close()
+	conn, err := net.Dial("udp", silent.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	wsnmp := NewWapSNMPOnConn("localhost", "public", SNMPv2c, 10*time.Millisecond, 0, conn)
+	defer wsnmp.Close()
+	breaker := NewCircuitBreaker(2, 50*time.Millisecond)
+	wsnmp.SetCircuitBreaker(breaker)
+	oid := MustParseOid(".1.3.6.1.2.1.1.1.0")
+
+	for i := 0; i < 2; i++ {
+		if _, err := wsnmp.Get(oid); !errors.Is(err, ErrTimeout) {
+			t.Fatalf("Get() returned %v, want %v", err, ErrTimeout)
+		}
+	}
+	if _, err := wsnmp.Get(oid); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Get() with the circuit open returned %v, want %v", err, ErrCircuitOpen)
+	}
+	if got := atomic.LoadInt32(received); got != 2 {
+		t.Errorf("agent received %d requests, want 2", got)
+	}
+
+	// After the cooldown one request is let through, and it times out again.
+	time.Sleep(60 * time.Millisecond)
+	if _, err := wsnmp.Get(oid); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Get() after the cooldown returned %v, want %v", err, ErrTimeout)
+	}
+	if _, err := wsnmp.Get(oid); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Get() after a failed probe returned %v, want %v", err, ErrCircuitOpen)
+	}
+
+	// Only one request probes the device, and a response closes the circuit.
+	time.Sleep(60 * time.Millisecond)
+	probe, err := breaker.allow()
+	if err != nil || probe == 0 {
+		t.Fatalf("allow() after the cooldown returned %d, %v, want a probe", probe, err)
+	}
+	if _, err := breaker.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("allow() while probing returned %v, want %v", err, ErrCircuitOpen)
+	}
+	breaker.record(probe, nil)
+	if probe, err := breaker.allow(); err != nil || probe != 0 {
+		t.Errorf("allow() after a response returned %d, %v, want no probe", probe, err)
+	}
+}
+
+func TestCircuitBreakerProbe(t *testing.T) {
+	// A Threshold of 0 is taken as 1.
+	breaker := &CircuitBreaker{Cooldown: time.Millisecond}
+	if probe, err := breaker.allow(); err != nil || probe != 0 {
+		t.Fatalf("allow() of a closed circuit returned %d, %v, want no probe", probe, err)
+	}
+	breaker.record(0, ErrTimeout)
+	if _, err := breaker.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("allow() after a timeout returned %v, want %v", err, ErrCircuitOpen)
+	}
+
+	// A request sent before the circuit opened doesn't end the probe when it
+	// finishes first.
+	time.Sleep(2 * time.Millisecond)
+	probe, err := breaker.allow()
+	if err != nil || probe == 0 {
+		t.Fatalf("allow() after the cooldown returned %d, %v, want a probe", probe, err)
+	}
+	breaker.record(0, ErrTimeout)
+	time.Sleep(2 * time.Millisecond)
+	if _, err := breaker.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("allow() while probing returned %v, want %v", err, ErrCircuitOpen)
+	}
+
+	breaker.record(probe, ErrTimeout)
+	time.Sleep(2 * time.Millisecond)
+	next, err := breaker.allow()
+	if err != nil || next == 0 || next == probe {
+		t.Errorf("allow() after the probe returned %d, %v, want a new probe", next, err)
+	}
+	// The old probe can't end the new one.
+	breaker.record(probe, ErrTimeout)
+	time.Sleep(2 * time.Millisecond)
+	if _, err := breaker.allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("allow() while probing again returned %v, want %v", err, ErrCircuitOpen)
+	}
+}
@@ -2,15 +2,15 @@
 package wapsnmp
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"math/rand"
 	"net"
-	"reflect"
 	"time"
 )
 
-// WapSNMP is the type that lets you do SNMP requests.
+// WapSNMP is the type that lets you do SNMP requests. It can be used by several goroutines at once, their requests
+// share the connection and each gets its own response.
 type WapSNMP struct {
 	Target    string        // Target device for these SNMP events.
 	Community string        // Community to use to contact the device.
@@ -18,6 +18,13 @@ type WapSNMP struct {
 	timeout   time.Duration // Timeout to use for all SNMP packets.
 	retries   int           // Number of times to retry an operation.
 	conn      net.Conn      // Cache the UDP connection in the object.
+	mux       *requestMux   // Hands the responses on conn to the requests waiting for them.
+	policy    RetryPolicy   // Overrides timeout and retries when set.
+	breaker   *CircuitBreaker
+	strategy  WalkStrategy // Requests GetTable uses.
+	limits    WalkLimits   // Bounds of the walks of GetTable and Walk.
+	reps      *repetitions // Max-repetitions GetTable uses, shared by the copies of a WapSNMP.
+	usm       *USM         // SNMPv3 security settings, nil for v1 and v2c.
 }
 
 // SNMPValue type to express an oid value pair.
@@ -37,14 +44,35 @@ func NewWapSNMP(target, community string, version SNMPVersion, timeout time.Dura
 	if err != nil {
 		return nil, fmt.Errorf(`error connecting to ("udp", "%s"): %s`, targetPort, err)
 	}
-	return &WapSNMP{target, community, version, timeout, retries, conn}, nil
+	return NewWapSNMPOnConn(target, community, version, timeout, retries, conn), nil
 }
 
 // NewWapSNMPOnConn creates a new WapSNMP object from an existing net.Conn.
 //
 // It does not check if the provided target is valid.
 func NewWapSNMPOnConn(target, community string, version SNMPVersion, timeout time.Duration, retries int, conn net.Conn) *WapSNMP {
-	return &WapSNMP{target, community, version, timeout, retries, conn}
+	return &WapSNMP{Target: target, Community: community, Version: version, timeout: timeout, retries: retries, conn: conn,
+		mux: newRequestMux(conn), reps: newRepetitions(defaultMaxRepetitions)}
+}
+
+// NewWapSNMPv3 creates a new WapSNMP object that talks SNMPv3 to the device,
+// using the User-based Security Model settings in usm.
+func NewWapSNMPv3(target string, usm *USM, timeout time.Duration, retries int) (*WapSNMP, error) {
+	w, err := NewWapSNMP(target, "", SNMPv3, timeout, retries)
+	if err != nil {
+		return nil, err
+	}
+	w.usm = usm
+	return w, nil
+}
+
+// NewWapSNMPv3OnConn creates a new SNMPv3 WapSNMP object from an existing net.Conn.
+//
+// It does not check if the provided target is valid.
+func NewWapSNMPv3OnConn(target string, usm *USM, timeout time.Duration, retries int, conn net.Conn) *WapSNMP {
+	w := NewWapSNMPOnConn(target, "", SNMPv3, timeout, retries, conn)
+	w.usm = usm
+	return w
 }
 
 // RandomRequestID generates a valid SNMP request ID.
@@ -52,103 +80,179 @@ func RandomRequestID() int {
 	return int(rand.Int31())
 }
 
-// poll sends a packet and wait for a response. Both operations can timeout, they're retried up to retries times.
-func poll(conn net.Conn, toSend []byte, respondBuffer []byte, retries int, timeout time.Duration) (int, error) {
+// SetRetryPolicy makes requests use policy to decide how long to wait for a response, and when to retry, instead
+// of the timeout and retries the WapSNMP was created with.
+func (w *WapSNMP) SetRetryPolicy(policy RetryPolicy) {
+	w.policy = policy
+}
+
+// SetCircuitBreaker makes requests fail fast with ErrCircuitOpen when the device stopped answering, as decided by
+// breaker. A breaker belongs to one device, nil removes it.
+func (w *WapSNMP) SetCircuitBreaker(breaker *CircuitBreaker) {
+	w.breaker = breaker
+}
+
+// retryPolicy returns the policy set with SetRetryPolicy, or one using the timeout and retries the WapSNMP was
+// created with.
+func (w WapSNMP) retryPolicy() RetryPolicy {
+	if w.policy != nil {
+		return w.policy
+	}
+	return &ConstantRetry{Timeout: w.timeout, Retries: w.retries}
+}
+
+// roundTrip sends a message to the device and returns the size of the first response with the same request ID, or
+// message ID for SNMPv3, that accept accepts. The response passed to accept is only valid during the call.
+func (w WapSNMP) roundTrip(ctx context.Context, id int64, req []byte, accept func([]byte) error) (int, error) {
+	policy := w.retryPolicy()
+	if w.breaker == nil {
+		return w.mux.poll(ctx, id, req, policy, accept)
+	}
+	probe, err := w.breaker.allow()
+	if err != nil {
+		return 0, err
+	}
+	size, err := w.mux.poll(ctx, id, req, policy, accept)
+	w.breaker.record(probe, err)
+	return size, err
+}
+
+// pduRequestID returns the request ID of a PDU built for EncodeSequence.
+func pduRequestID(pdu []interface{}) int64 {
+	switch id := pdu[1].(type) {
+	case int:
+		return int64(id)
+	case int64:
+		return id
+	}
+	return -1
+}
+
+// exchange sends a request PDU to the device and returns the response PDU, a GetResponse, and the size of the response
+// message. If the response has a non-zero error-status, an SNMPError is returned. This is the only place responses are
+// checked for one.
+func (w WapSNMP) exchange(ctx context.Context, pdu MessagePDU) (*PDU, int, error) {
+	var respPDU *PDU
+	var size int
 	var err error
-	for i := 0; i < retries+1; i++ {
-		deadline := time.Now().Add(timeout)
+	if w.Version == SNMPv3 {
+		respPDU, size, err = w.exchangeV3(ctx, pdu)
+	} else {
+		respPDU, size, err = w.exchangeCommunity(ctx, pdu)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := responseError(respPDU); err != nil {
+		return nil, 0, err
+	}
+	return respPDU, size, nil
+}
 
-		if err = conn.SetWriteDeadline(deadline); err != nil {
-			log.Printf("Couldn't set write deadline. Retrying. Retry %d/%d\n", i, retries)
-			continue
+// exchangeCommunity sends a request PDU in an SNMPv1 or SNMPv2c message and returns the response PDU. Only a
+// GetResponse with the same request ID, version and community is accepted as the response.
+func (w WapSNMP) exchangeCommunity(ctx context.Context, pdu MessagePDU) (*PDU, int, error) {
+	buf := getPacket()
+	defer putPacket(buf)
+	req, err := (&Message{w.Version, w.Community, pdu}).AppendMarshal(*buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	*buf = req
+
+	requestID := pduRequestID(pdu.Sequence())
+	var respPDU *PDU
+	size, err := w.roundTrip(ctx, requestID, req, func(response []byte) error {
+		var msg Message
+		if err := msg.Unmarshal(response); err != nil {
+			return err
 		}
-		if _, err = conn.Write(toSend); err != nil {
-			log.Printf("Couldn't write. Retrying. Retry %d/%d\n", i, retries)
-			continue
+		if msg.Version != w.Version {
+			return fmt.Errorf("response has SNMP version %d, want %d", msg.Version, w.Version)
 		}
-
-		deadline = time.Now().Add(timeout)
-		if err = conn.SetReadDeadline(deadline); err != nil {
-			log.Printf("Couldn't set read deadline. Retrying. Retry %d/%d\n", i, retries)
-			continue
+		if msg.Community != w.Community {
+			return fmt.Errorf("response has community %q, want %q", msg.Community, w.Community)
 		}
-
-		numRead := 0
-		if numRead, err = conn.Read(respondBuffer); err != nil {
-			log.Printf("Couldn't read. Retrying. Retry %d/%d\n", i, retries)
-			continue
+		p, ok := msg.PDU.(*PDU)
+		if !ok || p.Type != AsnGetResponse {
+			return fmt.Errorf("response is not a GetResponse: %v", msg.PDU)
 		}
-
-		return numRead, nil
+		if int64(p.RequestID) != requestID {
+			return fmt.Errorf("response has request ID %d, want %d", p.RequestID, requestID)
+		}
+		respPDU = p
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
 	}
-	return 0, err
+	return respPDU, size, nil
 }
 
-// Get sends an SNMP get request requesting the value for an oid.
-func (w WapSNMP) Get(oid Oid) (interface{}, error) {
-	requestID := RandomRequestID()
-	req, err := EncodeSequence([]interface{}{Sequence, int(w.Version), w.Community,
-		[]interface{}{AsnGetRequest, requestID, 0, 0,
-			[]interface{}{Sequence,
-				[]interface{}{Sequence, oid, nil}}}})
+// request sends a request PDU and returns the varbinds of the response. A non-zero error-status is returned as an
+// SNMPError by exchange.
+func (w WapSNMP) request(ctx context.Context, pdu MessagePDU) ([]SNMPValue, error) {
+	respPDU, _, err := w.exchange(ctx, pdu)
 	if err != nil {
 		return nil, err
 	}
+	return respPDU.VarBinds, nil
+}
 
-	response := make([]byte, bufSize, bufSize)
-	numRead, err := poll(w.conn, req, response, w.retries, w.timeout)
-	if err != nil {
-		return nil, err
+// expectVarbinds checks a response has as many varbinds as the request.
+func expectVarbinds(varbinds []SNMPValue, count int) error {
+	if len(varbinds) != count {
+		return fmt.Errorf("response has %d varbinds, want %d", len(varbinds), count)
 	}
+	return nil
+}
 
-	decodedResponse, err := DecodeSequence(response[:numRead])
+// Get sends an SNMP get request requesting the value for an oid. If the agent has no such object or instance, an
+// *ExceptionError is returned.
+func (w WapSNMP) Get(oid Oid) (interface{}, error) {
+	return w.GetContext(context.Background(), oid)
+}
+
+// GetContext is Get with a context. Cancelling ctx aborts the request.
+func (w WapSNMP) GetContext(ctx context.Context, oid Oid) (interface{}, error) {
+	varbinds, err := w.request(ctx, &PDU{Type: AsnGetRequest, RequestID: RandomRequestID(),
+		VarBinds: []VarBind{{oid, nil}}})
 	if err != nil {
 		return nil, err
 	}
+	if err := expectVarbinds(varbinds, 1); err != nil {
+		return nil, err
+	}
+	if exception, ok := varbinds[0].Value.(BERType); ok && IsException(exception) {
+		return nil, &ExceptionError{Oid: varbinds[0].Oid, Exception: exception}
+	}
 
-	// Fetch the varbinds out of the packet.
-	respPacket := decodedResponse[3].([]interface{})
-	varbinds := respPacket[4].([]interface{})
-	result := varbinds[1].([]interface{})[2]
-
-	return result, nil
+	return varbinds[0].Value, nil
 }
 
-// GetMultiple issues a single GET SNMP request requesting multiple values
+// GetMultiple issues a single GET SNMP request requesting multiple values. The oids the agent has no value for get
+// an exception as value, NoSuchObject or NoSuchInstance, see IsException.
 func (w WapSNMP) GetMultiple(oids []Oid) (map[string]interface{}, error) {
-	requestID := RandomRequestID()
+	return w.GetMultipleContext(context.Background(), oids)
+}
 
-	varbinds := []interface{}{Sequence}
+// GetMultipleContext is GetMultiple with a context. Cancelling ctx aborts the request.
+func (w WapSNMP) GetMultipleContext(ctx context.Context, oids []Oid) (map[string]interface{}, error) {
+	req := &PDU{Type: AsnGetRequest, RequestID: RandomRequestID()}
 	for _, oid := range oids {
-		varbinds = append(varbinds, []interface{}{Sequence, oid, nil})
+		req.VarBinds = append(req.VarBinds, VarBind{oid, nil})
 	}
-	req, err := EncodeSequence([]interface{}{Sequence, int(w.Version), w.Community,
-		[]interface{}{AsnGetRequest, requestID, 0, 0, varbinds}})
-
+	varbinds, err := w.request(ctx, req)
 	if err != nil {
 		return nil, err
 	}
-
-	response := make([]byte, bufSize, bufSize)
-	numRead, err := poll(w.conn, req, response, w.retries, w.timeout)
-	if err != nil {
+	if err := expectVarbinds(varbinds, len(oids)); err != nil {
 		return nil, err
 	}
 
-	decodedResponse, err := DecodeSequence(response[:numRead])
-	if err != nil {
-		return nil, err
-	}
-
-	// Find the varbinds
-	respPacket := decodedResponse[3].([]interface{})
-	respVarbinds := respPacket[4].([]interface{})
-
 	result := make(map[string]interface{})
-	for _, v := range respVarbinds[1:] { // First element is just a sequence
-		oid := v.([]interface{})[1].(Oid).String()
-		value := v.([]interface{})[2]
-		result[oid] = value
+	for _, v := range varbinds {
+		result[v.Oid.String()] = v.Value
 	}
 
 	return result, nil
@@ -156,69 +260,49 @@ func (w WapSNMP) GetMultiple(oids []Oid) (map[string]interface{}, error) {
 
 // Set sends an SNMP set request to change the value associated with an oid.
 func (w WapSNMP) Set(oid Oid, value interface{}) (interface{}, error) {
-	requestID := RandomRequestID()
-	req, err := EncodeSequence([]interface{}{Sequence, int(w.Version), w.Community,
-		[]interface{}{AsnSetRequest, requestID, 0, 0,
-			[]interface{}{Sequence,
-				[]interface{}{Sequence, oid, value}}}})
-	if err != nil {
-		return nil, err
-	}
+	return w.SetContext(context.Background(), oid, value)
+}
 
-	response := make([]byte, bufSize, bufSize)
-	numRead, err := poll(w.conn, req, response, w.retries, w.timeout)
+// SetContext is Set with a context. Cancelling ctx aborts the request.
+func (w WapSNMP) SetContext(ctx context.Context, oid Oid, value interface{}) (interface{}, error) {
+	varbinds, err := w.request(ctx, &PDU{Type: AsnSetRequest, RequestID: RandomRequestID(),
+		VarBinds: []VarBind{{oid, value}}})
 	if err != nil {
 		return nil, err
 	}
-
-	decodedResponse, err := DecodeSequence(response[:numRead])
-	if err != nil {
+	if err := expectVarbinds(varbinds, 1); err != nil {
 		return nil, err
 	}
 
-	// Fetch the varbinds out of the packet.
-	respPacket := decodedResponse[3].([]interface{})
-	varbinds := respPacket[4].([]interface{})
-	result := varbinds[1].([]interface{})[2]
-
-	return result, nil
+	return varbinds[0].Value, nil
 }
 
-// SetMultiple issues a single GET SNMP request requesting multiple values
+// SetMultiple issues a single SET SNMP request setting multiple values
 func (w WapSNMP) SetMultiple(toset map[string]interface{}) (map[string]interface{}, error) {
-	requestID := RandomRequestID()
+	return w.SetMultipleContext(context.Background(), toset)
+}
 
-	varbinds := []interface{}{Sequence}
+// SetMultipleContext is SetMultiple with a context. Cancelling ctx aborts the request.
+func (w WapSNMP) SetMultipleContext(ctx context.Context, toset map[string]interface{}) (map[string]interface{}, error) {
+	req := &PDU{Type: AsnSetRequest, RequestID: RandomRequestID()}
 	for oid, value := range toset {
-		varbinds = append(varbinds, []interface{}{Sequence, oid, value})
-	}
-	req, err := EncodeSequence([]interface{}{Sequence, int(w.Version), w.Community,
-		[]interface{}{AsnGetRequest, requestID, 0, 0, varbinds}})
-
-	if err != nil {
-		return nil, err
+		parsedOid, err := ParseOid(oid)
+		if err != nil {
+			return nil, err
+		}
+		req.VarBinds = append(req.VarBinds, VarBind{parsedOid, value})
 	}
-
-	response := make([]byte, bufSize, bufSize)
-	numRead, err := poll(w.conn, req, response, w.retries, w.timeout)
+	varbinds, err := w.request(ctx, req)
 	if err != nil {
 		return nil, err
 	}
-
-	decodedResponse, err := DecodeSequence(response[:numRead])
-	if err != nil {
+	if err := expectVarbinds(varbinds, len(toset)); err != nil {
 		return nil, err
 	}
 
-	// Find the varbinds
-	respPacket := decodedResponse[3].([]interface{})
-	respVarbinds := respPacket[4].([]interface{})
-
 	result := make(map[string]interface{})
-	for _, v := range respVarbinds[1:] { // First element is just a sequence
-		oid := v.([]interface{})[1].(Oid).String()
-		value := v.([]interface{})[2]
-		result[oid] = value
+	for _, v := range varbinds {
+		result[v.Oid.String()] = v.Value
 	}
 
 	return result, nil
@@ -226,74 +310,46 @@ func (w WapSNMP) SetMultiple(toset map[string]interface{}) (map[string]interface
 
 // GetNext issues a GETNEXT SNMP request.
 func (w WapSNMP) GetNext(oid Oid) (*Oid, interface{}, error) {
-	requestID := RandomRequestID()
-	req, err := EncodeSequence([]interface{}{Sequence, int(w.Version), w.Community,
-		[]interface{}{AsnGetNextRequest, requestID, 0, 0,
-			[]interface{}{Sequence,
-				[]interface{}{Sequence, oid, nil}}}})
-	if err != nil {
-		return nil, nil, err
-	}
+	return w.GetNextContext(context.Background(), oid)
+}
 
-	response := make([]byte, bufSize)
-	numRead, err := poll(w.conn, req, response, w.retries, w.timeout)
+// GetNextContext is GetNext with a context. Cancelling ctx aborts the request.
+func (w WapSNMP) GetNextContext(ctx context.Context, oid Oid) (*Oid, interface{}, error) {
+	varbinds, err := w.request(ctx, &PDU{Type: AsnGetNextRequest, RequestID: RandomRequestID(),
+		VarBinds: []VarBind{{oid, nil}}})
 	if err != nil {
 		return nil, nil, err
 	}
-
-	decodedResponse, err := DecodeSequence(response[:numRead])
-	if err != nil {
+	if err := expectVarbinds(varbinds, 1); err != nil {
 		return nil, nil, err
 	}
 
-	// Find the varbinds
-	respPacket := decodedResponse[3].([]interface{})
-	varbinds := respPacket[4].([]interface{})
-	result := varbinds[1].([]interface{})
-
-	resultOid := result[1].(Oid)
-	resultVal := result[2]
-
-	return &resultOid, resultVal, nil
+	return &varbinds[0].Oid, varbinds[0].Value, nil
 }
 
 // GetBulk is semantically the same as maxRepetitions getnext requests, but in a single GETBULK SNMP packet.
 //
 // Caveat: many devices will silently drop GETBULK requests for more than some number of maxrepetitions, if
-// it doesn't work, try with a lower value and/or use GetTable.
+// it doesn't work, try with a lower value and/or use GetTable, which finds a value that works.
+//
+// Values past the end of the MIB are EndOfMibView, see IsException.
 //
 // Caveat: as codedance (on github) pointed out, iteration order on a map is indeterminate. You can alternatively
 // use GetBulkArray to get the entries as a list, with deterministic iteration order.
 func (w WapSNMP) GetBulk(oid Oid, maxRepetitions int) (map[string]interface{}, error) {
-	requestID := RandomRequestID()
-	req, err := EncodeSequence([]interface{}{Sequence, int(w.Version), w.Community,
-		[]interface{}{AsnGetBulkRequest, requestID, 0, maxRepetitions,
-			[]interface{}{Sequence,
-				[]interface{}{Sequence, oid, nil}}}})
-	if err != nil {
-		return nil, err
-	}
-
-	response := make([]byte, bufSize, bufSize)
-	numRead, err := poll(w.conn, req, response, w.retries, w.timeout)
-	if err != nil {
-		return nil, err
-	}
+	return w.GetBulkContext(context.Background(), oid, maxRepetitions)
+}
 
-	decodedResponse, err := DecodeSequence(response[:numRead])
+// GetBulkContext is GetBulk with a context. Cancelling ctx aborts the request.
+func (w WapSNMP) GetBulkContext(ctx context.Context, oid Oid, maxRepetitions int) (map[string]interface{}, error) {
+	varbinds, err := w.GetBulkArrayContext(ctx, oid, maxRepetitions)
 	if err != nil {
 		return nil, err
 	}
 
-	// Find the varbinds
-	respPacket := decodedResponse[3].([]interface{})
-	respVarbinds := respPacket[4].([]interface{})
-
 	result := make(map[string]interface{})
-	for _, v := range respVarbinds[1:] { // First element is just a sequence
-		oid := v.([]interface{})[1].(Oid).String()
-		value := v.([]interface{})[2]
-		result[oid] = value
+	for _, v := range varbinds {
+		result[v.Oid.String()] = v.Value
 	}
 
 	return result, nil
@@ -302,67 +358,35 @@ func (w WapSNMP) GetBulk(oid Oid, maxRepetitions int) (map[string]interface{}, e
 // GetBulkArray is the same as GetBulk, but returns it's results as a list, for those who want deterministic
 // iteration instead of convenient access.
 func (w WapSNMP) GetBulkArray(oid Oid, maxRepetitions int) ([]SNMPValue, error) {
-	requestID := RandomRequestID()
-	req, err := EncodeSequence([]interface{}{Sequence, int(w.Version), w.Community,
-		[]interface{}{AsnGetBulkRequest, requestID, 0, maxRepetitions,
-			[]interface{}{Sequence,
-				[]interface{}{Sequence, oid, nil}}}})
-	if err != nil {
-		return nil, err
-	}
-
-	response := make([]byte, bufSize, bufSize)
-	numRead, err := poll(w.conn, req, response, w.retries, w.timeout)
-	if err != nil {
-		return nil, err
-	}
-
-	decodedResponse, err := DecodeSequence(response[:numRead])
-	if err != nil {
-		return nil, fmt.Errorf("error during sequence decoding: %v", err)
-	}
-
-	// Find the varbinds
-	respPacket := decodedResponse[3].([]interface{})
-	respVarbinds := respPacket[4].([]interface{})
-
-	result := make([]SNMPValue, 0, len(respVarbinds[1:]))
-	for _, v := range respVarbinds[1:] { // First element is just a sequence
-		oid := v.([]interface{})[1].(Oid)
-		value := v.([]interface{})[2]
-		result = append(result, SNMPValue{oid, value})
-	}
+	return w.GetBulkArrayContext(context.Background(), oid, maxRepetitions)
+}
 
-	return result, nil
+// GetBulkArrayContext is GetBulkArray with a context. Cancelling ctx aborts the request.
+func (w WapSNMP) GetBulkArrayContext(ctx context.Context, oid Oid, maxRepetitions int) ([]SNMPValue, error) {
+	return w.request(ctx, &BulkPDU{RequestID: RandomRequestID(), MaxRepetitions: maxRepetitions,
+		VarBinds: []VarBind{{oid, nil}}})
 }
 
-// GetTable efficiently gets an entire table from an SNMP agent. Uses GETBULK requests to go fast.
+// GetTable efficiently gets an entire table from an SNMP agent. Uses GETBULK requests to go fast, or GETNEXT
+// requests for SNMPv1 agents and when SetWalkStrategy says so. The max-repetitions of the GETBULK requests adapt
+// to the device, see SetMaxRepetitions. If the walk fails, e.g. because it reached the limits set with
+// SetWalkLimits, the values before the error are returned with it.
 func (w WapSNMP) GetTable(oid Oid) (map[string]interface{}, error) {
-	result := make(map[string]interface{})
-	lastOid := oid.Copy()
-	for lastOid.Within(oid) {
-		results, err := w.GetBulkArray(lastOid, 50)
-		if err != nil {
-			return nil, fmt.Errorf("received GetBulk error => %v\n", err)
-		}
-		newLastOid := lastOid.Copy()
-		for _, v := range results {
-			if v.Oid.Within(oid) {
-				result[v.Oid.String()] = v.Value
-			}
-			newLastOid = v.Oid
-		}
+	return w.GetTableContext(context.Background(), oid)
+}
 
-		if reflect.DeepEqual(lastOid, newLastOid) {
-			// Not making any progress ? Assume we reached end of table.
-			break
-		}
-		lastOid = newLastOid
-	}
-	return result, nil
+// GetTableContext is GetTable with a context. Cancelling ctx aborts the
+// request in progress, and stops the walk.
+func (w WapSNMP) GetTableContext(ctx context.Context, oid Oid) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+	err := w.walk(ctx, oid, func(v SNMPValue) bool {
+		result[v.Oid.String()] = v.Value
+		return true
+	})
+	return result, err
 }
 
-// Close the net.conn in WapSNMP.
+// Close the net.conn in WapSNMP. Requests in progress fail.
 func (w WapSNMP) Close() error {
 	return w.conn.Close()
 }
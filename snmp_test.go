@@ -1,129 +1,135 @@
 package wapsnmp
 
 import (
-	"fmt"
+	"context"
+	"encoding/hex"
+	"errors"
 	"math/rand" // Needed to set Seed, so a consistent request ID will be chosen.
+	"net"
+	"strings"
 	"testing"
 	"time"
 )
 
-func ExampleGetTable() {
-	target := "some_host"
-	community := "public"
+func TestGet(t *testing.T) {
+	rand.Seed(0)
+
+	target := "magic_host"
+	community := "[R0_C@cti!]"
 	version := SNMPv2c
 
-	oid := MustParseOid(".1.3.6.1.4.1.2636.3.2.3.1.20")
+	oid := MustParseOid("1.3.6.1.2.1.1.3.0")
+
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	// Expect a UDP SNMP GET packet.
+	udpStub.Expect("302e020101040b5b52305f4340637469215da01c020478fc2ffa020100020100300e300c06082b060102010103000500").AndRespond([]string{"3032020101040b5b52305f4340637469215da220020478fc2ffa0201000201003012301006082b06010201010300430404926fa4"})
 
-	fmt.Printf("Contacting %v %v %v\n", target, community, version)
-	wsnmp, err := NewWapSNMP(target, community, version, 2*time.Second, 5)
+	wsnmp := NewWapSNMPOnConn(target, community, version, 2*time.Second, 5, udpStub)
+	//wsnmp, err := NewWapSNMP(target, community, version, 2*time.Second, 5)
 	defer wsnmp.Close()
-	if err != nil {
-		fmt.Printf("Error creating wsnmp => %v\n", wsnmp)
-		return
-	}
+	val, err := wsnmp.Get(oid)
 
-	table, err := wsnmp.GetTable(oid)
 	if err != nil {
-		fmt.Printf("Error getting table => %v\n", wsnmp)
-		return
+		t.Errorf("Error testing to get a value: %v.", err)
 	}
-	for k, v := range table {
-		fmt.Printf("%v => %v\n", k, v)
+
+	if val != time.Duration(76705700)*10*time.Millisecond {
+		t.Errorf("Received wrong value: %v", val)
 	}
 }
 
-func ExampleGetBulk() {
-	target := "some_host"
-	community := "public"
-	version := SNMPv2c
-
-	oid := MustParseOid(".1.3.6.1.2.1")
+func TestGetDiscardsMismatchedResponses(t *testing.T) {
+	rand.Seed(0)
 
-	fmt.Printf("Contacting %v %v %v\n", target, community, version)
-	wsnmp, err := NewWapSNMP(target, community, version, 2*time.Second, 5)
-	defer wsnmp.Close()
-	if err != nil {
-		fmt.Printf("Error creating wsnmp => %v\n", wsnmp)
-		return
-	}
-	defer wsnmp.Close()
-	for {
-		results, err := wsnmp.GetBulk(oid, 50)
+	community := "[R0_C@cti!]"
+	oid := MustParseOid("1.3.6.1.2.1.1.3.0")
+	respond := func(community string, pduType BERType, requestID int, value interface{}) string {
+		packet, err := EncodeSequence([]interface{}{Sequence, int(SNMPv2c), community,
+			[]interface{}{pduType, requestID, 0, 0, []interface{}{Sequence, []interface{}{Sequence, oid, value}}}})
 		if err != nil {
-			fmt.Printf("GetBulk error => %v\n", err)
-			return
-		}
-		for o, v := range results {
-			fmt.Printf("%v => %v\n", o, v)
-
-			oid = MustParseOid(o)
+			t.Fatalf("error encoding response: %v", err)
 		}
-		/*  Old version without GETBULK
-		    result_oid, val, err := wsnmp.GetNext(oid)
-		    if err != nil {
-		      fmt.Printf("GetNext error => %v\n", err)
-		      return
-		    }
-		    fmt.Printf("GetNext(%v, %v, %v, %v) => %s, %v\n", target, community, version, oid, result_oid, val)
-		    oid = *result_oid
-		*/
+		return hex.EncodeToString(packet)
 	}
-}
-
-func ExampleGet() {
-	target := "some_host"
-	community := "public"
-	version := SNMPv2c
+	request := "302e020101040b5b52305f4340637469215da01c020478fc2ffa020100020100300e300c06082b060102010103000500"
 
-	oids := []Oid{
-		MustParseOid(".1.3.6.1.2.1.1.1.0"),
-		MustParseOid(".1.3.6.1.2.1.1.2.0"),
-		MustParseOid(".1.3.6.1.2.1.2.1.0"),
-	}
-
-	wsnmp, err := NewWapSNMP(target, community, version, 2*time.Second, 5)
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.Expect(request).AndRespond([]string{
+		respond(community, AsnGetResponse, 0x21182cd7, 1), // A late answer to an earlier request.
+		respond("public", AsnGetResponse, 0x78fc2ffa, 2),
+		respond(community, AsnGetRequest, 0x78fc2ffa, 3),
+		respond(community, AsnGetResponse, 0x78fc2ffa, 4),
+	})
+
+	wsnmp := NewWapSNMPOnConn("magic_host", community, SNMPv2c, 2*time.Second, 5, udpStub)
 	defer wsnmp.Close()
+	val, err := wsnmp.Get(oid)
 	if err != nil {
-		fmt.Printf("Error creating wsnmp => %v\n", wsnmp)
-		return
+		t.Errorf("Error testing to get a value: %v.", err)
 	}
-
-	for _, oid := range oids {
-		val, err := wsnmp.Get(oid)
-		fmt.Printf("Getting %v\n", oid)
-		if err != nil {
-			fmt.Printf("Get error => %v\n", err)
-			return
-		}
-		fmt.Printf("Get(%v, %v, %v, %v) => %v\n", target, community, version, oid, val)
+	if val != int64(4) {
+		t.Errorf("Received wrong value: %v", val)
 	}
-}
 
-func TestGet(t *testing.T) {
+	// Without a matching response, the request fails.
 	rand.Seed(0)
-
-	target := "magic_host"
-	community := "[R0_C@cti!]"
-	version := SNMPv2c
-
-	oid := MustParseOid("1.3.6.1.2.1.1.3.0")
-
-	udpStub := NewUdpStub(t)
+	udpStub = NewUdpStub(t)
 	defer udpStub.CheckClosed()
-	// Expect a UDP SNMP GET packet.
-	udpStub.Expect("302e020101040b5b52305f4340637469215da01c020478fc2ffa020100020100300e300c06082b060102010103000500").AndRespond([]string{"3032020101040b5b52305f4340637469215da220020421182cd70201000201003012301006082b06010201010300430404926fa4"})
-
-	wsnmp := NewWapSNMPOnConn(target, community, version, 2*time.Second, 5, udpStub)
-	//wsnmp, err := NewWapSNMP(target, community, version, 2*time.Second, 5)
+	udpStub.Expect(request).AndRespond([]string{respond(community, AsnGetResponse, 0x21182cd7, 1)})
+	wsnmp = NewWapSNMPOnConn("magic_host", community, SNMPv2c, 10*time.Millisecond, 0, udpStub)
 	defer wsnmp.Close()
-	val, err := wsnmp.Get(oid)
+	if val, err := wsnmp.Get(oid); err == nil || !strings.Contains(err.Error(), "discarded response") {
+		t.Errorf("Get() with a stale response returned %v, %v, want a discarded response error", val, err)
+	}
+}
 
-	if err != nil {
-		t.Errorf("Error testing to get a value: %v.", err)
+func TestMalformedResponses(t *testing.T) {
+	community := "[R0_C@cti!]"
+	oid := MustParseOid("1.3.6.1.2.1.1.3.0")
+	request := "302e020101040b5b52305f4340637469215da01c020478fc2ffa020100020100300e300c06082b060102010103000500"
+	requestID := 0x78fc2ffa
+	varbind := []interface{}{Sequence, oid, 1}
+
+	tests := []struct {
+		name    string
+		message []interface{}
+	}{
+		{"no varbinds", []interface{}{Sequence, int(SNMPv2c), community,
+			[]interface{}{AsnGetResponse, requestID, 0, 0, []interface{}{Sequence}}}},
+		{"two varbinds", []interface{}{Sequence, int(SNMPv2c), community,
+			[]interface{}{AsnGetResponse, requestID, 0, 0, []interface{}{Sequence, varbind, varbind}}}},
+		{"varbind not a sequence", []interface{}{Sequence, int(SNMPv2c), community,
+			[]interface{}{AsnGetResponse, requestID, 0, 0, []interface{}{Sequence, 5}}}},
+		{"varbind without value", []interface{}{Sequence, int(SNMPv2c), community,
+			[]interface{}{AsnGetResponse, requestID, 0, 0, []interface{}{Sequence, []interface{}{Sequence, oid}}}}},
+		{"varbind name not an oid", []interface{}{Sequence, int(SNMPv2c), community,
+			[]interface{}{AsnGetResponse, requestID, 0, 0, []interface{}{Sequence, []interface{}{Sequence, "x", 1}}}}},
+		{"varbind list not a sequence", []interface{}{Sequence, int(SNMPv2c), community,
+			[]interface{}{AsnGetResponse, requestID, 0, 0, 5}}},
+		{"no varbind list", []interface{}{Sequence, int(SNMPv2c), community,
+			[]interface{}{AsnGetResponse, requestID, 0, 0}}},
+		{"error-status not an integer", []interface{}{Sequence, int(SNMPv2c), community,
+			[]interface{}{AsnGetResponse, requestID, "x", 0, []interface{}{Sequence, varbind}}}},
+		{"PDU not a sequence", []interface{}{Sequence, int(SNMPv2c), community, 5}},
+		{"extra message element", []interface{}{Sequence, int(SNMPv2c), community,
+			[]interface{}{AsnGetResponse, requestID, 0, 0, []interface{}{Sequence, varbind}}, 5}},
 	}
 
-	if val != time.Duration(76705700)*10*time.Millisecond {
-		t.Errorf("Received wrong value: %v", val)
+	for _, test := range tests {
+		rand.Seed(0)
+		packet, err := EncodeSequence(test.message)
+		if err != nil {
+			t.Fatalf("%s: error encoding response: %v", test.name, err)
+		}
+		udpStub := NewUdpStub(t)
+		udpStub.Expect(request).AndRespond([]string{hex.EncodeToString(packet)})
+		wsnmp := NewWapSNMPOnConn("magic_host", community, SNMPv2c, 10*time.Millisecond, 0, udpStub)
+		if val, err := wsnmp.Get(oid); err == nil {
+			t.Errorf("%s: Get() returned %v, want an error", test.name, val)
+		}
+		wsnmp.Close()
 	}
 }
 
@@ -139,7 +145,7 @@ func TestGetTable(t *testing.T) {
 	udpStub := NewUdpStub(t)
 	defer udpStub.CheckClosed()
 	// Expect a UDP SNMP GETBULK packet.
-	udpStub.Expect("3033020101040f6578616d706c636f6d6d756e697479a51d020478fc2ffa020100020132300f300d06092b06010201020201150500").AndRespond([]string{"3082039c020101040f6578616d706c636f6d6d756e697479a282038402046a4eef7a020100020100308203743010060b2b060102010202011585064201003010060b2b060102010202011585074201003010060b2b060102010202011585084201003010060b2b060102010202011585094201003010060b2b0601020102020115850a4201003010060b2b0601020102020115850b4201003010060b2b0601020102020115850c4201003010060b2b0601020102020115850d4201003010060b2b0601020102020115850e4201003010060b2b0601020102020115850f4201003010060b2b060102010202011585104201003010060b2b060102010202011585114201003010060b2b060102010202011585124201003010060b2b060102010202011585134201003010060b2b060102010202011585144201003010060b2b060102010202011585154201003010060b2b060102010202011585164201003010060b2b060102010202011585174201003010060b2b060102010202011585184201003010060b2b060102010202011585194201003010060b2b0601020102020115851a4201003010060b2b0601020102020115851b4201003010060b2b0601020102020115851c4201003010060b2b0601020102020115851d4201003010060b2b0601020102020115851e4201003010060b2b0601020102020115851f4201003010060b2b060102010202011585204201003010060b2b060102010202011585214201003010060b2b060102010202011585224201003010060b2b060102010202011585234201003010060b2b060102010202011585244201003010060b2b060102010202011585254201003010060b2b060102010202011585264201003010060b2b06010201020201158527420100300f060a2b060102010202011601060100300f060a2b060102010202011604060100300f060a2b060102010202011605060100300f060a2b060102010202011606060100300f060a2b060102010202011607060100300f060a2b060102010202011608060100300f060a2b060102010202011609060100300f060a2b06010201020201160a060100300f060a2b06010201020201160b060100300f060a2b06010201020201160c060100300f060a2b06010201020201160d060100300f060a2b060102010202011610060100300f060a2b060102010202011611060100300f060a2b060102010202011612060100300f060a2b060102010202011615060100300f060a2b060102010202011616060100"})
+	udpStub.Expect("3033020101040f6578616d706c636f6d6d756e697479a51d020478fc2ffa020100020132300f300d06092b06010201020201150500").AndRespond([]string{"3082039c020101040f6578616d706c636f6d6d756e697479a2820384020478fc2ffa020100020100308203743010060b2b060102010202011585064201003010060b2b060102010202011585074201003010060b2b060102010202011585084201003010060b2b060102010202011585094201003010060b2b0601020102020115850a4201003010060b2b0601020102020115850b4201003010060b2b0601020102020115850c4201003010060b2b0601020102020115850d4201003010060b2b0601020102020115850e4201003010060b2b0601020102020115850f4201003010060b2b060102010202011585104201003010060b2b060102010202011585114201003010060b2b060102010202011585124201003010060b2b060102010202011585134201003010060b2b060102010202011585144201003010060b2b060102010202011585154201003010060b2b060102010202011585164201003010060b2b060102010202011585174201003010060b2b060102010202011585184201003010060b2b060102010202011585194201003010060b2b0601020102020115851a4201003010060b2b0601020102020115851b4201003010060b2b0601020102020115851c4201003010060b2b0601020102020115851d4201003010060b2b0601020102020115851e4201003010060b2b0601020102020115851f4201003010060b2b060102010202011585204201003010060b2b060102010202011585214201003010060b2b060102010202011585224201003010060b2b060102010202011585234201003010060b2b060102010202011585244201003010060b2b060102010202011585254201003010060b2b060102010202011585264201003010060b2b06010201020201158527420100300f060a2b060102010202011601060100300f060a2b060102010202011604060100300f060a2b060102010202011605060100300f060a2b060102010202011606060100300f060a2b060102010202011607060100300f060a2b060102010202011608060100300f060a2b060102010202011609060100300f060a2b06010201020201160a060100300f060a2b06010201020201160b060100300f060a2b06010201020201160c060100300f060a2b06010201020201160d060100300f060a2b060102010202011610060100300f060a2b060102010202011611060100300f060a2b060102010202011612060100300f060a2b060102010202011615060100300f060a2b060102010202011616060100"})
 
 	wsnmp := NewWapSNMPOnConn(target, community, version, 2*time.Second, 5, udpStub)
 	defer wsnmp.Close()
@@ -159,3 +165,67 @@ func TestGetTable(t *testing.T) {
 		t.Errorf("Expected a zero value in this table request, got %v", val["1.3.6.1.2.1.2.2.1.21.646"])
 	}
 }
+
+func TestGetContext(t *testing.T) {
+	// An agent that never answers.
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error creating socket: %v", err)
+	}
+	defer silent.Close()
+	conn, err := net.Dial("udp", silent.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	wsnmp := NewWapSNMPOnConn("localhost", "public", SNMPv2c, 10*time.Second, 2, conn)
+	defer wsnmp.Close()
+	oid := MustParseOid(".1.3.6.1.2.1.1.1.0")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := wsnmp.GetContext(ctx, oid); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetContext() with a cancelled context returned %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("GetContext() took %v to notice the cancellation", elapsed)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := wsnmp.GetBulkArrayContext(ctx, oid, 10); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetBulkArrayContext() past the deadline returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestGetTableContext(t *testing.T) {
+	a, wsnmp := startTestAgent(t, "public", SNMPv2c)
+	defer a.Close()
+	defer wsnmp.Close()
+	ifDescr := MustParseOid(".1.3.6.1.2.1.2.2.1.2")
+
+	table, err := wsnmp.GetTableContext(context.Background(), ifDescr)
+	if err != nil || len(table) != 2 {
+		t.Errorf("GetTableContext() => %v, %v, want 2 entries", table, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := wsnmp.GetTableContext(ctx, ifDescr); err != context.Canceled {
+		t.Errorf("GetTableContext() with a cancelled context returned %v, want %v", err, context.Canceled)
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	a, wsnmp := startTestAgent(b, "public", SNMPv2c)
+	defer a.Close()
+	defer wsnmp.Close()
+	oid := MustParseOid(".1.3.6.1.2.1.1.1.0")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := wsnmp.Get(oid); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,480 @@
+package wapsnmp
+
+/* This file implements an AgentX sub-agent, which serves parts of the MIB
+   through a master agent such as net-snmp's snmpd.
+
+   References : RFC 2741 section 7 (elements of procedure).
+*/
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// SubAgent is an AgentX sub-agent. It opens a session with a master agent,
+// registers subtrees with it, and answers the requests the master agent
+// forwards using the same Handlers an Agent uses.
+type SubAgent struct {
+	mib       *Agent // Holds the registered handlers.
+	conn      net.Conn
+	timeout   time.Duration
+	sessionID uint32
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	// The following are protected by mu.
+	packetID uint32
+	pending  map[uint32]chan *agentxPDU
+	closing  bool
+	err      error
+
+	setVarbinds []SNMPValue // The varbinds of the Set being processed.
+	done        chan struct{}
+	finishOnce  sync.Once
+}
+
+// DialSubAgent connects to a master agent, e.g. ("unix",
+// "/var/agentx/master") or ("tcp", "localhost:705"), and opens a session.
+// id identifies the sub-agent and description describes it. timeout is how
+// long to wait for the master agent, and is also passed to it, in whole
+// seconds from 1 to 255, as the time the master agent should wait for the
+// sub-agent.
+func DialSubAgent(network, address string, id Oid, description string, timeout time.Duration) (*SubAgent, error) {
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, fmt.Errorf(`error connecting to ("%s", "%s"): %s`, network, address, err)
+	}
+	s, err := NewSubAgentOnConn(conn, id, description, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewSubAgentOnConn opens a session with a master agent over an existing
+// connection.
+func NewSubAgentOnConn(conn net.Conn, id Oid, description string, timeout time.Duration) (*SubAgent, error) {
+	if timeout < time.Second || timeout > 255*time.Second {
+		return nil, fmt.Errorf("timeout %v is outside the 1s to 255s AgentX allows", timeout)
+	}
+	s := &SubAgent{
+		mib:     NewAgentOnConn(nil, "", ""),
+		conn:    conn,
+		timeout: timeout,
+		pending: make(map[uint32]chan *agentxPDU),
+		done:    make(chan struct{}),
+	}
+
+	// Nothing else happens on the connection until the session is open, so
+	// wait for the response here.
+	e := newAgentXEncoder()
+	e.buf = append(e.buf, byte(timeout/time.Second), 0, 0, 0)
+	if err := e.oid(id, false); err != nil {
+		return nil, err
+	}
+	e.octetString(description)
+	open := &agentxPDU{pduType: agentxOpen, packetID: s.nextPacketID(), payload: e.buf}
+	if err := s.write(open); err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	response, err := readAgentXPDU(conn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening AgentX session: %v", err)
+	}
+	if err := checkAgentXResponse(open, response); err != nil {
+		return nil, fmt.Errorf("error opening AgentX session: %w", err)
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	s.sessionID = response.sessionID
+
+	go s.serve()
+	return s, nil
+}
+
+// Register makes handler serve the subtree of the MIB below subtree, and
+// registers the subtree with the master agent.
+func (s *SubAgent) Register(subtree Oid, handler Handler) error {
+	// Register the handler first, the master agent may forward requests as
+	// soon as it has accepted the registration.
+	s.mib.Register(subtree, handler)
+
+	e := newAgentXEncoder()
+	// timeout 0 uses the session's, the default priority of 127, and no
+	// range_subid.
+	e.buf = append(e.buf, 0, 127, 0, 0)
+	if err := e.oid(subtree, false); err != nil {
+		s.mib.unregister(subtree)
+		return err
+	}
+	if _, err := s.request(agentxRegister, e.buf); err != nil {
+		s.mib.unregister(subtree)
+		return fmt.Errorf("error registering %v: %w", subtree, err)
+	}
+	return nil
+}
+
+// RegisterScalar serves the scalar object oid, whose only instance is oid.0.
+// get is called for every request. If set is nil the object is read-only.
+func (s *SubAgent) RegisterScalar(oid Oid, get func() interface{}, set func(value interface{}) error) error {
+	return s.Register(oid, &scalarHandler{append(oid.Copy(), 0), get, set})
+}
+
+// RegisterTable serves a conceptual table below entry, the oid of its
+// xxxEntry object. Set requests are accepted if table is a WritableTable.
+func (s *SubAgent) RegisterTable(entry Oid, table Table) error {
+	return s.Register(entry, &tableHandler{entry.Copy(), table})
+}
+
+// Wait blocks until the session ends. Returns nil if it was ended by Close,
+// or the reason it ended otherwise, e.g. because the master agent closed it.
+func (s *SubAgent) Wait() error {
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close closes the session with the master agent, and the connection.
+func (s *SubAgent) Close() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	s.mu.Lock()
+	closing := s.closing
+	s.closing = true
+	s.mu.Unlock()
+	if closing {
+		return nil
+	}
+
+	_, err := s.request(agentxClose, []byte{agentxReasonShutdown, 0, 0, 0})
+	s.finish(nil)
+	return err
+}
+
+// nextPacketID returns the packet ID for a new request.
+func (s *SubAgent) nextPacketID() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packetID++
+	return s.packetID
+}
+
+func (s *SubAgent) write(p *agentxPDU) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.conn.SetWriteDeadline(time.Now().Add(s.timeout)); err != nil {
+		return err
+	}
+	_, err := s.conn.Write(p.encode())
+	return err
+}
+
+// request sends a PDU to the master agent and waits for the response.
+func (s *SubAgent) request(pduType byte, payload []byte) (*agentxPDU, error) {
+	p := &agentxPDU{pduType: pduType, sessionID: s.sessionID, packetID: s.nextPacketID(), payload: payload}
+	responses := make(chan *agentxPDU, 1)
+	s.mu.Lock()
+	s.pending[p.packetID] = responses
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, p.packetID)
+		s.mu.Unlock()
+	}()
+
+	if err := s.write(p); err != nil {
+		return nil, err
+	}
+	select {
+	case response := <-responses:
+		return response, checkAgentXResponse(p, response)
+	case <-s.done:
+		return nil, errors.New("AgentX session closed")
+	case <-time.After(s.timeout):
+		return nil, fmt.Errorf("timed out waiting for the master agent after %v", s.timeout)
+	}
+}
+
+// checkAgentXResponse checks whether response is a successful response to
+// request.
+func checkAgentXResponse(request, response *agentxPDU) error {
+	if response.pduType != agentxResponse || response.packetID != request.packetID {
+		return fmt.Errorf("unexpected AgentX PDU type %d packet ID %d", response.pduType, response.packetID)
+	}
+	d := response.decoder()
+	if _, err := d.uint32(); err != nil { // sysUpTime
+		return err
+	}
+	resError, err := d.uint16()
+	if err != nil {
+		return err
+	}
+	if resError != 0 {
+		return AgentXError(resError)
+	}
+	return nil
+}
+
+// finish ends the session, recording err as the reason unless Close was
+// called.
+func (s *SubAgent) finish(err error) {
+	s.finishOnce.Do(func() {
+		s.mu.Lock()
+		if !s.closing {
+			s.err = err
+		}
+		s.mu.Unlock()
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+// serve reads PDUs from the master agent until the session ends.
+func (s *SubAgent) serve() {
+	for {
+		p, err := readAgentXPDU(s.conn)
+		if err != nil {
+			s.finish(fmt.Errorf("error reading from the master agent: %v", err))
+			return
+		}
+
+		switch p.pduType {
+		case agentxResponse:
+			s.mu.Lock()
+			responses, ok := s.pending[p.packetID]
+			s.mu.Unlock()
+			if ok {
+				select {
+				case responses <- p:
+				default:
+					// A duplicate response.
+				}
+			}
+			continue
+		case agentxClose:
+			reason := byte(0)
+			if len(p.payload) > 0 {
+				reason = p.payload[0]
+			}
+			s.finish(fmt.Errorf("AgentX session closed by the master agent, reason %d", reason))
+			return
+		case agentxCleanupSet:
+			// The Set is over, there is no response to this.
+			s.setVarbinds = nil
+			continue
+		}
+
+		if err := s.write(s.handle(p)); err != nil {
+			s.finish(fmt.Errorf("error writing to the master agent: %v", err))
+			return
+		}
+	}
+}
+
+// handle answers a request forwarded by the master agent.
+func (s *SubAgent) handle(p *agentxPDU) *agentxPDU {
+	var varbinds []SNMPValue
+	var resError, index int
+	var err error
+	s.mib.mu.RLock()
+	switch {
+	case p.context != "":
+		resError = agentxUnsupportedContext
+	case p.pduType == agentxGet:
+		varbinds, err = s.get(p.decoder())
+	case p.pduType == agentxGetNext:
+		varbinds, err = s.getNext(p.decoder())
+	case p.pduType == agentxGetBulk:
+		varbinds, err = s.getBulk(p.decoder())
+	case p.pduType == agentxTestSet:
+		resError, index, err = s.testSet(p.decoder())
+	case p.pduType == agentxCommitSet:
+		resError, index = s.commitSet()
+	case p.pduType == agentxUndoSet:
+		// Handlers can't undo a Set.
+		resError = int(UndoFailed)
+	default:
+		resError = agentxParseError
+	}
+	s.mib.mu.RUnlock()
+	if err != nil {
+		resError, index, varbinds = int(GenErr), 0, nil
+		var status ErrorStatus
+		if errors.As(err, &status) {
+			resError = int(status)
+		} else if errors.Is(err, errAgentXParse) {
+			resError = agentxParseError
+		}
+	}
+
+	e := newAgentXEncoder()
+	e.uint32(uint32(time.Since(startTime) / (10 * time.Millisecond)))
+	e.uint16(uint16(resError))
+	e.uint16(uint16(index))
+	for idx, v := range varbinds {
+		if err := e.varbind(v); err != nil {
+			// A handler returned a value that can't be encoded.
+			e.buf = e.buf[:4]
+			e.uint16(uint16(GenErr))
+			e.uint16(uint16(idx + 1))
+			break
+		}
+	}
+	return &agentxPDU{pduType: agentxResponse, sessionID: p.sessionID, transactionID: p.transactionID,
+		packetID: p.packetID, payload: e.buf}
+}
+
+func (s *SubAgent) get(d *agentxDecoder) ([]SNMPValue, error) {
+	ranges, err := d.searchRanges()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]SNMPValue, 0, len(ranges))
+	for _, r := range ranges {
+		value := interface{}(NoSuchObject)
+		if handler := s.mib.lookup(r.start); handler != nil {
+			if value, err = handler.Get(r.start); err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, SNMPValue{r.start, value})
+	}
+	return result, nil
+}
+
+// next returns the first instance within a search range, or EndOfMibView.
+func (s *SubAgent) next(r agentxSearchRange) (SNMPValue, error) {
+	if r.include {
+		if handler := s.mib.lookup(r.start); handler != nil {
+			value, err := handler.Get(r.start)
+			if err != nil {
+				return SNMPValue{}, err
+			}
+			if value != NoSuchObject && value != NoSuchInstance && value != EndOfMibView {
+				return SNMPValue{r.start, value}, nil
+			}
+		}
+	}
+	result, err := s.mib.next(r.start, SNMPv2c)
+	if err != nil {
+		return SNMPValue{}, err
+	}
+	if result.Value == EndOfMibView || (r.end != nil && result.Oid.Compare(r.end) >= 0) {
+		return SNMPValue{r.start, EndOfMibView}, nil
+	}
+	return result, nil
+}
+
+func (s *SubAgent) getNext(d *agentxDecoder) ([]SNMPValue, error) {
+	ranges, err := d.searchRanges()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]SNMPValue, 0, len(ranges))
+	for _, r := range ranges {
+		v, err := s.next(r)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+func (s *SubAgent) getBulk(d *agentxDecoder) ([]SNMPValue, error) {
+	nonRepeaters, err := d.uint16()
+	if err != nil {
+		return nil, err
+	}
+	maxRepetitions, err := d.uint16()
+	if err != nil {
+		return nil, err
+	}
+	ranges, err := d.searchRanges()
+	if err != nil {
+		return nil, err
+	}
+	if int(nonRepeaters) > len(ranges) {
+		nonRepeaters = uint16(len(ranges))
+	}
+
+	var result []SNMPValue
+	for _, r := range ranges[:nonRepeaters] {
+		v, err := s.next(r)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, v)
+	}
+	// The repeaters are answered interleaved, like Agent does.
+	repeaters := append([]agentxSearchRange{}, ranges[nonRepeaters:]...)
+	for rep := 0; rep < int(maxRepetitions) && len(repeaters) > 0; rep++ {
+		atEnd := true
+		for idx, r := range repeaters {
+			v, err := s.next(r)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, v)
+			repeaters[idx] = agentxSearchRange{v.Oid, false, r.end}
+			if v.Value != EndOfMibView {
+				atEnd = false
+			}
+		}
+		if atEnd {
+			break
+		}
+	}
+	return result, nil
+}
+
+// testSet remembers the varbinds of a Set, and tests them with handlers
+// implementing SetTester.
+func (s *SubAgent) testSet(d *agentxDecoder) (int, int, error) {
+	s.setVarbinds = nil
+	for len(d.buf) > 0 {
+		v, err := d.varbind()
+		if err != nil {
+			return 0, 0, err
+		}
+		s.setVarbinds = append(s.setVarbinds, v)
+	}
+	for idx, v := range s.setVarbinds {
+		handler := s.mib.lookup(v.Oid)
+		if handler == nil {
+			return int(NotWritable), idx + 1, nil
+		}
+		if tester, ok := handler.(SetTester); ok {
+			if err := tester.TestSet(v.Oid, v.Value); err != nil {
+				return int(setErrorStatus(err)), idx + 1, nil
+			}
+		}
+	}
+	return 0, 0, nil
+}
+
+// commitSet sets the varbinds of the tested Set.
+func (s *SubAgent) commitSet() (int, int) {
+	for idx, v := range s.setVarbinds {
+		handler := s.mib.lookup(v.Oid)
+		if handler == nil {
+			return int(CommitFailed), idx + 1
+		}
+		if err := handler.Set(v.Oid, v.Value); err != nil {
+			return int(CommitFailed), idx + 1
+		}
+	}
+	return 0, 0
+}
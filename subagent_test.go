@@ -0,0 +1,314 @@
+package wapsnmp
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeMaster is a minimal AgentX master agent, standing in for snmpd.
+type fakeMaster struct {
+	t        *testing.T
+	listener net.Listener
+	conn     net.Conn
+	packetID uint32
+}
+
+// startFakeMaster listens on a Unix socket for a sub-agent.
+func startFakeMaster(t *testing.T) *fakeMaster {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "master"))
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	return &fakeMaster{t: t, listener: l}
+}
+
+func (m *fakeMaster) Close() {
+	m.listener.Close()
+	if m.conn != nil {
+		m.conn.Close()
+	}
+}
+
+// accept accepts a sub-agent, and answers its Open and the given number of
+// Registers, the last one with resError.
+func (m *fakeMaster) accept(registrations int, resError int) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			result <- err
+			return
+		}
+		m.conn = conn
+		for i := 0; i <= registrations; i++ {
+			p, err := readAgentXPDU(conn)
+			if err != nil {
+				result <- err
+				return
+			}
+			want := agentxRegister
+			if i == 0 {
+				want = agentxOpen
+			}
+			if p.pduType != want {
+				result <- errors.New("unexpected PDU type")
+				return
+			}
+			status := 0
+			if i == registrations {
+				status = resError
+			}
+			m.respond(p, 42, status)
+		}
+		result <- nil
+	}()
+	return result
+}
+
+// respond sends a Response PDU without varbinds.
+func (m *fakeMaster) respond(p *agentxPDU, sessionID uint32, resError int) {
+	e := newAgentXEncoder()
+	e.uint32(0)
+	e.uint16(uint16(resError))
+	e.uint16(0)
+	m.conn.Write((&agentxPDU{pduType: agentxResponse, sessionID: sessionID, packetID: p.packetID, payload: e.buf}).encode())
+}
+
+// request sends a request to the sub-agent, and returns the res.error,
+// res.index and varbinds of the response.
+func (m *fakeMaster) request(pduType byte, payload []byte) (int, int, []SNMPValue) {
+	m.t.Helper()
+	m.packetID++
+	if _, err := m.conn.Write((&agentxPDU{pduType: pduType, sessionID: 42, transactionID: m.packetID,
+		packetID: m.packetID, payload: payload}).encode()); err != nil {
+		m.t.Fatalf("error sending request: %v", err)
+	}
+	m.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	p, err := readAgentXPDU(m.conn)
+	if err != nil {
+		m.t.Fatalf("error reading response: %v", err)
+	}
+	if p.pduType != agentxResponse || p.packetID != m.packetID || p.sessionID != 42 {
+		m.t.Fatalf("got PDU %+v, want response to packet %d", p, m.packetID)
+	}
+	d := p.decoder()
+	d.uint32()
+	resError, _ := d.uint16()
+	index, _ := d.uint16()
+	var varbinds []SNMPValue
+	for len(d.buf) > 0 {
+		v, err := d.varbind()
+		if err != nil {
+			m.t.Fatalf("error decoding varbind: %v", err)
+		}
+		varbinds = append(varbinds, v)
+	}
+	return int(resError), int(index), varbinds
+}
+
+// searchRanges encodes a SearchRangeList, pairs of start and end oids.
+func searchRanges(include bool, oids ...Oid) []byte {
+	e := newAgentXEncoder()
+	for idx := 0; idx+1 < len(oids); idx += 2 {
+		e.oid(oids[idx], include)
+		e.oid(oids[idx+1], false)
+	}
+	return e.buf
+}
+
+// startTestSubAgent connects a sub-agent serving sysDescr.0, a writable
+// sysContact.0 and ifTable to a fake master.
+func startTestSubAgent(t *testing.T) (*fakeMaster, *SubAgent) {
+	m := startFakeMaster(t)
+	setup := m.accept(3, 0)
+	s, err := DialSubAgent("unix", m.listener.Addr().String(), MustParseOid(".1.3.6.1.4.1.8072"), "test", time.Second)
+	if err != nil {
+		m.Close()
+		t.Fatalf("DialSubAgent() returned error %v", err)
+	}
+
+	contact := "nobody"
+	errs := []error{
+		s.RegisterScalar(MustParseOid(".1.3.6.1.2.1.1.1"), func() interface{} { return "test agent" }, nil),
+		s.RegisterScalar(MustParseOid(".1.3.6.1.2.1.1.4"), func() interface{} { return contact },
+			func(value interface{}) error {
+				contact = value.(string)
+				return nil
+			}),
+		s.RegisterTable(MustParseOid(".1.3.6.1.2.1.2.2.1"), &testIfTable{map[int]string{1: "lo", 2: "eth0"}}),
+	}
+	for _, err := range append(errs, <-setup) {
+		if err != nil {
+			s.Close()
+			m.Close()
+			t.Fatalf("error setting up sub-agent: %v", err)
+		}
+	}
+	return m, s
+}
+
+func TestSubAgentGet(t *testing.T) {
+	m, s := startTestSubAgent(t)
+	defer s.Close()
+	defer m.Close()
+
+	resError, _, got := m.request(agentxGet, searchRanges(false,
+		MustParseOid(".1.3.6.1.2.1.1.1.0"), nil,
+		MustParseOid(".1.3.6.1.2.1.1.1.1"), nil,
+		MustParseOid(".1.3.6.1.2.1.1.2.0"), nil))
+	want := []SNMPValue{
+		{MustParseOid(".1.3.6.1.2.1.1.1.0"), "test agent"},
+		{MustParseOid(".1.3.6.1.2.1.1.1.1"), NoSuchInstance},
+		{MustParseOid(".1.3.6.1.2.1.1.2.0"), NoSuchObject},
+	}
+	if resError != 0 || !reflect.DeepEqual(got, want) {
+		t.Errorf("Get returned %d, %v, want %v", resError, got, want)
+	}
+
+	resError, _, got = m.request(agentxGetNext, searchRanges(false,
+		MustParseOid(".1.3.6.1.2.1.2.2.1.1"), MustParseOid(".1.3.6.1.2.1.2.2.1.2"),
+		MustParseOid(".1.3.6.1.2.1.2.2.1.1.2"), MustParseOid(".1.3.6.1.2.1.2.2.1.2"),
+		MustParseOid(".1.3.6.1.2.1.2.2.1.2.2"), nil))
+	want = []SNMPValue{
+		{MustParseOid(".1.3.6.1.2.1.2.2.1.1.1"), int64(1)},
+		// The next instance is outside the search range.
+		{MustParseOid(".1.3.6.1.2.1.2.2.1.1.2"), EndOfMibView},
+		{MustParseOid(".1.3.6.1.2.1.2.2.1.2.2"), EndOfMibView},
+	}
+	if resError != 0 || !reflect.DeepEqual(got, want) {
+		t.Errorf("GetNext returned %d, %v, want %v", resError, got, want)
+	}
+
+	// With include set, the start of the range itself is returned.
+	resError, _, got = m.request(agentxGetNext, searchRanges(true, MustParseOid(".1.3.6.1.2.1.1.1.0"), nil))
+	want = []SNMPValue{{MustParseOid(".1.3.6.1.2.1.1.1.0"), "test agent"}}
+	if resError != 0 || !reflect.DeepEqual(got, want) {
+		t.Errorf("GetNext with include returned %d, %v, want %v", resError, got, want)
+	}
+
+	e := newAgentXEncoder()
+	e.uint16(0) // non_repeaters
+	e.uint16(3) // max_repetitions
+	e.buf = append(e.buf, searchRanges(false, MustParseOid(".1.3.6.1.2.1.2.2.1.2"), nil)...)
+	resError, _, got = m.request(agentxGetBulk, e.buf)
+	want = []SNMPValue{
+		{MustParseOid(".1.3.6.1.2.1.2.2.1.2.1"), "lo"},
+		{MustParseOid(".1.3.6.1.2.1.2.2.1.2.2"), "eth0"},
+		{MustParseOid(".1.3.6.1.2.1.2.2.1.2.2"), EndOfMibView},
+	}
+	if resError != 0 || !reflect.DeepEqual(got, want) {
+		t.Errorf("GetBulk returned %d, %v, want %v", resError, got, want)
+	}
+}
+
+func TestSubAgentSet(t *testing.T) {
+	m, s := startTestSubAgent(t)
+	defer s.Close()
+	defer m.Close()
+
+	sysContact := MustParseOid(".1.3.6.1.2.1.1.4.0")
+	e := newAgentXEncoder()
+	e.varbind(SNMPValue{sysContact, "admin"})
+	if resError, _, _ := m.request(agentxTestSet, e.buf); resError != 0 {
+		t.Fatalf("TestSet returned error %d", resError)
+	}
+	if resError, _, _ := m.request(agentxCommitSet, nil); resError != 0 {
+		t.Fatalf("CommitSet returned error %d", resError)
+	}
+	m.conn.Write((&agentxPDU{pduType: agentxCleanupSet, sessionID: 42}).encode())
+
+	_, _, got := m.request(agentxGet, searchRanges(false, sysContact, nil))
+	if len(got) != 1 || got[0].Value != "admin" {
+		t.Errorf("got %v after set, want admin", got)
+	}
+
+	// sysDescr.0 is read-only, and the table refuses integers.
+	e = newAgentXEncoder()
+	e.varbind(SNMPValue{MustParseOid(".1.3.6.1.2.1.1.1.0"), "x"})
+	if resError, index, _ := m.request(agentxTestSet, e.buf); resError != int(NotWritable) || index != 1 {
+		t.Errorf("TestSet of sysDescr.0 returned error %d index %d, want notWritable", resError, index)
+	}
+	e = newAgentXEncoder()
+	e.varbind(SNMPValue{sysContact, "admin"})
+	e.varbind(SNMPValue{MustParseOid(".1.3.6.1.2.1.2.2.1.2.1"), 1})
+	if resError, _, _ := m.request(agentxTestSet, e.buf); resError != 0 {
+		t.Errorf("TestSet returned error %d", resError)
+	}
+	if resError, index, _ := m.request(agentxCommitSet, nil); resError != int(CommitFailed) || index != 2 {
+		t.Errorf("CommitSet returned error %d index %d, want commitFailed at 2", resError, index)
+	}
+}
+
+func TestSubAgentClose(t *testing.T) {
+	m, s := startTestSubAgent(t)
+	defer m.Close()
+
+	closed := make(chan error, 1)
+	go func() { closed <- s.Close() }()
+	m.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	p, err := readAgentXPDU(m.conn)
+	if err != nil || p.pduType != agentxClose || p.payload[0] != agentxReasonShutdown {
+		t.Fatalf("got PDU %+v, %v, want close", p, err)
+	}
+	m.respond(p, 42, 0)
+	if err := <-closed; err != nil {
+		t.Errorf("Close() returned error %v", err)
+	}
+	if err := s.Wait(); err != nil {
+		t.Errorf("Wait() after Close() returned error %v", err)
+	}
+}
+
+func TestSubAgentClosedByMaster(t *testing.T) {
+	m, s := startTestSubAgent(t)
+	defer s.Close()
+	defer m.Close()
+
+	m.conn.Write((&agentxPDU{pduType: agentxClose, sessionID: 42, payload: []byte{6, 0, 0, 0}}).encode())
+	if err := s.Wait(); err == nil {
+		t.Errorf("Wait() returned no error after the master closed the session")
+	}
+}
+
+func TestSubAgentRegisterDenied(t *testing.T) {
+	m := startFakeMaster(t)
+	setup := m.accept(1, agentxDuplicateRegistration)
+	s, err := DialSubAgent("unix", m.listener.Addr().String(), MustParseOid(".1.3.6.1.4.1.8072"), "test", time.Second)
+	if err != nil {
+		m.Close()
+		t.Fatalf("DialSubAgent() returned error %v", err)
+	}
+	defer s.Close()
+	defer m.Close()
+
+	err = s.RegisterScalar(MustParseOid(".1.3.6.1.2.1.1.1"), func() interface{} { return "x" }, nil)
+	var agentxErr AgentXError
+	if !errors.As(err, &agentxErr) || agentxErr != agentxDuplicateRegistration {
+		t.Errorf("RegisterScalar() returned error %v, want duplicateRegistration", err)
+	}
+	if err := <-setup; err != nil {
+		t.Errorf("fake master returned error %v", err)
+	}
+}
+
+func TestSubAgentOutOfRange(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	for _, timeout := range []time.Duration{-time.Second, 0, 500 * time.Millisecond, 256 * time.Second} {
+		if _, err := NewSubAgentOnConn(client, MustParseOid(".1.3.6.1.4.1.8072"), "test", timeout); err == nil {
+			t.Errorf("NewSubAgentOnConn() with a timeout of %v returned no error", timeout)
+		}
+	}
+
+	m, s := startTestSubAgent(t)
+	defer m.Close()
+	defer s.Close()
+	long := append(MustParseOid(".1.3.6.1.2.1"), make(Oid, 255)...)
+	if err := s.Register(long, &scalarHandler{}); err == nil {
+		t.Errorf("Register() of an oid with 261 sub-identifiers returned no error")
+	}
+}
@@ -0,0 +1,307 @@
+package wapsnmp
+
+/* This file implements a receiver for SNMP notifications: SNMPv1 traps,
+   SNMPv2c traps and informs.
+
+   References : RFC 1157 section 4.1.6 (Trap-PDU), RFC 3416 section 4.2.6 and
+                4.2.7 (SNMPv2-Trap-PDU and InformRequest-PDU).
+*/
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Well-known oids that are part of every SNMPv2 notification.
+var (
+	sysUpTimeOid = MustParseOid(".1.3.6.1.2.1.1.3.0")
+	snmpTrapOid  = MustParseOid(".1.3.6.1.6.3.1.1.4.1.0")
+	snmpTrapsOid = MustParseOid(".1.3.6.1.6.3.1.1.5")
+)
+
+// Notification is a trap or inform received by a TrapListener.
+type Notification struct {
+	Source    net.Addr    // Address the notification was sent from.
+	Version   SNMPVersion // SNMPv1 or SNMPv2c.
+	Community string      // Community the notification was sent with.
+	Type      BERType     // AsnTrap, AsnTrapV2 or AsnInformRequest.
+	RequestID int64       // Request ID, 0 for SNMPv1 traps.
+	TrapOID   Oid         // Identifies the notification, snmpTrapOID.0.
+	SysUpTime time.Duration
+	Varbinds  []SNMPValue // The varbinds sent, excluding sysUpTime.0 and snmpTrapOID.0.
+
+	// SNMPv1 only fields. SNMPv1 traps are translated to SNMPv2 form as
+	// described in RFC 3584, so TrapOID is set and these fields are also
+	// appended to Varbinds as snmpTrapAddress.0, snmpTrapCommunity.0 and
+	// snmpTrapEnterprise.0.
+	Enterprise   Oid
+	AgentAddress net.IP
+	GenericTrap  int
+	SpecificTrap int
+}
+
+// TrapListener listens for SNMP notifications on a UDP socket. Informs are
+// acknowledged automatically.
+type TrapListener struct {
+	// ErrorHandler is called for packets that can't be decoded. They are
+	// dropped silently when it is nil.
+	ErrorHandler func(source net.Addr, err error)
+
+	conn      net.PacketConn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewTrapListener creates a TrapListener bound to a UDP address, e.g.
+// ":162".
+func NewTrapListener(address string) (*TrapListener, error) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf(`error listening on ("udp", "%s"): %s`, address, err)
+	}
+	return NewTrapListenerOnConn(conn), nil
+}
+
+// NewTrapListenerOnConn creates a TrapListener from an existing
+// net.PacketConn.
+func NewTrapListenerOnConn(conn net.PacketConn) *TrapListener {
+	return &TrapListener{conn: conn, closed: make(chan struct{})}
+}
+
+// Addr returns the address the listener is bound to.
+func (l *TrapListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Serve receives notifications and calls handler for each of them, until the
+// listener is closed. Returns nil when stopped by Close.
+func (l *TrapListener) Serve(handler func(*Notification)) error {
+	buf := make([]byte, bufSize)
+	for {
+		numRead, source, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-l.closed:
+				return nil
+			default:
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		n, err := l.handlePacket(buf[:numRead], source)
+		if err != nil {
+			if l.ErrorHandler != nil {
+				l.ErrorHandler(source, err)
+			}
+			continue
+		}
+		handler(n)
+	}
+}
+
+// Notifications starts receiving notifications in the background and returns
+// a channel they are delivered on. The channel is closed when the listener
+// is closed.
+func (l *TrapListener) Notifications(bufferSize int) <-chan *Notification {
+	result := make(chan *Notification, bufferSize)
+	go func() {
+		defer close(result)
+		l.Serve(func(n *Notification) {
+			select {
+			case result <- n:
+			case <-l.closed:
+			}
+		})
+	}()
+	return result
+}
+
+// Close stops the listener and closes its socket.
+func (l *TrapListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.conn.Close()
+	})
+	return err
+}
+
+// handlePacket decodes a received notification, and acknowledges it if it's
+// an inform.
+func (l *TrapListener) handlePacket(packet []byte, source net.Addr) (*Notification, error) {
+	decoded, err := DecodeSequence(packet)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) != 4 {
+		return nil, fmt.Errorf("message has %d elements, want 3", len(decoded)-1)
+	}
+	version, ok1 := decoded[1].(int64)
+	community, ok2 := decoded[2].(string)
+	pdu, ok3 := decoded[3].([]interface{})
+	if !ok1 || !ok2 || !ok3 || len(pdu) == 0 {
+		return nil, fmt.Errorf("malformed message %v", decoded)
+	}
+
+	if version != int64(SNMPv1) && version != int64(SNMPv2c) {
+		return nil, fmt.Errorf("unsupported SNMP version %d", version)
+	}
+
+	n := &Notification{Source: source, Version: SNMPVersion(version), Community: community}
+	switch pdu[0] {
+	case AsnTrap:
+		if n.Version != SNMPv1 {
+			return nil, fmt.Errorf("SNMPv1 trap in an SNMP version %d message", version)
+		}
+		err = n.decodeV1(pdu)
+	case AsnTrapV2, AsnInformRequest:
+		if n.Version != SNMPv2c {
+			return nil, fmt.Errorf("SNMPv2 notification in an SNMP version %d message", version)
+		}
+		err = n.decodeV2(pdu)
+	default:
+		return nil, fmt.Errorf("unexpected PDU type %v", pdu[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if n.Type == AsnInformRequest {
+		// Acknowledge with a response with the same request ID and varbinds.
+		// The varbinds are copied as they were received, so the agent gets
+		// back exactly what it sent.
+		varbinds, err := rawVarbinds(packet)
+		if err != nil {
+			return nil, err
+		}
+		ack, err := EncodeSequence([]interface{}{Sequence, int(n.Version), n.Community,
+			[]interface{}{AsnGetResponse, n.RequestID, 0, 0, UnsupportedBerType(varbinds)}})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := l.conn.WriteTo(ack, source); err != nil {
+			return nil, fmt.Errorf("error acknowledging inform: %v", err)
+		}
+	}
+	return n, nil
+}
+
+// rawVarbinds returns the encoded varbind list of an SNMPv1 or SNMPv2c
+// message.
+func rawVarbinds(packet []byte) ([]byte, error) {
+	// SEQUENCE { version, community, PDU { request-id, error-status,
+	// error-index, varbinds } }
+	idx, _, err := tlvBounds(packet, 0)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < 2; i++ {
+		if _, idx, err = tlvBounds(packet, idx); err != nil {
+			return nil, err
+		}
+	}
+	if idx, _, err = tlvBounds(packet, idx); err != nil {
+		return nil, err
+	}
+	for i := 0; i < 3; i++ {
+		if _, idx, err = tlvBounds(packet, idx); err != nil {
+			return nil, err
+		}
+	}
+	_, end, err := tlvBounds(packet, idx)
+	if err != nil {
+		return nil, err
+	}
+	return packet[idx:end], nil
+}
+
+// encodeVarbinds converts SNMPValues into a varbind list for EncodeSequence.
+func encodeVarbinds(varbinds []SNMPValue) []interface{} {
+	result := make([]interface{}, 0, len(varbinds)+1)
+	result = append(result, Sequence)
+	for _, v := range varbinds {
+		result = append(result, []interface{}{Sequence, v.Oid, v.Value})
+	}
+	return result
+}
+
+// decodeVarbinds converts a decoded varbind list into SNMPValues.
+func decodeVarbinds(varbinds interface{}) ([]SNMPValue, error) {
+	list, ok := varbinds.([]interface{})
+	if !ok || len(list) == 0 || list[0] != Sequence {
+		return nil, fmt.Errorf("malformed varbind list %v", varbinds)
+	}
+	result := make([]SNMPValue, 0, len(list)-1)
+	for _, v := range list[1:] {
+		varbind, ok := v.([]interface{})
+		if !ok || len(varbind) != 3 {
+			return nil, fmt.Errorf("malformed varbind %v", v)
+		}
+		oid, ok := varbind[1].(Oid)
+		if !ok {
+			return nil, fmt.Errorf("malformed varbind %v", v)
+		}
+		result = append(result, SNMPValue{oid, varbind[2]})
+	}
+	return result, nil
+}
+
+// decodeV2 fills in the notification from an SNMPv2-Trap-PDU or
+// InformRequest-PDU.
+func (n *Notification) decodeV2(pdu []interface{}) error {
+	if len(pdu) != 5 {
+		return fmt.Errorf("notification PDU has %d elements, want 4", len(pdu)-1)
+	}
+	requestID, ok := pdu[1].(int64)
+	if !ok {
+		return fmt.Errorf("malformed request ID %v", pdu[1])
+	}
+	varbinds, err := decodeVarbinds(pdu[4])
+	if err != nil {
+		return err
+	}
+
+	// The first two varbinds have to be sysUpTime.0 and snmpTrapOID.0.
+	if len(varbinds) < 2 || !varbinds[0].Oid.Equal(sysUpTimeOid) || !varbinds[1].Oid.Equal(snmpTrapOid) {
+		return errors.New("notification does not start with sysUpTime.0 and snmpTrapOID.0")
+	}
+	sysUpTime, ok1 := varbinds[0].Value.(time.Duration)
+	trapOID, ok2 := varbinds[1].Value.(Oid)
+	if !ok1 || !ok2 {
+		return fmt.Errorf("malformed sysUpTime.0 %v or snmpTrapOID.0 %v", varbinds[0].Value, varbinds[1].Value)
+	}
+
+	n.Type = pdu[0].(BERType)
+	n.RequestID = requestID
+	n.SysUpTime = sysUpTime
+	n.TrapOID = trapOID
+	n.Varbinds = varbinds[2:]
+	return nil
+}
+
+// decodeV1 fills in the notification from an SNMPv1 Trap-PDU. The trap is
+// translated to SNMPv2 form, so TrapOID and Varbinds look the same as for
+// SNMPv2 notifications.
+func (n *Notification) decodeV1(pdu []interface{}) error {
+	trap, err := DecodeTrapV1(pdu)
+	if err != nil {
+		return err
+	}
+
+	n.Type = AsnTrap
+	n.Enterprise = trap.Enterprise
+	n.AgentAddress = trap.AgentAddress
+	n.GenericTrap = trap.GenericTrap
+	n.SpecificTrap = trap.SpecificTrap
+	n.SysUpTime = trap.TimeStamp
+	n.TrapOID = trap.TrapOID()
+	n.Varbinds = trap.ToV2(n.Community)[2:]
+	return nil
+}
@@ -0,0 +1,175 @@
+package wapsnmp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testTrapV2 is a trap generated via:
+// $ snmptrap -v 2c -c public localhost:1600 '' SNMPv2-MIB::snmpTrapOID SNMPv2-MIB::sysName.0 s "test"
+const testTrapV2 = "MFgCAQEEBnB1YmxpY6dLAgRAPUXKAgEAAgEAMD0wEAYIKwYBAgEBAwBDBAbPOZIwFwYKKwYBBgMBAQQBAAYJKwYBBgMBAQQBMBAGCCsGAQIBAQUABAR0ZXN0"
+
+// startTestTrapListener starts a TrapListener on loopback, and returns it
+// along with a connection to send notifications to it.
+func startTestTrapListener(t *testing.T) (*TrapListener, <-chan *Notification, net.Conn) {
+	l, err := NewTrapListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTrapListener() returned error %v", err)
+	}
+	notifications := l.Notifications(1)
+	conn, err := net.Dial("udp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		t.Fatalf("error connecting to listener: %v", err)
+	}
+	return l, notifications, conn
+}
+
+// receiveNotification waits for a notification to arrive.
+func receiveNotification(t *testing.T, notifications <-chan *Notification) *Notification {
+	select {
+	case n := <-notifications:
+		return n
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for notification")
+	}
+	return nil
+}
+
+func TestTrapListenerV2(t *testing.T) {
+	l, notifications, conn := startTestTrapListener(t)
+	defer l.Close()
+	defer conn.Close()
+
+	packet, _ := base64.StdEncoding.DecodeString(testTrapV2)
+	if _, err := conn.Write(packet); err != nil {
+		t.Fatalf("error sending trap: %v", err)
+	}
+
+	n := receiveNotification(t, notifications)
+	if n.Type != AsnTrapV2 || n.Version != SNMPv2c || n.Community != "public" {
+		t.Errorf("got notification type %v version %v community %q, want trap v2c public", n.Type, n.Version, n.Community)
+	}
+	if !n.TrapOID.Equal(MustParseOid(".1.3.6.1.6.3.1.1.4.1")) {
+		t.Errorf("got trap oid %v, want .1.3.6.1.6.3.1.1.4.1", n.TrapOID)
+	}
+	if n.SysUpTime != 114243986*10*time.Millisecond {
+		t.Errorf("got sysUpTime %v, want %v", n.SysUpTime, 114243986*10*time.Millisecond)
+	}
+	want := []SNMPValue{{MustParseOid(".1.3.6.1.2.1.1.5.0"), "test"}}
+	if !reflect.DeepEqual(n.Varbinds, want) {
+		t.Errorf("got varbinds %v, want %v", n.Varbinds, want)
+	}
+}
+
+func TestTrapListenerInform(t *testing.T) {
+	l, notifications, conn := startTestTrapListener(t)
+	defer l.Close()
+	defer conn.Close()
+
+	// Turn the trap into an inform.
+	packet, _ := base64.StdEncoding.DecodeString(testTrapV2)
+	packet[bytes.IndexByte(packet, byte(AsnTrapV2))] = byte(AsnInformRequest)
+	if _, err := conn.Write(packet); err != nil {
+		t.Fatalf("error sending inform: %v", err)
+	}
+
+	n := receiveNotification(t, notifications)
+	if n.Type != AsnInformRequest || n.RequestID != 0x403d45ca {
+		t.Errorf("got notification type %v request ID %x, want inform 403d45ca", n.Type, n.RequestID)
+	}
+
+	// The inform should be acknowledged with the same request ID and varbinds.
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	ack := make([]byte, bufSize)
+	numRead, err := conn.Read(ack)
+	if err != nil {
+		t.Fatalf("error reading inform acknowledgement: %v", err)
+	}
+	want := append([]byte{}, packet...)
+	want[bytes.IndexByte(want, byte(AsnInformRequest))] = byte(AsnGetResponse)
+	if !bytes.Equal(ack[:numRead], want) {
+		t.Errorf("got acknowledgement %x, want %x", ack[:numRead], want)
+	}
+}
+
+func TestTrapListenerV1(t *testing.T) {
+	l, notifications, conn := startTestTrapListener(t)
+	defer l.Close()
+	defer conn.Close()
+
+	// An SNMPv1 linkDown trap, with a time-stamp of 12345 ticks.
+	packet, err := EncodeSequence([]interface{}{Sequence, int(SNMPv1), "public",
+		[]interface{}{AsnTrap, MustParseOid(".1.3.6.1.4.1.8072.3.2.10"), net.ParseIP("192.0.2.1"), 2, 0,
+			12345 * 10 * time.Millisecond,
+			[]interface{}{Sequence,
+				[]interface{}{Sequence, MustParseOid(".1.3.6.1.2.1.2.2.1.1.3"), 3}}}})
+	if err != nil {
+		t.Fatalf("error encoding trap: %v", err)
+	}
+	if _, err := conn.Write(packet); err != nil {
+		t.Fatalf("error sending trap: %v", err)
+	}
+
+	n := receiveNotification(t, notifications)
+	if n.Type != AsnTrap || n.Version != SNMPv1 {
+		t.Errorf("got notification type %v version %v, want v1 trap", n.Type, n.Version)
+	}
+	if !n.TrapOID.Equal(MustParseOid(".1.3.6.1.6.3.1.1.5.3")) {
+		t.Errorf("got trap oid %v, want linkDown", n.TrapOID)
+	}
+	if !n.AgentAddress.Equal(net.ParseIP("192.0.2.1")) || n.GenericTrap != 2 || n.SysUpTime != 123450*time.Millisecond {
+		t.Errorf("got agent %v generic trap %v time-stamp %v", n.AgentAddress, n.GenericTrap, n.SysUpTime)
+	}
+	// The trap is translated to SNMPv2 form, RFC 3584.
+	want := []SNMPValue{
+		{MustParseOid(".1.3.6.1.2.1.2.2.1.1.3"), int64(3)},
+		{MustParseOid(".1.3.6.1.6.3.18.1.3.0"), net.ParseIP("192.0.2.1")},
+		{MustParseOid(".1.3.6.1.6.3.18.1.4.0"), "public"},
+		{MustParseOid(".1.3.6.1.6.3.1.1.4.3.0"), MustParseOid(".1.3.6.1.4.1.8072.3.2.10")},
+	}
+	if !reflect.DeepEqual(n.Varbinds, want) {
+		t.Errorf("got varbinds %v, want %v", n.Varbinds, want)
+	}
+}
+
+func TestTrapListenerMalformed(t *testing.T) {
+	l, err := NewTrapListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTrapListener() returned error %v", err)
+	}
+	defer l.Close()
+	errs := make(chan error, 1)
+	l.ErrorHandler = func(source net.Addr, err error) { errs <- err }
+	notifications := l.Notifications(1)
+
+	conn, err := net.Dial("udp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting to listener: %v", err)
+	}
+	defer conn.Close()
+
+	// A GET request is not a notification.
+	packet, _ := EncodeSequence([]interface{}{Sequence, int(SNMPv2c), "public",
+		[]interface{}{AsnGetRequest, 1, 0, 0, []interface{}{Sequence}}})
+	conn.Write(packet)
+
+	select {
+	case <-errs:
+	case n := <-notifications:
+		t.Errorf("got notification %v for a GET request", n)
+	case <-time.After(2 * time.Second):
+		t.Errorf("timed out waiting for error")
+	}
+
+	// Version 257 is not SNMPv2c, though it is in a byte.
+	packet, _ = base64.StdEncoding.DecodeString(testTrapV2)
+	wrapped := append([]byte{0x30, packet[1] + 1, 0x02, 0x02, 0x01, 0x01}, packet[5:]...)
+	if n, err := l.handlePacket(wrapped, nil); err == nil {
+		t.Errorf("handlePacket() of a version 257 trap => %v, want an error", n)
+	}
+}
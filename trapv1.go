@@ -0,0 +1,155 @@
+package wapsnmp
+
+/* This file implements the SNMPv1 Trap-PDU, and the translation between
+   SNMPv1 traps and SNMPv2 notifications.
+
+   References : RFC 1157 section 4.1.6 (Trap-PDU),
+                RFC 3584 section 3 (translating notification parameters).
+*/
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Oids added to SNMPv2 notifications translated from SNMPv1 traps.
+var (
+	snmpTrapAddressOid    = MustParseOid(".1.3.6.1.6.3.18.1.3.0")
+	snmpTrapCommunityOid  = MustParseOid(".1.3.6.1.6.3.18.1.4.0")
+	snmpTrapEnterpriseOid = MustParseOid(".1.3.6.1.6.3.1.1.4.3.0")
+)
+
+// Values for the generic-trap field of an SNMPv1 trap.
+const (
+	ColdStart             = 0
+	WarmStart             = 1
+	LinkDown              = 2
+	LinkUp                = 3
+	AuthenticationFailure = 4
+	EgpNeighborLoss       = 5
+	EnterpriseSpecific    = 6
+)
+
+// TrapV1 is an SNMPv1 Trap-PDU.
+type TrapV1 struct {
+	Enterprise   Oid
+	AgentAddress net.IP
+	GenericTrap  int
+	SpecificTrap int
+	TimeStamp    time.Duration
+	Varbinds     []SNMPValue
+}
+
+// Sequence returns the trap in the form EncodeSequence takes.
+func (t *TrapV1) Sequence() []interface{} {
+	agentAddress := t.AgentAddress
+	if agentAddress == nil {
+		agentAddress = net.IPv4zero
+	}
+	return []interface{}{AsnTrap, t.Enterprise, agentAddress, t.GenericTrap, t.SpecificTrap, t.TimeStamp,
+		encodeVarbinds(t.Varbinds)}
+}
+
+// DecodeTrapV1 converts a Trap-PDU as returned by DecodeSequence into a
+// TrapV1.
+func DecodeTrapV1(pdu []interface{}) (*TrapV1, error) {
+	if len(pdu) != 7 || pdu[0] != AsnTrap {
+		return nil, fmt.Errorf("not an SNMPv1 trap PDU: %v", pdu)
+	}
+	enterprise, ok1 := pdu[1].(Oid)
+	agentAddress, ok2 := pdu[2].(net.IP)
+	genericTrap, ok3 := pdu[3].(int64)
+	specificTrap, ok4 := pdu[4].(int64)
+	timeStamp, ok5 := pdu[5].(time.Duration)
+	if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 {
+		return nil, fmt.Errorf("malformed trap PDU %v", pdu)
+	}
+	varbinds, err := decodeVarbinds(pdu[6])
+	if err != nil {
+		return nil, err
+	}
+	return &TrapV1{enterprise, agentAddress, int(genericTrap), int(specificTrap), timeStamp, varbinds}, nil
+}
+
+// TrapOID returns the snmpTrapOID.0 value identifying this trap in SNMPv2,
+// as described in RFC 3584 section 3.1.
+func (t *TrapV1) TrapOID() Oid {
+	if t.GenericTrap != EnterpriseSpecific {
+		return append(snmpTrapsOid.Copy(), t.GenericTrap+1)
+	}
+	return append(t.Enterprise.Copy(), 0, t.SpecificTrap)
+}
+
+// ToV2 translates the trap into the varbinds of an SNMPv2 notification, as
+// described in RFC 3584 section 3.1. The result starts with sysUpTime.0 and
+// snmpTrapOID.0, followed by the trap's varbinds, snmpTrapAddress.0,
+// snmpTrapCommunity.0 (if community isn't empty) and snmpTrapEnterprise.0.
+func (t *TrapV1) ToV2(community string) []SNMPValue {
+	result := make([]SNMPValue, 0, len(t.Varbinds)+5)
+	result = append(result, SNMPValue{sysUpTimeOid, t.TimeStamp}, SNMPValue{snmpTrapOid, t.TrapOID()})
+	result = append(result, t.Varbinds...)
+	if t.AgentAddress != nil {
+		result = append(result, SNMPValue{snmpTrapAddressOid, t.AgentAddress})
+	}
+	if community != "" {
+		result = append(result, SNMPValue{snmpTrapCommunityOid, community})
+	}
+	return append(result, SNMPValue{snmpTrapEnterpriseOid, t.Enterprise})
+}
+
+// TrapV1FromV2 translates the varbinds of an SNMPv2 notification into an
+// SNMPv1 trap, as described in RFC 3584 section 3.2. The varbinds have to
+// start with sysUpTime.0 and snmpTrapOID.0.
+//
+// Counter64 varbinds are dropped, as SNMPv1 can't represent them.
+func TrapV1FromV2(varbinds []SNMPValue) (*TrapV1, error) {
+	if len(varbinds) < 2 || !varbinds[0].Oid.Equal(sysUpTimeOid) || !varbinds[1].Oid.Equal(snmpTrapOid) {
+		return nil, errors.New("notification does not start with sysUpTime.0 and snmpTrapOID.0")
+	}
+	timeStamp, ok1 := varbinds[0].Value.(time.Duration)
+	trapOID, ok2 := varbinds[1].Value.(Oid)
+	if !ok1 || !ok2 || len(trapOID) < 2 {
+		return nil, fmt.Errorf("malformed sysUpTime.0 %v or snmpTrapOID.0 %v", varbinds[0].Value, varbinds[1].Value)
+	}
+
+	result := &TrapV1{AgentAddress: net.IPv4zero, TimeStamp: timeStamp}
+	var enterprise Oid
+	for _, v := range varbinds[2:] {
+		switch {
+		case v.Oid.Equal(snmpTrapAddressOid):
+			if ip, ok := v.Value.(net.IP); ok {
+				result.AgentAddress = ip
+			}
+		case v.Oid.Equal(snmpTrapEnterpriseOid):
+			enterprise, _ = v.Value.(Oid)
+		case v.Oid.Equal(snmpTrapCommunityOid):
+			// Only meaningful in SNMPv2, the community goes in the message.
+		default:
+			if _, ok := v.Value.(Counter64); !ok {
+				result.Varbinds = append(result.Varbinds, v)
+			}
+		}
+	}
+
+	last := trapOID[len(trapOID)-1]
+	if len(trapOID) == len(snmpTrapsOid)+1 && trapOID.Within(snmpTrapsOid) && last >= 1 && last <= 6 {
+		// One of the generic traps, coldStart(1) through egpNeighborLoss(6).
+		result.GenericTrap = last - 1
+		result.Enterprise = snmpTrapsOid.Copy()
+		if enterprise != nil {
+			result.Enterprise = enterprise
+		}
+		return result, nil
+	}
+
+	result.GenericTrap = EnterpriseSpecific
+	result.SpecificTrap = last
+	if trapOID[len(trapOID)-2] == 0 {
+		result.Enterprise = trapOID[:len(trapOID)-2].Copy()
+	} else {
+		result.Enterprise = trapOID[:len(trapOID)-1].Copy()
+	}
+	return result, nil
+}
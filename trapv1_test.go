@@ -0,0 +1,129 @@
+package wapsnmp
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTrapV1EncodeDecode(t *testing.T) {
+	trap := &TrapV1{
+		Enterprise:   MustParseOid(".1.3.6.1.4.1.318"),
+		AgentAddress: net.ParseIP("192.0.2.1"),
+		GenericTrap:  EnterpriseSpecific,
+		SpecificTrap: 5,
+		TimeStamp:    12345 * 10 * time.Millisecond,
+		Varbinds:     []SNMPValue{{MustParseOid(".1.3.6.1.4.1.318.2.3.3.0"), "UPS on battery"}},
+	}
+	encoded, err := EncodeSequence(trap.Sequence())
+	if err != nil {
+		t.Fatalf("EncodeSequence() returned error %v", err)
+	}
+	decoded, err := DecodeSequence(append([]byte{0x30, byte(len(encoded))}, encoded...))
+	if err != nil {
+		t.Fatalf("DecodeSequence() returned error %v", err)
+	}
+	result, err := DecodeTrapV1(decoded[1].([]interface{}))
+	if err != nil {
+		t.Fatalf("DecodeTrapV1() returned error %v", err)
+	}
+	if !reflect.DeepEqual(result, trap) {
+		t.Errorf("DecodeTrapV1() => %v, want %v", result, trap)
+	}
+}
+
+func TestTrapV1ToV2(t *testing.T) {
+	tests := []struct {
+		trap    TrapV1
+		trapOID string
+	}{
+		{TrapV1{Enterprise: MustParseOid(".1.3.6.1.4.1.318"), GenericTrap: LinkUp}, ".1.3.6.1.6.3.1.1.5.4"},
+		{TrapV1{Enterprise: MustParseOid(".1.3.6.1.4.1.318"), GenericTrap: EnterpriseSpecific, SpecificTrap: 5}, ".1.3.6.1.4.1.318.0.5"},
+	}
+
+	for _, test := range tests {
+		test.trap.AgentAddress = net.ParseIP("192.0.2.1")
+		test.trap.TimeStamp = time.Second
+		v2 := test.trap.ToV2("public")
+		want := []SNMPValue{
+			{sysUpTimeOid, time.Second},
+			{snmpTrapOid, MustParseOid(test.trapOID)},
+			{snmpTrapAddressOid, net.ParseIP("192.0.2.1")},
+			{snmpTrapCommunityOid, "public"},
+			{snmpTrapEnterpriseOid, MustParseOid(".1.3.6.1.4.1.318")},
+		}
+		if !reflect.DeepEqual(v2, want) {
+			t.Errorf("ToV2() => %v, want %v", v2, want)
+			continue
+		}
+
+		// Translating back should give the original trap.
+		v1, err := TrapV1FromV2(v2)
+		if err != nil {
+			t.Errorf("TrapV1FromV2(%v) returned error %v", v2, err)
+			continue
+		}
+		if !reflect.DeepEqual(*v1, test.trap) {
+			t.Errorf("TrapV1FromV2(%v) => %v, want %v", v2, *v1, test.trap)
+		}
+	}
+}
+
+func TestTrapV1FromV2(t *testing.T) {
+	tests := []struct {
+		trapOID    string
+		enterprise string
+		generic    int
+		specific   int
+	}{
+		{".1.3.6.1.6.3.1.1.5.1", ".1.3.6.1.6.3.1.1.5", ColdStart, 0},
+		{".1.3.6.1.4.1.9.9.41.2.0.1", ".1.3.6.1.4.1.9.9.41.2", EnterpriseSpecific, 1},
+		{".1.3.6.1.4.1.2636.4.1.1", ".1.3.6.1.4.1.2636.4.1", EnterpriseSpecific, 1},
+	}
+
+	for _, test := range tests {
+		v1, err := TrapV1FromV2([]SNMPValue{
+			{sysUpTimeOid, time.Second},
+			{snmpTrapOid, MustParseOid(test.trapOID)},
+			{MustParseOid(".1.3.6.1.2.1.31.1.1.1.6.1"), Counter64(1)},
+			{MustParseOid(".1.3.6.1.2.1.2.2.1.1.1"), 1},
+		})
+		if err != nil {
+			t.Errorf("TrapV1FromV2(%v) returned error %v", test.trapOID, err)
+			continue
+		}
+		if !v1.Enterprise.Equal(MustParseOid(test.enterprise)) || v1.GenericTrap != test.generic || v1.SpecificTrap != test.specific {
+			t.Errorf("TrapV1FromV2(%v) => enterprise %v generic %d specific %d, want %v %d %d", test.trapOID,
+				v1.Enterprise, v1.GenericTrap, v1.SpecificTrap, test.enterprise, test.generic, test.specific)
+		}
+		// The Counter64 can't be sent in SNMPv1.
+		if len(v1.Varbinds) != 1 || !v1.AgentAddress.Equal(net.IPv4zero) {
+			t.Errorf("TrapV1FromV2(%v) => varbinds %v agent-addr %v, want 1 varbind from 0.0.0.0", test.trapOID, v1.Varbinds, v1.AgentAddress)
+		}
+	}
+
+	if _, err := TrapV1FromV2([]SNMPValue{{snmpTrapOid, MustParseOid(".1.3.6.1.6.3.1.1.5.1")}}); err == nil {
+		t.Errorf("TrapV1FromV2() without sysUpTime.0 returned no error")
+	}
+}
+
+func TestSendTrapV1(t *testing.T) {
+	l, notifications, wsnmp := startTestNotifier(t)
+	defer l.Close()
+	defer wsnmp.Close()
+	wsnmp.Version = SNMPv1
+
+	linkDown := MustParseOid(".1.3.6.1.6.3.1.1.5.3")
+	if err := wsnmp.SendTrap(linkDown, nil); err != nil {
+		t.Fatalf("SendTrap() returned error %v", err)
+	}
+
+	n := receiveNotification(t, notifications)
+	if n.Type != AsnTrap || n.GenericTrap != LinkDown || !n.TrapOID.Equal(linkDown) {
+		t.Errorf("got notification type %v generic trap %d trap oid %v, want v1 linkDown", n.Type, n.GenericTrap, n.TrapOID)
+	}
+	if !n.AgentAddress.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("got agent-addr %v, want 127.0.0.1", n.AgentAddress)
+	}
+}
@@ -3,6 +3,7 @@ package wapsnmp
 import (
 	"encoding/hex"
 	"net"
+	"sync"
 	"testing"
 	"time"
 )
@@ -31,11 +32,16 @@ type udpStub struct {
 
 	t      *testing.T
 	closed bool
+
+	mu     sync.Mutex
+	queued *sync.Cond // Signalled when packets are queued or the stub is closed.
 }
 
 // NewUdpStub creates a new udpStub.
 func NewUdpStub(t *testing.T) *udpStub {
-	return &udpStub{t: t}
+	u := &udpStub{t: t}
+	u.queued = sync.NewCond(&u.mu)
+	return u
 }
 
 // Expect declares that you expect this connection to be sent a hex-encoded string.
@@ -55,9 +61,15 @@ func (e *expectAndRespond) AndRespond(packets []string) *expectAndRespond {
 
 /* Read reads bytes from the connection.
 
-   Only returns stuff you put in the object with the AndRespond method.
+   Only returns stuff you put in the object with the AndRespond method. Blocks
+   until a response is queued, or the stub is closed.
 */
 func (u *udpStub) Read(b []byte) (n int, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for len(u.queuedPackets) == 0 && !u.closed {
+		u.queued.Wait()
+	}
 	if len(u.queuedPackets) > 0 {
 		val, err := hex.DecodeString(u.queuedPackets[0])
 		if err != nil {
@@ -70,7 +82,7 @@ func (u *udpStub) Read(b []byte) (n int, err error) {
 		u.queuedPackets = u.queuedPackets[1:]
 		return len(val), nil
 	}
-	return 0, nil
+	return 0, net.ErrClosed
 }
 
 /* Write writes bytes to the connection.
@@ -79,6 +91,10 @@ func (u *udpStub) Read(b []byte) (n int, err error) {
    If an unexpected packet is written it will trigger an error.
 */
 func (u *udpStub) Write(b []byte) (n int, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	defer u.queued.Broadcast()
+
 	// We're expecting the first packet in the expectResponses array.
 	realPacket := hex.EncodeToString(b)
 	expectedPacket := u.expectResponses[0].expect
@@ -102,12 +118,17 @@ func (u *udpStub) Write(b []byte) (n int, err error) {
    This sets a boolean flag so you can check the connection was really closed.
 */
 func (u *udpStub) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	u.closed = true
+	u.queued.Broadcast()
 	return nil
 }
 
 // CheckClosed checks if the udpStub was closed, signaling an error if it wasn't.
 func (u *udpStub) CheckClosed() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	if !u.closed {
 		u.t.Errorf("Connection was not closed")
 	}
@@ -0,0 +1,457 @@
+package wapsnmp
+
+/* This file implements the SNMPv3 message format and the User-based Security
+   Model (USM).
+
+   References : RFC 3412 (message processing), RFC 3414 (USM),
+                RFC 7860 (HMAC-SHA-2 authentication protocols).
+*/
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"sync"
+	"time"
+)
+
+// AuthProtocol is the USM authentication protocol used for SNMPv3 messages.
+type AuthProtocol uint8
+
+// List of the supported authentication protocols.
+const (
+	NoAuth     AuthProtocol = iota // noAuthNoPriv.
+	AuthMD5                        // HMAC-MD5-96, RFC 3414.
+	AuthSHA                        // HMAC-SHA-96, RFC 3414.
+	AuthSHA224                     // HMAC-SHA-224-128, RFC 7860.
+	AuthSHA256                     // HMAC-SHA-256-192, RFC 7860.
+	AuthSHA384                     // HMAC-SHA-384-256, RFC 7860.
+	AuthSHA512                     // HMAC-SHA-512-384, RFC 7860.
+)
+
+// Bits of the msgFlags field.
+const (
+	msgFlagAuth       byte = 0x01
+	msgFlagPriv       byte = 0x02
+	msgFlagReportable byte = 0x04
+)
+
+// usmSecurityModel is the msgSecurityModel value for the USM.
+const usmSecurityModel = 3
+
+// String returns the name of the authentication protocol.
+func (a AuthProtocol) String() string {
+	switch a {
+	case NoAuth:
+		return "NoAuth"
+	case AuthMD5:
+		return "MD5"
+	case AuthSHA:
+		return "SHA"
+	case AuthSHA224:
+		return "SHA224"
+	case AuthSHA256:
+		return "SHA256"
+	case AuthSHA384:
+		return "SHA384"
+	case AuthSHA512:
+		return "SHA512"
+	}
+	return fmt.Sprintf("AuthProtocol(%d)", uint8(a))
+}
+
+// hash returns the hash function the protocol is built on.
+func (a AuthProtocol) hash() (func() hash.Hash, error) {
+	switch a {
+	case AuthMD5:
+		return md5.New, nil
+	case AuthSHA:
+		return sha1.New, nil
+	case AuthSHA224:
+		return sha256.New224, nil
+	case AuthSHA256:
+		return sha256.New, nil
+	case AuthSHA384:
+		return sha512.New384, nil
+	case AuthSHA512:
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported authentication protocol %v", a)
+}
+
+// macLength returns the length of the truncated HMAC that goes into
+// msgAuthenticationParameters.
+func (a AuthProtocol) macLength() int {
+	switch a {
+	case AuthMD5, AuthSHA:
+		return 12
+	case AuthSHA224:
+		return 16
+	case AuthSHA256:
+		return 24
+	case AuthSHA384:
+		return 32
+	case AuthSHA512:
+		return 48
+	}
+	return 0
+}
+
+// PasswordToKey converts a password into a key localized to an engine ID, as
+// described in RFC 3414 appendix A.2.
+func PasswordToKey(proto AuthProtocol, password string, engineID []byte) ([]byte, error) {
+	newHash, err := proto.hash()
+	if err != nil {
+		return nil, err
+	}
+	if len(password) == 0 {
+		return nil, errors.New("password cannot be empty")
+	}
+
+	// Hash one megabyte worth of the password repeated over and over.
+	h := newHash()
+	buf := make([]byte, 64)
+	pwIdx := 0
+	for count := 0; count < 1048576; count += len(buf) {
+		for i := range buf {
+			buf[i] = password[pwIdx%len(password)]
+			pwIdx++
+		}
+		h.Write(buf)
+	}
+	ku := h.Sum(nil)
+
+	// Localize it: Kul = H(Ku || engineID || Ku).
+	h.Reset()
+	h.Write(ku)
+	h.Write(engineID)
+	h.Write(ku)
+	return h.Sum(nil), nil
+}
+
+// USM holds the SNMPv3 User-based Security Model settings for one user and
+// the state of the authoritative engine that user talks to.
+//
+// The engine fields are discovered automatically when AuthoritativeEngineID
+// is empty, and kept up to date afterwards. As they belong to one agent, use
+// a separate USM for every target. A USM can be used by concurrent requests,
+// but its fields should not be changed while requests are in progress.
+type USM struct {
+	UserName     string
+	AuthProtocol AuthProtocol
+	AuthPassword string
+	PrivProtocol PrivProtocol
+	PrivPassword string
+
+	ContextName     string
+	ContextEngineID string // Defaults to AuthoritativeEngineID when empty.
+
+	AuthoritativeEngineID    string
+	AuthoritativeEngineBoots int64
+	AuthoritativeEngineTime  int64
+	engineTimeAt             time.Time // Local time AuthoritativeEngineTime was learned.
+
+	mu sync.Mutex // Guards the engine fields and the state below.
+
+	authKey       []byte // Cached localized authentication key.
+	authKeyEngine string // Engine ID authKey was localized to.
+	privKey       []byte // Cached localized privacy key.
+	privKeyEngine string // Engine ID privKey was localized to.
+	salt          uint64 // Last salt used for encryption.
+	saltSet       bool   // Whether salt has been initialized.
+}
+
+// localizedAuthKey returns the authentication key localized to the
+// authoritative engine, computing it if needed.
+func (u *USM) localizedAuthKey() ([]byte, error) {
+	if u.authKey != nil && u.authKeyEngine == u.AuthoritativeEngineID {
+		return u.authKey, nil
+	}
+	key, err := PasswordToKey(u.AuthProtocol, u.AuthPassword, []byte(u.AuthoritativeEngineID))
+	if err != nil {
+		return nil, err
+	}
+	u.authKey = key
+	u.authKeyEngine = u.AuthoritativeEngineID
+	return key, nil
+}
+
+// isConfirmedPDU returns whether a PDU type expects a response, and so
+// should be sent with the reportable flag.
+func isConfirmedPDU(pduType BERType) bool {
+	switch pduType {
+	case AsnGetRequest, AsnGetNextRequest, AsnGetBulkRequest, AsnSetRequest, AsnInformRequest:
+		return true
+	}
+	return false
+}
+
+// encodeMessage wraps a PDU into an SNMPv3 message, encrypting and
+// authenticating it if required.
+func (u *USM) encodeMessage(msgID int, pdu []interface{}) ([]byte, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var flags byte
+	if pduType, ok := pdu[0].(BERType); ok && isConfirmedPDU(pduType) {
+		flags |= msgFlagReportable
+	}
+	authParams := ""
+	if u.AuthProtocol != NoAuth {
+		flags |= msgFlagAuth
+		// Zeroes are a placeholder for the HMAC, which is calculated over the
+		// whole message.
+		authParams = string(make([]byte, u.AuthProtocol.macLength()))
+	}
+
+	engineTime := u.engineTime()
+	contextEngineID := u.ContextEngineID
+	if contextEngineID == "" {
+		contextEngineID = u.AuthoritativeEngineID
+	}
+	var msgData interface{} = []interface{}{Sequence, contextEngineID, u.ContextName, pdu}
+	privParams := ""
+	if u.PrivProtocol != NoPriv {
+		if u.AuthProtocol == NoAuth {
+			return nil, errors.New("privacy requires an authentication protocol")
+		}
+		flags |= msgFlagPriv
+		scopedPDU, err := EncodeSequence(msgData.([]interface{}))
+		if err != nil {
+			return nil, err
+		}
+		encrypted, salt, err := u.encrypt(scopedPDU, u.AuthoritativeEngineBoots, engineTime)
+		if err != nil {
+			return nil, err
+		}
+		msgData = string(encrypted)
+		privParams = string(salt)
+	}
+
+	secParams, err := EncodeSequence([]interface{}{Sequence, u.AuthoritativeEngineID,
+		u.AuthoritativeEngineBoots, engineTime, u.UserName, authParams, privParams})
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := EncodeSequence([]interface{}{Sequence, int(SNMPv3),
+		[]interface{}{Sequence, msgID, bufSize, string([]byte{flags}), usmSecurityModel},
+		string(secParams),
+		msgData})
+	if err != nil {
+		return nil, err
+	}
+
+	if flags&msgFlagAuth != 0 {
+		if err := u.authenticate(msg); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// usmHeader holds the fields of a received SNMPv3 message the USM needs.
+type usmHeader struct {
+	msgID       int64
+	flags       byte
+	engineID    string
+	engineBoots int64
+	engineTime  int64
+	userName    string
+}
+
+// decodeMessage checks an SNMPv3 message and returns the PDU inside it, along
+// with the header fields.
+//
+// Report PDUs are accepted even when they are sent at a lower security level
+// than configured, as agents use them to signal security errors.
+func (u *USM) decodeMessage(raw []byte) ([]interface{}, *usmHeader, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	decoded, err := DecodeSequence(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(decoded) != 5 {
+		return nil, nil, fmt.Errorf("SNMPv3 message has %d elements, want 4", len(decoded)-1)
+	}
+	if version, ok := decoded[1].(int64); !ok || version != int64(SNMPv3) {
+		return nil, nil, fmt.Errorf("not an SNMPv3 message, version %v", decoded[1])
+	}
+	globalData, ok := decoded[2].([]interface{})
+	if !ok || len(globalData) != 5 {
+		return nil, nil, fmt.Errorf("malformed SNMPv3 msgGlobalData %v", decoded[2])
+	}
+	msgID, ok1 := globalData[1].(int64)
+	flags, ok2 := globalData[3].(string)
+	if !ok1 || !ok2 || len(flags) != 1 {
+		return nil, nil, fmt.Errorf("malformed SNMPv3 msgGlobalData %v", globalData)
+	}
+	if secModel, ok := globalData[4].(int64); !ok || secModel != usmSecurityModel {
+		return nil, nil, fmt.Errorf("unsupported security model %v", globalData[4])
+	}
+
+	rawSecParams, ok := decoded[3].(string)
+	if !ok {
+		return nil, nil, fmt.Errorf("malformed SNMPv3 msgSecurityParameters %v", decoded[3])
+	}
+	secParams, err := DecodeSequence([]byte(rawSecParams))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decoding msgSecurityParameters: %v", err)
+	}
+	if len(secParams) != 7 {
+		return nil, nil, fmt.Errorf("msgSecurityParameters has %d elements, want 6", len(secParams)-1)
+	}
+	engineID, ok1 := secParams[1].(string)
+	engineBoots, ok2 := secParams[2].(int64)
+	engineTime, ok3 := secParams[3].(int64)
+	userName, ok4 := secParams[4].(string)
+	privParams, ok5 := secParams[6].(string)
+	if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 {
+		return nil, nil, fmt.Errorf("malformed msgSecurityParameters %v", secParams)
+	}
+	header := &usmHeader{msgID, flags[0], engineID, engineBoots, engineTime, userName}
+
+	if header.flags&msgFlagAuth != 0 {
+		if userName != u.UserName {
+			return nil, nil, fmt.Errorf("response for unknown user %q", userName)
+		}
+		if err := u.verify(raw); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	msgData := decoded[4]
+	if header.flags&msgFlagPriv != 0 {
+		if header.flags&msgFlagAuth == 0 || u.PrivProtocol == NoPriv {
+			return nil, nil, errors.New("received encrypted response without privacy configured")
+		}
+		encrypted, ok := msgData.(string)
+		if !ok {
+			return nil, nil, fmt.Errorf("malformed encryptedPDU %v", msgData)
+		}
+		plaintext, err := u.decrypt([]byte(encrypted), []byte(privParams), engineBoots, engineTime)
+		if err != nil {
+			return nil, nil, err
+		}
+		if msgData, err = DecodeSequence(plaintext); err != nil {
+			return nil, nil, fmt.Errorf("error decoding decrypted scopedPDU: %v", err)
+		}
+	}
+
+	scopedPDU, ok := msgData.([]interface{})
+	if !ok || len(scopedPDU) != 4 {
+		return nil, nil, fmt.Errorf("malformed scopedPDU %v", msgData)
+	}
+	pdu, ok := scopedPDU[3].([]interface{})
+	if !ok || len(pdu) == 0 {
+		return nil, nil, fmt.Errorf("malformed PDU %v", scopedPDU[3])
+	}
+
+	if pdu[0] != AsnReport {
+		if header.flags&msgFlagAuth == 0 && u.AuthProtocol != NoAuth {
+			return nil, nil, errors.New("received unauthenticated response to an authenticated request")
+		}
+		if header.flags&msgFlagPriv == 0 && u.PrivProtocol != NoPriv {
+			return nil, nil, errors.New("received unencrypted response to an encrypted request")
+		}
+	}
+	return pdu, header, nil
+}
+
+// authenticate fills in msgAuthenticationParameters of an encoded message.
+func (u *USM) authenticate(msg []byte) error {
+	start, end, err := authParamsBounds(msg)
+	if err != nil {
+		return err
+	}
+	mac, err := u.mac(msg)
+	if err != nil {
+		return err
+	}
+	copy(msg[start:end], mac)
+	return nil
+}
+
+// verify checks msgAuthenticationParameters of a received message.
+func (u *USM) verify(msg []byte) error {
+	start, end, err := authParamsBounds(msg)
+	if err != nil {
+		return err
+	}
+	if end-start != u.AuthProtocol.macLength() {
+		return fmt.Errorf("msgAuthenticationParameters is %d bytes, want %d", end-start, u.AuthProtocol.macLength())
+	}
+
+	// The HMAC is calculated with the authentication parameters zeroed out.
+	scratch := make([]byte, len(msg))
+	copy(scratch, msg)
+	for i := start; i < end; i++ {
+		scratch[i] = 0
+	}
+	mac, err := u.mac(scratch)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, msg[start:end]) {
+		return fmt.Errorf("authentication failure: %w", ErrWrongDigest)
+	}
+	return nil
+}
+
+// mac calculates the truncated HMAC of a message.
+func (u *USM) mac(msg []byte) ([]byte, error) {
+	newHash, err := u.AuthProtocol.hash()
+	if err != nil {
+		return nil, err
+	}
+	key, err := u.localizedAuthKey()
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(newHash, key)
+	h.Write(msg)
+	return h.Sum(nil)[:u.AuthProtocol.macLength()], nil
+}
+
+// authParamsBounds finds msgAuthenticationParameters in an encoded SNMPv3
+// message.
+func authParamsBounds(msg []byte) (int, int, error) {
+	// SEQUENCE { msgVersion, msgGlobalData, msgSecurityParameters, msgData }
+	idx, _, err := tlvBounds(msg, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	for i := 0; i < 2; i++ {
+		if _, idx, err = tlvBounds(msg, idx); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	// msgSecurityParameters is an OCTET STRING wrapping a SEQUENCE {
+	// engineID, engineBoots, engineTime, userName, authParams, privParams }.
+	if idx >= len(msg) || BERType(msg[idx]) != AsnOctetStr {
+		return 0, 0, errors.New("msgSecurityParameters is not an octet string")
+	}
+	if idx, _, err = tlvBounds(msg, idx); err != nil {
+		return 0, 0, err
+	}
+	if idx, _, err = tlvBounds(msg, idx); err != nil {
+		return 0, 0, err
+	}
+	for i := 0; i < 4; i++ {
+		if _, idx, err = tlvBounds(msg, idx); err != nil {
+			return 0, 0, err
+		}
+	}
+	if idx >= len(msg) || BERType(msg[idx]) != AsnOctetStr {
+		return 0, 0, errors.New("msgAuthenticationParameters is not an octet string")
+	}
+	return tlvBounds(msg, idx)
+}
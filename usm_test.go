@@ -0,0 +1,111 @@
+package wapsnmp
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestPasswordToKey(t *testing.T) {
+	// Test vectors for MD5 and SHA are from RFC 3414 appendix A.3.
+	engineID, _ := hex.DecodeString("000000000000000000000002")
+	tests := []struct {
+		proto AuthProtocol
+		want  string
+	}{
+		{AuthMD5, "526f5eed9fcce26f8964c2930787d82b"},
+		{AuthSHA, "6695febc9288e36282235fc7151f128497b38f3f"},
+		{AuthSHA224, "0bd8827c6e29f8065e08e09237f177e410f69b90e1782be682075674"},
+		{AuthSHA256, "8982e0e549e866db361a6b625d84cccc11162d453ee8ce3a6445c2d6776f0f8b"},
+		{AuthSHA384, "3b298f16164a11184279d5432bf169e2d2a48307de02b3d3f7e2b4f36eb6f0455a53689a3937eea07319a633d2ccba78"},
+		{AuthSHA512, "22a5a36cedfcc085807a128d7bc6c2382167ad6c0dbc5fdff856740f3d84c099ad1ea87a8db096714d9788bd544047c9021e4229ce27e4c0a69250adfcffbb0b"},
+	}
+
+	for _, test := range tests {
+		key, err := PasswordToKey(test.proto, "maplesyrup", engineID)
+		if err != nil {
+			t.Errorf("PasswordToKey(%v, ...) returned error %v", test.proto, err)
+			continue
+		}
+		if hex.EncodeToString(key) != test.want {
+			t.Errorf("PasswordToKey(%v, ...) => %x, want %v", test.proto, key, test.want)
+		}
+	}
+
+	if _, err := PasswordToKey(AuthSHA, "", engineID); err == nil {
+		t.Errorf("PasswordToKey with an empty password returned no error")
+	}
+}
+
+// testAgentUSM returns the USM settings shared by the v3 tests.
+func testAgentUSM() *USM {
+	engineID, _ := hex.DecodeString("80001f8880e9bd0c1d12667a5100000000")
+	return &USM{
+		UserName:                 "authuser",
+		AuthProtocol:             AuthSHA,
+		AuthPassword:             "maplesyrup",
+		AuthoritativeEngineID:    string(engineID),
+		AuthoritativeEngineBoots: 5,
+		AuthoritativeEngineTime:  1000,
+	}
+}
+
+// The SNMPv3 responses of the tests are fixtures in the form net-snmp's agent
+// sends them, e.g. with a msgMaxSize of 65507, built independently of this
+// package with Python's hashlib and hmac and the OpenSSL command line tool,
+// so they catch interoperability bugs in msgFlags, the layout of the
+// msgSecurityParameters and the HMAC placeholder. The user is authuser of
+// testAgentUSM, with authentication password maplesyrup and, for authPriv,
+// privacy password privpassword.
+
+func TestGetV3(t *testing.T) {
+	rand.Seed(0)
+
+	oid := MustParseOid("1.3.6.1.2.1.1.5.0")
+
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	// Expect an authenticated (authNoPriv, HMAC-SHA-96) GET packet.
+	udpStub.Expect("308182020103301002041f5b04120202400004010502010304363034041180001f8880e9bd0c1d12667a51000000" +
+		"00020105020203e804086175746875736572040c82f10567c779303583643a6604003033041180001f8880e9bd0c1d12667a" +
+		"51000000000400a01c020478fc2ffa020100020100300e300c06082b060102010105000500").AndRespond([]string{
+		"30818a020103301102041f5b0412020300ffe304010102010304363034041180001f8880e9bd0c1d12667a5100000000" +
+			"020105020203e804086175746875736572040ceffd3b85aa1739bdd10a49a10400303a041180001f8880e9bd0c1d1266" +
+			"7a51000000000400a223020478fc2ffa0201000201003015301306082b060102010105000407726f7574657231",
+	})
+
+	wsnmp := NewWapSNMPv3OnConn("magic_host", testAgentUSM(), 2*time.Second, 5, udpStub)
+	defer wsnmp.Close()
+	val, err := wsnmp.Get(oid)
+	if err != nil {
+		t.Fatalf("Get() returned error %v", err)
+	}
+	if val != "router1" {
+		t.Errorf("Get() => %v, want router1", val)
+	}
+}
+
+func TestV3WrongDigest(t *testing.T) {
+	usm := testAgentUSM()
+	resp, err := usm.encodeMessage(1, []interface{}{AsnGetResponse, 1, 0, 0, []interface{}{Sequence}})
+	if err != nil {
+		t.Fatalf("encodeMessage() returned error %v", err)
+	}
+	if _, _, err := usm.decodeMessage(resp); err != nil {
+		t.Fatalf("decodeMessage() of an authentic message returned error %v", err)
+	}
+
+	// Flip a bit in the PDU, the digest should no longer match.
+	resp[len(resp)-3] ^= 1
+	if _, _, err := usm.decodeMessage(resp); err == nil {
+		t.Errorf("decodeMessage() of a tampered message returned no error")
+	}
+
+	other := testAgentUSM()
+	other.AuthPassword = "notmaplesyrup"
+	resp[len(resp)-3] ^= 1
+	if _, _, err := other.decodeMessage(resp); err == nil {
+		t.Errorf("decodeMessage() with the wrong password returned no error")
+	}
+}
@@ -0,0 +1,395 @@
+package wapsnmp
+
+/* This file implements walking a subtree of an agent's MIB, with GetNext or
+   GetBulk requests.
+
+   References : RFC 3416 section 4.2.2 and 4.2.3 (the oids a GetNext or GetBulk
+                returns are lexicographically greater than the ones asked for),
+                RFC 3584 section 4.1.2.1
+                (SNMPv1 agents signal the end of the MIB with noSuchName),
+                RFC 3417 section 3.2 (fragmented datagrams are often lost).
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"sync"
+	"time"
+)
+
+// WalkStrategy selects the requests used to walk a subtree.
+type WalkStrategy int
+
+const (
+	// WalkAuto uses GetNext requests for SNMPv1, which has no GetBulk, and
+	// GetBulk requests otherwise.
+	WalkAuto WalkStrategy = iota
+	// WalkGetBulk always uses GetBulk requests.
+	WalkGetBulk
+	// WalkGetNext always uses GetNext requests, for devices that mishandle
+	// GetBulk.
+	WalkGetNext
+)
+
+// SetWalkStrategy selects the requests GetTable uses. The default is
+// WalkAuto.
+func (w *WapSNMP) SetWalkStrategy(strategy WalkStrategy) {
+	w.strategy = strategy
+}
+
+// ErrWalkLimit is returned, wrapped, when a walk stops because it reached one
+// of its WalkLimits.
+var ErrWalkLimit = errors.New("walk limit reached")
+
+// ErrNotIncreasing is returned, wrapped, when an agent answers a GetNext or
+// GetBulk with an oid that isn't after the previous one. Following such an
+// agent could loop forever.
+var ErrNotIncreasing = errors.New("agent returned oids out of lexicographic order")
+
+// WalkLimits bounds a walk of a subtree, so a huge table or a misbehaving
+// agent can't keep it going for too long.
+type WalkLimits struct {
+	MaxRows     int           // Values after which a walk stops, none when 0.
+	MaxDuration time.Duration // Time after which a walk stops, none when 0.
+}
+
+// SetWalkLimits bounds the walks of GetTable, GetTableFunc, GetTableSeq and
+// Walk. A walk that reaches a limit stops with an error wrapping
+// ErrWalkLimit. There are no limits by default.
+func (w *WapSNMP) SetWalkLimits(limits WalkLimits) {
+	w.limits = limits
+}
+
+const (
+	// defaultMaxRepetitions is the max-repetitions GetTable starts with.
+	defaultMaxRepetitions = 50
+	// maxMaxRepetitions caps how far GetTable grows the max-repetitions.
+	maxMaxRepetitions = 1000
+	// maxUnfragmented is the largest UDP payload that fits in an Ethernet
+	// frame. GetTable only grows the max-repetitions while the response
+	// would still fit when doubled.
+	maxUnfragmented = 1472
+)
+
+// repetitions is the max-repetitions GetTable uses with a device. It halves
+// when a GetBulk request times out or is answered with tooBig, and doubles when
+// responses come back fast and small, but stays below the smallest value that
+// failed.
+type repetitions struct {
+	mu      sync.Mutex
+	current int
+	failed  int // Smallest value that failed, 0 if none did.
+}
+
+func newRepetitions(n int) *repetitions {
+	return &repetitions{current: n}
+}
+
+func (r *repetitions) get() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// reset starts over from n, forgetting the values that failed.
+func (r *repetitions) reset(n int) {
+	r.restore(n, 0)
+}
+
+func (r *repetitions) snapshot() (current, failed int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current, r.failed
+}
+
+func (r *repetitions) restore(current, failed int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current, r.failed = current, failed
+}
+
+// shrink records that a request with n repetitions failed.
+func (r *repetitions) shrink(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failed == 0 || n < r.failed {
+		r.failed = n
+	}
+	if r.current >= n {
+		r.current = max(n/2, 1)
+	}
+}
+
+// grow records that a request with n repetitions was answered fast, with a
+// small response.
+func (r *repetitions) grow(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current != n {
+		// Another walk changed it in the meantime.
+		return
+	}
+	r.current = min(2*n, maxMaxRepetitions)
+	if r.failed > 0 {
+		r.current = max(min(r.current, r.failed-1), n)
+	}
+}
+
+// SetMaxRepetitions sets the max-repetitions GetTable starts with, 50 by
+// default. GetTable halves it when a GetBulk request is answered with tooBig,
+// or times out while the device does answer a single repetition, and doubles
+// it when responses come back fast and small. The value it ends up with is
+// used by the next walks.
+func (w *WapSNMP) SetMaxRepetitions(n int) {
+	if n < 1 {
+		n = 1
+	}
+	if w.reps == nil {
+		w.reps = newRepetitions(n)
+		return
+	}
+	w.reps.reset(n)
+}
+
+// MaxRepetitions returns the max-repetitions the next GetTable starts with.
+func (w WapSNMP) MaxRepetitions() int {
+	if w.reps == nil {
+		return defaultMaxRepetitions
+	}
+	return w.reps.get()
+}
+
+// Walk gets all values in a subtree with GetNext requests, in the order the
+// agent returns them. It works with all agents, but needs a request for every
+// value; GetTable is faster with agents that support GetBulk. If the walk
+// fails, the values before the error are returned with it.
+func (w WapSNMP) Walk(oid Oid) ([]SNMPValue, error) {
+	return w.WalkContext(context.Background(), oid)
+}
+
+// WalkContext is Walk with a context. Cancelling ctx aborts the request in
+// progress, and stops the walk.
+func (w WapSNMP) WalkContext(ctx context.Context, oid Oid) ([]SNMPValue, error) {
+	var result []SNMPValue
+	err := w.limitWalk(ctx, oid, w.walkGetNext, func(v SNMPValue) bool {
+		result = append(result, v)
+		return true
+	})
+	return result, err
+}
+
+// GetTableFunc calls fn for every value in a subtree as the responses arrive,
+// in lexicographic order, instead of collecting them like GetTable does. The
+// walk stops when fn returns false. Uses the same requests as GetTable.
+func (w WapSNMP) GetTableFunc(ctx context.Context, oid Oid, fn func(oid Oid, value interface{}) bool) error {
+	return w.walk(ctx, oid, func(v SNMPValue) bool {
+		return fn(v.Oid, v.Value)
+	})
+}
+
+// GetTableSeq returns an iterator over the values in a subtree, like
+// GetTableFunc, and a function returning the error that ended the last walk
+// over it. The walk stops when the loop over it does, which isn't an error:
+//
+//	values, errf := wsnmp.GetTableSeq(ctx, oid)
+//	for oid, value := range values {
+//		...
+//	}
+//	if err := errf(); err != nil {
+//		return err
+//	}
+func (w WapSNMP) GetTableSeq(ctx context.Context, oid Oid) (iter.Seq2[Oid, interface{}], func() error) {
+	var err error
+	seq := func(yield func(Oid, interface{}) bool) {
+		err = w.GetTableFunc(ctx, oid, yield)
+	}
+	return seq, func() error { return err }
+}
+
+// walk calls yield for every value in a subtree, using the requests the walk
+// strategy selects, until yield returns false.
+func (w WapSNMP) walk(ctx context.Context, oid Oid, yield func(SNMPValue) bool) error {
+	strategy := w.strategy
+	if strategy == WalkAuto {
+		strategy = WalkGetBulk
+		if w.Version == SNMPv1 {
+			strategy = WalkGetNext
+		}
+	}
+	if strategy == WalkGetNext {
+		return w.limitWalk(ctx, oid, w.walkGetNext, yield)
+	}
+	return w.limitWalk(ctx, oid, w.walkGetBulk, yield)
+}
+
+// limitWalk runs walk, stopping it when it reaches the walk limits.
+func (w WapSNMP) limitWalk(ctx context.Context, oid Oid, walk func(context.Context, Oid, func(SNMPValue) bool) error,
+	yield func(SNMPValue) bool) error {
+	limits := w.limits
+	walkCtx := ctx
+	if limits.MaxDuration > 0 {
+		var cancel context.CancelFunc
+		walkCtx, cancel = context.WithTimeout(ctx, limits.MaxDuration)
+		defer cancel()
+	}
+
+	start := time.Now()
+	rows := 0
+	tooMany := false
+	err := walk(walkCtx, oid, func(v SNMPValue) bool {
+		if limits.MaxRows > 0 && rows >= limits.MaxRows {
+			tooMany = true
+			return false
+		}
+		rows++
+		return yield(v)
+	})
+	switch {
+	case tooMany:
+		return fmt.Errorf("walk of %v stopped after %d values: %w", oid, rows, ErrWalkLimit)
+	case err != nil && limits.MaxDuration > 0 && time.Since(start) >= limits.MaxDuration && ctx.Err() == nil:
+		return fmt.Errorf("walk of %v stopped after %v and %d values: %w", oid, limits.MaxDuration, rows,
+			ErrWalkLimit)
+	case err != nil && err == ctx.Err():
+		return err
+	case err != nil:
+		return fmt.Errorf("walk of %v failed after %d values: %w", oid, rows, err)
+	}
+	return nil
+}
+
+// walkGetNext calls yield for every value in a subtree, with GetNext requests,
+// until yield returns false.
+func (w WapSNMP) walkGetNext(ctx context.Context, oid Oid, yield func(SNMPValue) bool) error {
+	lastOid := oid.Copy()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		varbinds, err := w.request(ctx, &PDU{Type: AsnGetNextRequest, RequestID: RandomRequestID(),
+			VarBinds: []VarBind{{lastOid, nil}}})
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			if w.Version == SNMPv1 && errors.Is(err, NoSuchName) {
+				// The end of the MIB.
+				return nil
+			}
+			return fmt.Errorf("received GetNext error => %w", err)
+		}
+		if err := expectVarbinds(varbinds, 1); err != nil {
+			return err
+		}
+
+		v := varbinds[0]
+		if IsException(v.Value) || !v.Oid.Within(oid) {
+			// Past the end of the MIB or the subtree. Agents shouldn't return
+			// noSuchObject or noSuchInstance here, take them to mean the same
+			// as endOfMibView.
+			return nil
+		}
+		if v.Oid.Compare(lastOid) <= 0 {
+			return fmt.Errorf("agent returned %v after %v: %w", v.Oid, lastOid, ErrNotIncreasing)
+		}
+		if !yield(v) {
+			return nil
+		}
+		lastOid = v.Oid
+	}
+}
+
+// walkGetBulk calls yield for every value in a subtree, with GetBulk requests,
+// until yield returns false. The max-repetitions adapt to the device.
+func (w WapSNMP) walkGetBulk(ctx context.Context, oid Oid, yield func(SNMPValue) bool) error {
+	reps := w.reps
+	if reps == nil {
+		reps = newRepetitions(defaultMaxRepetitions)
+	}
+	fast := w.retryPolicy().AttemptTimeout(0) / 4
+	current, failed := reps.snapshot()
+
+	// getBulk asks for n repetitions after lastOid, with the given policy.
+	getBulk := func(w WapSNMP, lastOid Oid, n int) ([]SNMPValue, int, error) {
+		respPDU, size, err := w.exchange(ctx, &BulkPDU{RequestID: RandomRequestID(), MaxRepetitions: n,
+			VarBinds: []VarBind{{lastOid, nil}}})
+		if err != nil {
+			return nil, 0, err
+		}
+		return respPDU.VarBinds, size, nil
+	}
+
+	lastOid := oid.Copy()
+	answered := false // Whether the device answered during this walk.
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n := reps.get()
+		start := time.Now()
+		results, size, err := getBulk(w, lastOid, n)
+		elapsed := time.Since(start)
+		probed := false
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			switch {
+			case n > 1 && errors.Is(err, TooBig), n > 1 && errors.Is(err, ErrTimeout) && answered:
+				// The device drops or refuses responses this large, try
+				// again with fewer repetitions.
+				answered = true
+				reps.shrink(n)
+				continue
+			case n > 1 && errors.Is(err, ErrTimeout):
+				// A device that never answered may be down rather than
+				// overwhelmed. Only shrink if it answers a single attempt for
+				// one repetition.
+				probe := w
+				probe.policy = &ConstantRetry{Timeout: w.retryPolicy().AttemptTimeout(0)}
+				if results, _, err = getBulk(probe, lastOid, 1); err == nil {
+					reps.shrink(n)
+					probed = true
+				}
+			}
+		}
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			if errors.Is(err, ErrTimeout) {
+				// A device that doesn't answer a single repetition is down,
+				// not overwhelmed. Forget what this walk learned.
+				reps.restore(current, failed)
+			}
+			return fmt.Errorf("received GetBulk error => %w", err)
+		}
+		answered = true
+
+		if len(results) == 0 {
+			// Nothing after lastOid.
+			return nil
+		}
+		for _, v := range results {
+			if IsException(v.Value) || !v.Oid.Within(oid) {
+				// Past the end of the MIB or the subtree. Agents shouldn't
+				// return noSuchObject or noSuchInstance here, take them to
+				// mean the same as endOfMibView.
+				return nil
+			}
+			if v.Oid.Compare(lastOid) <= 0 {
+				return fmt.Errorf("agent returned %v after %v: %w", v.Oid, lastOid, ErrNotIncreasing)
+			}
+			if !yield(v) {
+				return nil
+			}
+			lastOid = v.Oid
+		}
+
+		if !probed && len(results) == n && elapsed < fast && 2*size <= maxUnfragmented {
+			reps.grow(n)
+		}
+	}
+}
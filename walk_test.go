@@ -0,0 +1,345 @@
+package wapsnmp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testIfEntry = []SNMPValue{
+	{MustParseOid(".1.3.6.1.2.1.2.2.1.1.1"), int64(1)},
+	{MustParseOid(".1.3.6.1.2.1.2.2.1.1.2"), int64(2)},
+	{MustParseOid(".1.3.6.1.2.1.2.2.1.2.1"), "lo"},
+	{MustParseOid(".1.3.6.1.2.1.2.2.1.2.2"), "eth0"},
+}
+
+func TestWalk(t *testing.T) {
+	for _, version := range []SNMPVersion{SNMPv1, SNMPv2c} {
+		a, wsnmp := startTestAgent(t, "public", version)
+		defer a.Close()
+		defer wsnmp.Close()
+
+		got, err := wsnmp.Walk(MustParseOid(".1.3.6.1.2.1.2.2.1"))
+		if err != nil || !reflect.DeepEqual(got, testIfEntry) {
+			t.Errorf("SNMP version %d: Walk(ifEntry) => %v, %v, want %v", version, got, err, testIfEntry)
+		}
+
+		// ifDescr is the end of the agent's MIB.
+		got, err = wsnmp.Walk(MustParseOid(".1.3.6.1.2.1.2.2.1.2"))
+		if err != nil || !reflect.DeepEqual(got, testIfEntry[2:]) {
+			t.Errorf("SNMP version %d: Walk(ifDescr) => %v, %v, want %v", version, got, err, testIfEntry[2:])
+		}
+	}
+}
+
+func TestGetTableStrategy(t *testing.T) {
+	want := map[string]interface{}{}
+	for _, v := range testIfEntry {
+		want[v.Oid.String()] = v.Value
+	}
+
+	// SNMPv1 has no GetBulk, so GetTable walks with GetNext.
+	a, wsnmp := startTestAgent(t, "public", SNMPv1)
+	defer a.Close()
+	defer wsnmp.Close()
+	if got, err := wsnmp.GetTable(MustParseOid(".1.3.6.1.2.1.2.2.1")); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("SNMPv1 GetTable(ifEntry) => %v, %v, want %v", got, err, want)
+	}
+
+	// Forcing GetBulk fails, the agent drops GetBulk requests in SNMPv1 messages.
+	wsnmp.SetWalkStrategy(WalkGetBulk)
+	wsnmp.SetRetryPolicy(&ConstantRetry{Timeout: 50 * time.Millisecond})
+	if _, err := wsnmp.GetTable(MustParseOid(".1.3.6.1.2.1.2.2.1")); !errors.Is(err, ErrTimeout) {
+		t.Errorf("SNMPv1 GetTable(ifEntry) with GetBulk returned %v, want %v", err, ErrTimeout)
+	}
+
+	a2, wsnmp2 := startTestAgent(t, "public", SNMPv2c)
+	defer a2.Close()
+	defer wsnmp2.Close()
+	wsnmp2.SetWalkStrategy(WalkGetNext)
+	if got, err := wsnmp2.GetTable(MustParseOid(".1.3.6.1.2.1.2.2.1")); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("SNMPv2c GetTable(ifEntry) with GetNext => %v, %v, want %v", got, err, want)
+	}
+}
+
+func TestGetTableSeq(t *testing.T) {
+	a, wsnmp := startTestAgent(t, "public", SNMPv2c)
+	defer a.Close()
+	defer wsnmp.Close()
+	ifEntry := MustParseOid(".1.3.6.1.2.1.2.2.1")
+
+	var got []SNMPValue
+	values, errf := wsnmp.GetTableSeq(context.Background(), ifEntry)
+	for oid, value := range values {
+		got = append(got, SNMPValue{oid, value})
+	}
+	if err := errf(); err != nil || !reflect.DeepEqual(got, testIfEntry) {
+		t.Errorf("GetTableSeq(ifEntry) => %v, %v, want %v", got, err, testIfEntry)
+	}
+
+	// Breaking out of the loop stops the walk.
+	got = nil
+	for oid, value := range values {
+		got = append(got, SNMPValue{oid, value})
+		if len(got) == 2 {
+			break
+		}
+	}
+	if err := errf(); err != nil || !reflect.DeepEqual(got, testIfEntry[:2]) {
+		t.Errorf("GetTableSeq(ifEntry) with break => %v, %v, want %v", got, err, testIfEntry[:2])
+	}
+
+	calls := 0
+	err := wsnmp.GetTableFunc(context.Background(), ifEntry, func(oid Oid, value interface{}) bool {
+		calls++
+		return false
+	})
+	if err != nil || calls != 1 {
+		t.Errorf("GetTableFunc() returning false => %d calls, %v, want 1 call", calls, err)
+	}
+
+	// Errors are returned separately.
+	wsnmp.SetRetryPolicy(&ConstantRetry{Timeout: 50 * time.Millisecond})
+	wsnmp.Community = "wrong"
+	values, errf = wsnmp.GetTableSeq(context.Background(), ifEntry)
+	for oid := range values {
+		t.Errorf("GetTableSeq() with the wrong community returned %v", oid)
+	}
+	if err := errf(); !errors.Is(err, ErrTimeout) {
+		t.Errorf("GetTableSeq() with the wrong community returned error %v, want %v", err, ErrTimeout)
+	}
+}
+
+// startFakeAgent starts an agent that answers every request with what
+// respond returns, nothing when it returns nil.
+func startFakeAgent(t *testing.T, respond func(msg *Message, packet []byte) []byte) (*WapSNMP, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error creating socket: %v", err)
+	}
+	go func() {
+		buf := make([]byte, bufSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg Message
+			if err := msg.Unmarshal(buf[:n]); err != nil {
+				continue
+			}
+			if response := respond(&msg, buf[:n]); response != nil {
+				conn.WriteTo(response, addr)
+			}
+		}
+	}()
+
+	clientConn, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		conn.Close()
+		t.Fatalf("error connecting to agent: %v", err)
+	}
+	wsnmp := NewWapSNMPOnConn("localhost", "public", SNMPv2c, time.Second, 0, clientConn)
+	return wsnmp, func() { wsnmp.Close(); conn.Close() }
+}
+
+// startLimitedAgent starts a test agent that drops GetBulk requests for more
+// than drop repetitions, and answers those for more than tooBig repetitions
+// with tooBig. It counts the requests over tooBig repetitions.
+func startLimitedAgent(t *testing.T, drop, tooBig int) (*WapSNMP, func(), *int32) {
+	a := newTestAgent()
+	var large int32
+	wsnmp, stop := startFakeAgent(t, func(msg *Message, packet []byte) []byte {
+		if bulk, ok := msg.PDU.(*BulkPDU); ok && bulk.MaxRepetitions > tooBig {
+			atomic.AddInt32(&large, 1)
+			if bulk.MaxRepetitions > drop {
+				return nil
+			}
+			response, _ := (&Message{msg.Version, msg.Community, &PDU{Type: AsnGetResponse,
+				RequestID: bulk.RequestID, ErrorStatus: TooBig}}).Marshal()
+			return response
+		}
+		response, _ := a.handlePacket(packet)
+		return response
+	})
+	return wsnmp, stop, &large
+}
+
+func TestGetTableShrinksRepetitions(t *testing.T) {
+	wsnmp, stop, large := startLimitedAgent(t, 16, 8)
+	defer stop()
+	wsnmp.SetRetryPolicy(&ConstantRetry{Timeout: 50 * time.Millisecond})
+	want := map[string]interface{}{}
+	for _, v := range testIfEntry {
+		want[v.Oid.String()] = v.Value
+	}
+
+	// 50 and 25 repetitions time out, 12 gets tooBig, 6 works.
+	ifEntry := MustParseOid(".1.3.6.1.2.1.2.2.1")
+	if got, err := wsnmp.GetTable(ifEntry); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("GetTable(ifEntry) => %v, %v, want %v", got, err, want)
+	}
+	if got := wsnmp.MaxRepetitions(); got != 6 {
+		t.Errorf("MaxRepetitions() => %d, want 6", got)
+	}
+
+	// The next walk starts with what worked.
+	atomic.StoreInt32(large, 0)
+	if got, err := wsnmp.GetTable(ifEntry); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("second GetTable(ifEntry) => %v, %v, want %v", got, err, want)
+	}
+	if got := atomic.LoadInt32(large); got != 0 {
+		t.Errorf("second GetTable() sent %d requests with too many repetitions, want 0", got)
+	}
+
+	// Failures that aren't about the size don't shrink it.
+	wsnmp.Community = "wrong"
+	if _, err := wsnmp.GetTable(ifEntry); !errors.Is(err, ErrTimeout) {
+		t.Errorf("GetTable() with the wrong community returned %v, want %v", err, ErrTimeout)
+	}
+	if got := wsnmp.MaxRepetitions(); got != 6 {
+		t.Errorf("MaxRepetitions() after the device stopped answering => %d, want 6", got)
+	}
+}
+
+func TestGetTableDeadDevice(t *testing.T) {
+	var requests int32
+	wsnmp, stop := startFakeAgent(t, func(msg *Message, packet []byte) []byte {
+		atomic.AddInt32(&requests, 1)
+		return nil
+	})
+	defer stop()
+	wsnmp.SetRetryPolicy(&ConstantRetry{Timeout: 50 * time.Millisecond, Retries: 2})
+
+	// The retries of the first request, and a single probe for one
+	// repetition, instead of retries for every halved value.
+	if _, err := wsnmp.GetTable(MustParseOid(".1.3.6.1.2.1.2.2.1")); !errors.Is(err, ErrTimeout) {
+		t.Errorf("GetTable() of a dead device returned %v, want %v", err, ErrTimeout)
+	}
+	if got := atomic.LoadInt32(&requests); got != 4 {
+		t.Errorf("GetTable() of a dead device sent %d requests, want 4", got)
+	}
+	if got := wsnmp.MaxRepetitions(); got != defaultMaxRepetitions {
+		t.Errorf("MaxRepetitions() after a dead device => %d, want %d", got, defaultMaxRepetitions)
+	}
+}
+
+func TestGetTableGrowsRepetitions(t *testing.T) {
+	a, wsnmp := startTestAgent(t, "public", SNMPv2c)
+	defer a.Close()
+	defer wsnmp.Close()
+	wsnmp.SetMaxRepetitions(1)
+
+	// Full responses of 1 and 2 repetitions grow it, the end of the MIB
+	// doesn't.
+	got, err := wsnmp.GetTable(MustParseOid(".1.3.6.1.2.1"))
+	if err != nil || len(got) != 6 {
+		t.Errorf("GetTable(mib-2) => %v, %v, want 6 values", got, err)
+	}
+	if got := wsnmp.MaxRepetitions(); got != 4 {
+		t.Errorf("MaxRepetitions() => %d, want 4", got)
+	}
+}
+
+func TestRepetitions(t *testing.T) {
+	r := newRepetitions(40)
+	r.shrink(40)
+	r.shrink(40) // Another walk failing with the same value.
+	if got := r.get(); got != 20 {
+		t.Errorf("get() after shrink(40) => %d, want 20", got)
+	}
+	r.grow(20)
+	if got := r.get(); got != 39 {
+		t.Errorf("get() after grow(20) => %d, want 39, below the value that failed", got)
+	}
+	r.grow(39)
+	if got := r.get(); got != 39 {
+		t.Errorf("get() after grow(39) => %d, want 39", got)
+	}
+	r.reset(1)
+	r.shrink(1)
+	if got := r.get(); got != 1 {
+		t.Errorf("get() after shrink(1) => %d, want 1", got)
+	}
+}
+
+func TestWalkLimits(t *testing.T) {
+	a, wsnmp := startTestAgent(t, "public", SNMPv2c)
+	defer a.Close()
+	defer wsnmp.Close()
+	ifEntry := MustParseOid(".1.3.6.1.2.1.2.2.1")
+
+	wsnmp.SetWalkLimits(WalkLimits{MaxRows: 3})
+	if got, err := wsnmp.GetTable(ifEntry); !errors.Is(err, ErrWalkLimit) || len(got) != 3 {
+		t.Errorf("GetTable() with MaxRows 3 => %v, %v, want 3 values and %v", got, err, ErrWalkLimit)
+	}
+	if got, err := wsnmp.Walk(ifEntry); !errors.Is(err, ErrWalkLimit) || !reflect.DeepEqual(got, testIfEntry[:3]) {
+		t.Errorf("Walk() with MaxRows 3 => %v, %v, want %v and %v", got, err, testIfEntry[:3], ErrWalkLimit)
+	}
+	wsnmp.SetWalkLimits(WalkLimits{MaxRows: 4})
+	if got, err := wsnmp.GetTable(ifEntry); err != nil || len(got) != 4 {
+		t.Errorf("GetTable() with MaxRows 4 => %v, %v, want 4 values", got, err)
+	}
+
+	// An agent that doesn't answer GetBulk, and doesn't get the chance to
+	// time out.
+	silent, stop, _ := startLimitedAgent(t, 0, 0)
+	defer stop()
+	silent.SetWalkLimits(WalkLimits{MaxDuration: 100 * time.Millisecond})
+	start := time.Now()
+	if _, err := silent.GetTable(ifEntry); !errors.Is(err, ErrWalkLimit) {
+		t.Errorf("GetTable() with MaxDuration returned %v, want %v", err, ErrWalkLimit)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("GetTable() with MaxDuration 100ms took %v", elapsed)
+	}
+}
+
+func TestWalkTermination(t *testing.T) {
+	ifIndex1 := MustParseOid(".1.3.6.1.2.1.2.2.1.1.1")
+	ifIndex2 := MustParseOid(".1.3.6.1.2.1.2.2.1.1.2")
+	tests := []struct {
+		name   string
+		second SNMPValue // The response to every request after the first.
+		err    error
+	}{
+		{"repeating oid", SNMPValue{ifIndex1, int64(1)}, ErrNotIncreasing},
+		{"decreasing oid", SNMPValue{MustParseOid(".1.3.6.1.2.1.2.2.1.1"), int64(1)}, ErrNotIncreasing},
+		{"endOfMibView", SNMPValue{ifIndex2, EndOfMibView}, nil},
+		{"noSuchObject", SNMPValue{ifIndex2, NoSuchObject}, nil},
+	}
+	for _, test := range tests {
+		for _, strategy := range []WalkStrategy{WalkGetNext, WalkGetBulk} {
+			wsnmp, stop := startFakeAgent(t, func(msg *Message, packet []byte) []byte {
+				var requestID int
+				var oid Oid
+				switch pdu := msg.PDU.(type) {
+				case *PDU:
+					requestID, oid = pdu.RequestID, pdu.VarBinds[0].Oid
+				case *BulkPDU:
+					requestID, oid = pdu.RequestID, pdu.VarBinds[0].Oid
+				}
+				v := test.second
+				if oid.Compare(ifIndex1) < 0 {
+					v = SNMPValue{ifIndex1, int64(1)}
+				}
+				response, _ := (&Message{msg.Version, msg.Community, &PDU{Type: AsnGetResponse,
+					RequestID: requestID, VarBinds: []VarBind{v}}}).Marshal()
+				return response
+			})
+			wsnmp.SetWalkStrategy(strategy)
+
+			want := map[string]interface{}{ifIndex1.String(): int64(1)}
+			got, err := wsnmp.GetTable(MustParseOid(".1.3.6.1.2.1.2.2.1"))
+			if !reflect.DeepEqual(got, want) || !errors.Is(err, test.err) {
+				t.Errorf("%s with strategy %d: GetTable() => %v, %v, want %v, %v", test.name, strategy, got, err,
+					want, test.err)
+			}
+			stop()
+		}
+	}
+}